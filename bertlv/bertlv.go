@@ -0,0 +1,235 @@
+// Package bertlv decodes and encodes the BER-TLV data objects of ISO 7816-4,
+// which OpenPGP cards use for their data objects and command data. Decoding is
+// safe on malformed input: truncated or overlong data objects are reported as
+// errors rather than read past the end of the data.
+package bertlv
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	// MaxTagLength is the longest tag supported, in bytes.
+	MaxTagLength = 4
+
+	// MaxDepth is the deepest nesting of constructed data objects decoded.
+	MaxDepth = 32
+
+	// maxLengthBytes is the longest length field supported after the 0x8x
+	// byte of the long form, which covers all lengths a slice can hold.
+	maxLengthBytes = 4
+)
+
+var (
+	ErrTruncated = errors.New("data object truncated")
+	ErrTagLength = errors.New("data object tag too long")
+	ErrLength    = errors.New("invalid data object length")
+	ErrDepth     = errors.New("data objects nested too deeply")
+)
+
+// TLV is a decoded data object. The value of a constructed data object is
+// decoded into its children, and is also kept as is.
+type TLV struct {
+	Tag      uint32
+	Value    []byte
+	Children []TLV
+}
+
+// Constructed reports whether the data object contains other data objects,
+// which is encoded in bit 6 of the first tag byte.
+func (t *TLV) Constructed() bool {
+	return IsConstructed(t.Tag)
+}
+
+// Find returns the first data object with the tag in the data object and its
+// descendants, searching depth first, or nil if there is none.
+func (t *TLV) Find(tag uint32) *TLV {
+	if t.Tag == tag {
+		return t
+	}
+
+	return Find(t.Children, tag)
+}
+
+// Encode encodes the data object. A constructed data object with children is
+// encoded from its children, otherwise the value is encoded.
+func (t *TLV) Encode() []byte {
+	if len(t.Children) == 0 {
+		return Encode(t.Tag, t.Value)
+	}
+
+	var value []byte
+	for i := range t.Children {
+		value = append(value, t.Children[i].Encode()...)
+	}
+
+	return Encode(t.Tag, value)
+}
+
+// IsConstructed reports whether the tag is of a constructed data object.
+func IsConstructed(tag uint32) bool {
+	return firstTagByte(tag)&0x20 != 0
+}
+
+// Find returns the first data object with the tag in the data objects and
+// their descendants, searching depth first, or nil if there is none.
+func Find(tlvs []TLV, tag uint32) *TLV {
+	for i := range tlvs {
+		if t := tlvs[i].Find(tag); t != nil {
+			return t
+		}
+	}
+
+	return nil
+}
+
+// Parse decodes a sequence of data objects, including the data objects nested
+// in constructed ones. The values of the returned data objects refer to data.
+// The bytes 00 and FF between data objects are skipped as padding.
+func Parse(data []byte) ([]TLV, error) {
+	return parse(data, 0)
+}
+
+func parse(data []byte, depth int) ([]TLV, error) {
+	if depth > MaxDepth {
+		return nil, ErrDepth
+	}
+
+	var tlvs []TLV
+
+	for len(data) > 0 {
+		// skip padding between data objects
+		if data[0] == 0x00 || data[0] == 0xff {
+			data = data[1:]
+			continue
+		}
+
+		tag, rest, err := parseTag(data)
+		if err != nil {
+			return nil, err
+		}
+
+		n, rest, err := parseLength(rest)
+		if err != nil {
+			return nil, fmt.Errorf("%w (tag %x)", err, tag)
+		}
+
+		t := TLV{Tag: tag, Value: rest[:n:n]}
+		if t.Constructed() {
+			if t.Children, err = parse(t.Value, depth+1); err != nil {
+				return nil, err
+			}
+		}
+
+		tlvs = append(tlvs, t)
+		data = rest[n:]
+	}
+
+	return tlvs, nil
+}
+
+// parseTag decodes a tag of up to MaxTagLength bytes. If the low 5 bits of the
+// first byte are set, subsequent bytes follow as long as bit 8 is set.
+func parseTag(data []byte) (uint32, []byte, error) {
+	if len(data) == 0 {
+		return 0, nil, ErrTruncated
+	}
+
+	tag := uint32(data[0])
+	if data[0]&0x1f != 0x1f {
+		return tag, data[1:], nil
+	}
+
+	for i := 1; ; i++ {
+		if i >= len(data) {
+			return 0, nil, ErrTruncated
+		}
+
+		if i >= MaxTagLength {
+			return 0, nil, ErrTagLength
+		}
+
+		tag = tag<<8 | uint32(data[i])
+		if data[i]&0x80 == 0 {
+			return tag, data[i+1:], nil
+		}
+	}
+}
+
+// parseLength decodes a length in the short form, or in the long form with up
+// to maxLengthBytes length bytes, and checks that the value fits in the data.
+// The indefinite form is not supported.
+func parseLength(data []byte) (int, []byte, error) {
+	if len(data) == 0 {
+		return 0, nil, ErrTruncated
+	}
+
+	// the short form holds lengths up to 127 in the first byte
+	k, n := 0, uint64(data[0])
+
+	if data[0] >= 0x80 {
+		k = int(data[0] & 0x7f)
+		if k == 0 || k > maxLengthBytes {
+			return 0, nil, ErrLength
+		}
+
+		if len(data) < 1+k {
+			return 0, nil, ErrTruncated
+		}
+
+		n = 0
+		for _, b := range data[1 : 1+k] {
+			n = n<<8 | uint64(b)
+		}
+	}
+
+	rest := data[1+k:]
+	if n > uint64(len(rest)) {
+		return 0, nil, ErrTruncated
+	}
+
+	return int(n), rest, nil
+}
+
+// Encode encodes a data object with the tag and value, using the short length
+// form for values up to 127 bytes and the shortest long form otherwise.
+func Encode(tag uint32, value []byte) []byte {
+	return append(EncodeTagLength(tag, len(value)), value...)
+}
+
+// EncodeTagLength encodes the tag and length of a data object without its
+// value, as used in the cardholder private key template.
+func EncodeTagLength(tag uint32, n int) []byte {
+	b := tagBytes(tag)
+
+	switch {
+	case n < 0x80:
+		b = append(b, uint8(n))
+	case n <= 0xff:
+		b = append(b, 0x81, uint8(n))
+	case n <= 0xffff:
+		b = append(b, 0x82, uint8(n>>8), uint8(n))
+	default:
+		b = append(b, 0x83, uint8(n>>16), uint8(n>>8), uint8(n))
+	}
+
+	return b
+}
+
+// tagBytes returns the bytes of the tag, without leading zero bytes.
+func tagBytes(tag uint32) []byte {
+	var b []byte
+	for shift := 24; shift > 0; shift -= 8 {
+		if tag>>shift != 0 {
+			b = append(b, uint8(tag>>shift))
+		}
+	}
+
+	return append(b, uint8(tag))
+}
+
+// firstTagByte returns the first byte of the encoded tag.
+func firstTagByte(tag uint32) byte {
+	return tagBytes(tag)[0]
+}
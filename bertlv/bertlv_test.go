@@ -0,0 +1,194 @@
+package bertlv
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	long := bytes.Repeat([]byte{0xab}, 300)
+
+	tests := []struct {
+		name string
+		data []byte
+		want []TLV
+	}{
+		{
+			name: "short length",
+			data: []byte{0x5a, 0x02, 0x01, 0x02},
+			want: []TLV{{Tag: 0x5a, Value: []byte{0x01, 0x02}}},
+		},
+		{
+			name: "0x81 length followed by another data object",
+			data: append(append([]byte{0xc0, 0x81, 0x80}, bytes.Repeat([]byte{0x01}, 0x80)...), 0xc1, 0x01, 0x02),
+			want: []TLV{
+				{Tag: 0xc0, Value: bytes.Repeat([]byte{0x01}, 0x80)},
+				{Tag: 0xc1, Value: []byte{0x02}},
+			},
+		},
+		{
+			name: "0x82 length followed by another data object",
+			data: append(append([]byte{0x5f, 0x48, 0x82, 0x01, 0x2c}, long...), 0x5f, 0x50, 0x01, 0x03),
+			want: []TLV{
+				{Tag: 0x5f48, Value: long},
+				{Tag: 0x5f50, Value: []byte{0x03}},
+			},
+		},
+		{
+			name: "three byte tag",
+			data: []byte{0x5f, 0xff, 0x01, 0x01, 0x04},
+			want: []TLV{{Tag: 0x5fff01, Value: []byte{0x04}}},
+		},
+		{
+			name: "padding between data objects",
+			data: []byte{0x00, 0xff, 0xc1, 0x01, 0x01, 0x00, 0x00, 0xc2, 0x00, 0xff},
+			want: []TLV{
+				{Tag: 0xc1, Value: []byte{0x01}},
+				{Tag: 0xc2, Value: []byte{}},
+			},
+		},
+		{
+			name: "constructed",
+			data: []byte{0x6e, 0x08, 0x73, 0x06, 0xc0, 0x01, 0x01, 0xc1, 0x01, 0x02},
+			want: []TLV{{
+				Tag:   0x6e,
+				Value: []byte{0x73, 0x06, 0xc0, 0x01, 0x01, 0xc1, 0x01, 0x02},
+				Children: []TLV{{
+					Tag:   0x73,
+					Value: []byte{0xc0, 0x01, 0x01, 0xc1, 0x01, 0x02},
+					Children: []TLV{
+						{Tag: 0xc0, Value: []byte{0x01}},
+						{Tag: 0xc1, Value: []byte{0x02}},
+					},
+				}},
+			}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(tt.data)
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+
+			if !equalTLVs(got, tt.want) {
+				t.Errorf("Parse() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	deep := []byte{0x01, 0x00}
+	for i := 0; i <= MaxDepth; i++ {
+		deep = Encode(0x21, deep)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"missing length", []byte{0xc0}, ErrTruncated},
+		{"truncated short value", []byte{0xc0, 0x03, 0x01, 0x02}, ErrTruncated},
+		{"truncated 0x81 value", []byte{0xc0, 0x81, 0x80, 0x01}, ErrTruncated},
+		{"truncated 0x82 length", []byte{0xc0, 0x82, 0x01}, ErrTruncated},
+		{"truncated 0x82 value", []byte{0xc0, 0x82, 0x01, 0x00, 0x01}, ErrTruncated},
+		{"truncated tag", []byte{0x7f}, ErrTruncated},
+		{"truncated nested value", []byte{0x73, 0x03, 0xc0, 0x05, 0x01}, ErrTruncated},
+		{"tag too long", []byte{0x5f, 0x81, 0x81, 0x81, 0x01, 0x00}, ErrTagLength},
+		{"indefinite length", []byte{0xc0, 0x80, 0x00, 0x00}, ErrLength},
+		{"length too long", []byte{0xc0, 0x85, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00}, ErrLength},
+		{"nested too deeply", deep, ErrDepth},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Parse(tt.data); !errors.Is(err, tt.err) {
+				t.Errorf("Parse() error = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestParseMaxDepth(t *testing.T) {
+	data := []byte{0x01, 0x00}
+	for i := 0; i < MaxDepth; i++ {
+		data = Encode(0x21, data)
+	}
+
+	tlvs, err := Parse(data)
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+
+	if Find(tlvs, 0x01) == nil {
+		t.Error("Find() did not find the innermost data object")
+	}
+}
+
+func TestEncodeTagLength(t *testing.T) {
+	tests := []struct {
+		tag  uint32
+		n    int
+		want []byte
+	}{
+		{0xc0, 0x7f, []byte{0xc0, 0x7f}},
+		{0xc0, 0x80, []byte{0xc0, 0x81, 0x80}},
+		{0x7f48, 0xff, []byte{0x7f, 0x48, 0x81, 0xff}},
+		{0x5f48, 0x100, []byte{0x5f, 0x48, 0x82, 0x01, 0x00}},
+		{0x4d, 0x10000, []byte{0x4d, 0x83, 0x01, 0x00, 0x00}},
+	}
+
+	for _, tt := range tests {
+		if got := EncodeTagLength(tt.tag, tt.n); !bytes.Equal(got, tt.want) {
+			t.Errorf("EncodeTagLength(%x, %d) = %x, want %x", tt.tag, tt.n, got, tt.want)
+		}
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	f.Add([]byte{0x6e, 0x08, 0x73, 0x06, 0xc0, 0x01, 0x01, 0xc1, 0x01, 0x02})
+	f.Add([]byte{0xc0, 0x81, 0x01, 0x01, 0xc1, 0x82, 0x00, 0x01, 0x02})
+	f.Add([]byte{0x00, 0xff, 0x5f, 0xff, 0x01, 0x00})
+	f.Add([]byte{0x7f, 0x49, 0x83, 0x00, 0x00, 0x00})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		tlvs, err := Parse(data)
+		if err != nil {
+			return
+		}
+
+		var encoded []byte
+		for i := range tlvs {
+			encoded = append(encoded, tlvs[i].Encode()...)
+		}
+
+		again, err := Parse(encoded)
+		if err != nil {
+			t.Fatalf("Parse() of re-encoded %x error = %v", encoded, err)
+		}
+
+		if len(again) != len(tlvs) {
+			t.Fatalf("Parse() of re-encoded data returned %d data objects, want %d", len(again), len(tlvs))
+		}
+	})
+}
+
+// equalTLVs reports whether the data objects have the same tags, values and
+// children.
+func equalTLVs(a, b []TLV) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i].Tag != b[i].Tag || !bytes.Equal(a[i].Value, b[i].Value) || !equalTLVs(a[i].Children, b[i].Children) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,46 @@
+package cmd
+
+import (
+	"vervet/vervet"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	rewrapRecipientFiles []string
+	rewrapRecipientSNs   []string
+	rewrapOutputFile     string
+)
+
+func init() {
+	keysRewrapSubCmd.Flags().StringArrayVarP(&rewrapRecipientFiles, "recipient", "r", nil, "file containing the PGP public key to encrypt to, may be repeated")
+	keysRewrapSubCmd.Flags().StringArrayVar(&rewrapRecipientSNs, "recipient-yubikey", nil, "serial number of a connected YubiKey to encrypt to, may be repeated")
+	keysRewrapSubCmd.Flags().StringVarP(&rewrapOutputFile, "output", "o", "", "file to write the updated keys to (default is to replace the key file)")
+
+	keysCmd.AddCommand(keysRewrapSubCmd)
+
+	rootCmd.AddCommand(keysCmd)
+}
+
+var keysCmd = &cobra.Command{
+	Use:   "keys",
+	Short: "Manage PGP-encrypted Vault unseal keys",
+	Long:  `Manage PGP-encrypted Vault unseal keys.`,
+}
+
+var keysRewrapSubCmd = &cobra.Command{
+	Use:   "rewrap <unseal key path>",
+	Short: "Re-encrypt unseal keys to new public keys",
+	Long: `Decrypt the unseal keys in the key file with a connected YubiKey and encrypt
+them to new PGP public keys, read from files or from connected YubiKeys. The
+decrypted unseal keys are never written to disk or displayed.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		keyPath := args[0]
+
+		err := vervet.RewrapKeyFile(keyPath, rewrapOutputFile, rewrapRecipientFiles, rewrapRecipientSNs)
+		if err != nil {
+			vervet.PrintFatal(err.Error(), 1)
+		}
+	},
+}
@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"vervet/vervet"
+
+	"github.com/spf13/cobra"
+)
+
+var unblockWithAdminPIN bool
+
+func init() {
+	pinUnblockSubCmd.Flags().BoolVar(&unblockWithAdminPIN, "admin-pin", false, "unblock with the admin PIN instead of the reset code")
+
+	pinCmd.AddCommand(pinChangeSubCmd)
+	pinCmd.AddCommand(pinChangeAdminSubCmd)
+	pinCmd.AddCommand(pinSetResetCodeSubCmd)
+	pinCmd.AddCommand(pinUnblockSubCmd)
+
+	rootCmd.AddCommand(pinCmd)
+}
+
+var pinCmd = &cobra.Command{
+	Use:   "pin",
+	Short: "Manage YubiKey OpenPGP PINs",
+	Long:  `Manage the PIN, admin PIN and reset code of the YubiKey OpenPGP application.`,
+}
+
+var pinChangeSubCmd = &cobra.Command{
+	Use:   "change <serial number>",
+	Short: "Change YubiKey PIN",
+	Long: `Change the PIN of the YubiKey, which is required to decrypt unseal keys. The
+new PIN must consist of digits and be within the length limits of the card.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := vervet.ChangePIN(args[0]); err != nil {
+			vervet.PrintFatal(err.Error(), 1)
+		}
+	},
+}
+
+var pinChangeAdminSubCmd = &cobra.Command{
+	Use:   "change-admin <serial number>",
+	Short: "Change YubiKey admin PIN",
+	Long: `Change the admin PIN of the YubiKey, which is required to generate and import
+keys and to change card settings.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := vervet.ChangeAdminPIN(args[0]); err != nil {
+			vervet.PrintFatal(err.Error(), 1)
+		}
+	},
+}
+
+var pinSetResetCodeSubCmd = &cobra.Command{
+	Use:   "set-reset-code <serial number>",
+	Short: "Set YubiKey reset code",
+	Long: `Set the reset code of the YubiKey, which allows a blocked PIN to be unblocked
+without the admin PIN. Requires the admin PIN.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := vervet.SetResetCode(args[0]); err != nil {
+			vervet.PrintFatal(err.Error(), 1)
+		}
+	},
+}
+
+var pinUnblockSubCmd = &cobra.Command{
+	Use:   "unblock <serial number>",
+	Short: "Unblock YubiKey PIN",
+	Long: `Set a new PIN for the YubiKey and reset its retry counter, which unblocks a PIN
+that ran out of retries. Requires the reset code, or the admin PIN if no reset
+code is set or --admin-pin is specified.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := vervet.UnblockPIN(args[0], unblockWithAdminPIN); err != nil {
+			vervet.PrintFatal(err.Error(), 1)
+		}
+	},
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net/url"
 	"os"
+	"path/filepath"
 	"vervet/vervet"
 
 	"github.com/mitchellh/go-homedir"
@@ -12,8 +13,13 @@ import (
 )
 
 var (
-	config     VervetConfig
-	configFile string
+	config           VervetConfig
+	configFile       string
+	simulatorKeyFile string
+	traceAPDUFile    string
+	replayAPDUFile   string
+	readerFilter     string
+	yubikeySerials   []string
 
 	vaultPort              int
 	vaultTLSDisable        bool
@@ -28,7 +34,11 @@ decrypt PGP-encrypted Vault unseal key using the YubiKey OpenPGP applet.`,
 )
 
 type VervetConfig struct {
-	Clusters map[string][]*VaultClusterConfig `hcl:"cluster" mapstructure:"cluster"`
+	Clusters      map[string][]*VaultClusterConfig `hcl:"cluster" mapstructure:"cluster"`
+	AttestationCA string                           `hcl:"attestation_ca" mapstructure:"attestation_ca"`
+	Reader        string                           `hcl:"reader" mapstructure:"reader"`
+	YubiKeys      []string                         `hcl:"yubikeys" mapstructure:"yubikeys"`
+	Manufacturers []string                         `hcl:"manufacturers" mapstructure:"manufacturers"`
 }
 
 type VaultClusterConfig struct {
@@ -46,6 +56,11 @@ func init() {
 	cobra.OnInitialize(initConfig)
 
 	rootCmd.PersistentFlags().StringVar(&configFile, "config", "", "config file (default is $HOME/.vervet/vervet.hcl)")
+	rootCmd.PersistentFlags().StringVar(&simulatorKeyFile, "simulator", "", "use a simulated OpenPGP card backed by the private key file instead of YubiKeys")
+	rootCmd.PersistentFlags().StringVar(&traceAPDUFile, "trace-apdu", "", "record APDUs exchanged with smart cards to file, PINs are redacted")
+	rootCmd.PersistentFlags().StringVar(&replayAPDUFile, "replay-apdu", "", "replay a recorded APDU trace file instead of using YubiKeys")
+	rootCmd.PersistentFlags().StringVar(&readerFilter, "reader", "", "only use smart card readers whose name matches the regular expression (default is reader from the config file)")
+	rootCmd.PersistentFlags().StringArrayVar(&yubikeySerials, "yubikey", nil, "only use the YubiKey with the serial number, may be repeated (default is yubikeys from the config file)")
 }
 
 func initConfig() {
@@ -71,6 +86,37 @@ func initConfig() {
 		vervet.PrintFatal(fmt.Sprintf("unable to decode into struct, %v", err), 1)
 	}
 
+	// resolve paths provided on the command line before changing the cwd
+	for _, path := range []*string{&simulatorKeyFile, &traceAPDUFile, &replayAPDUFile, &attestCAFile} {
+		if *path == "" {
+			continue
+		}
+
+		*path, err = filepath.Abs(*path)
+		if err != nil {
+			vervet.PrintFatal(err.Error(), 1)
+		}
+	}
+
+	// reader and YubiKey filters on the command line replace those in the
+	// config file
+	if readerFilter == "" {
+		readerFilter = config.Reader
+	}
+
+	if len(yubikeySerials) == 0 {
+		yubikeySerials = config.YubiKeys
+	}
+
+	vervet.SetCardOptions(vervet.CardOptions{
+		SimulatorKeyFile: simulatorKeyFile,
+		TraceFile:        traceAPDUFile,
+		ReplayFile:       replayAPDUFile,
+		ReaderFilter:     readerFilter,
+		Serials:          yubikeySerials,
+		Manufacturers:    config.Manufacturers,
+	})
+
 	// get vervet config direction and set as cwd
 	configDir, err := getConfigDir()
 	if err != nil {
@@ -105,7 +151,11 @@ func getVaultAddress(host string) string {
 }
 
 func (vc *VaultClusterConfig) keyring() ([]string, error) {
-	keys := vc.Keys
+	keys, err := vervet.NormalizeKeys(vc.Keys)
+	if err != nil {
+		return nil, err
+	}
+
 	if vc.KeyFile != "" {
 		kf, err := vervet.ReadKeyFile(vc.KeyFile)
 		if err != nil {
@@ -0,0 +1,196 @@
+package cmd
+
+import (
+	"fmt"
+	"vervet/vervet"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	exportPubKeyOutputFile string
+	exportPubKeyUserID     string
+	keygenSlot             string
+	keygenAlgo             string
+	keygenForce            bool
+	importSlot             string
+	importForce            bool
+	touchPolicySlot        string
+	attestSlot             string
+	attestCAFile           string
+)
+
+func init() {
+	yubikeyExportPubKeySubCmd.Flags().StringVarP(&exportPubKeyOutputFile, "output", "o", "", "file to write the public keys to (default is stdout)")
+	yubikeyExportPubKeySubCmd.Flags().StringVarP(&exportPubKeyUserID, "user-id", "u", "", "user ID of the certificate, such as 'Name <email>'")
+
+	yubikeyKeygenSubCmd.Flags().StringVar(&keygenSlot, "slot", "enc", "key slot to generate the key in: sign, enc or auth")
+	yubikeyKeygenSubCmd.Flags().StringVar(&keygenAlgo, "algo", "rsa4096", "key algorithm: rsa2048, rsa3072, rsa4096, cv25519, nistp256, nistp384 or nistp521")
+	yubikeyKeygenSubCmd.Flags().BoolVar(&keygenForce, "force", false, "replace an existing key in the key slot")
+
+	yubikeyImportSubCmd.Flags().StringVar(&importSlot, "slot", "enc", "key slot to import the key into: sign, enc or auth")
+	yubikeyImportSubCmd.Flags().BoolVar(&importForce, "force", false, "replace an existing key in the key slot")
+
+	yubikeyTouchPolicySubCmd.Flags().StringVar(&touchPolicySlot, "slot", "enc", "key slot to set the touch policy of: sign, enc or auth")
+
+	yubikeyAttestSubCmd.Flags().StringVar(&attestSlot, "slot", "enc", "key slot to attest: sign, enc or auth")
+	yubikeyAttestSubCmd.Flags().StringVar(&attestCAFile, "ca", "", "PEM bundle with the Yubico attestation root and intermediate certificates (default is attestation_ca from the config file)")
+
+	yubikeyCmd.AddCommand(yubikeyExportPubKeySubCmd)
+	yubikeyCmd.AddCommand(yubikeyKeygenSubCmd)
+	yubikeyCmd.AddCommand(yubikeyImportSubCmd)
+	yubikeyCmd.AddCommand(yubikeyKDFSubCmd)
+	yubikeyCmd.AddCommand(yubikeyTouchPolicySubCmd)
+	yubikeyCmd.AddCommand(yubikeyAttestSubCmd)
+	yubikeyCmd.AddCommand(yubikeyDumpSubCmd)
+
+	rootCmd.AddCommand(yubikeyCmd)
+}
+
+var yubikeyCmd = &cobra.Command{
+	Use:   "yubikey",
+	Short: "Manage the YubiKey OpenPGP application",
+	Long:  `Manage keys and settings of the YubiKey OpenPGP application.`,
+}
+
+var yubikeyExportPubKeySubCmd = &cobra.Command{
+	Use:   "export-pubkey <serial number>",
+	Short: "Export public keys of YubiKey",
+	Long: `Read the signature, encryption and authentication public keys from the YubiKey
+and write them as an ASCII-armored PGP certificate for the user ID given with
+--user-id. The fingerprint of each key is verified against the fingerprint
+stored on the YubiKey. The signature key is the primary key, the encryption and
+authentication keys are subkeys, and the self-signatures are made by the
+signature key on the YubiKey, so the YubiKey must hold a signature key and the
+PIN is required. The certificate can be used with vault operator init -pgp-keys
+and as a keys rewrap recipient.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		sn := args[0]
+
+		err := vervet.ExportPublicKeys(sn, exportPubKeyUserID, exportPubKeyOutputFile)
+		if err != nil {
+			vervet.PrintFatal(err.Error(), 1)
+		}
+	},
+}
+
+var yubikeyKeygenSubCmd = &cobra.Command{
+	Use:   "keygen <serial number>",
+	Short: "Generate key on YubiKey",
+	Long: `Generate a new key pair in a key slot of the YubiKey. The private key never
+leaves the YubiKey. Requires the admin PIN. The fingerprint and generation time
+of the key are stored on the YubiKey and the new public key is printed.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		sn := args[0]
+
+		err := vervet.GenerateKey(sn, keygenSlot, keygenAlgo, keygenForce)
+		if err != nil {
+			vervet.PrintFatal(err.Error(), 1)
+		}
+	},
+}
+
+var yubikeyImportSubCmd = &cobra.Command{
+	Use:   "import <serial number> <secret key path>",
+	Short: "Import PGP secret key into YubiKey",
+	Long: `Import a PGP secret key, as exported by gpg --export-secret-subkeys, into a key
+slot of the YubiKey. The newest key in the file that suits the slot is imported.
+Passphrase protected keys are decrypted first. Requires the admin PIN. The
+fingerprint and generation time of the key are stored on the YubiKey, so the
+same key can be imported into several YubiKeys.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		sn := args[0]
+		keyPath := args[1]
+
+		err := vervet.ImportKey(sn, keyPath, importSlot, importForce)
+		if err != nil {
+			vervet.PrintFatal(err.Error(), 1)
+		}
+	},
+}
+
+var yubikeyKDFSubCmd = &cobra.Command{
+	Use:   "kdf <serial number> <on|off>",
+	Short: "Turn PIN hashing with a KDF on or off",
+	Long: `Turn hashing of PINs with a key derivation function (KDF) on or off for the
+YubiKey. With KDF on, PINs are hashed before they are sent to the card, so the
+card never sees the PIN itself. Requires the admin PIN. Changing the setting
+resets the PIN and admin PIN to their defaults, which must be changed afterwards.`,
+	Args:      cobra.ExactArgs(2),
+	ValidArgs: []string{"on", "off"},
+	Run: func(cmd *cobra.Command, args []string) {
+		sn := args[0]
+
+		var enable bool
+
+		switch args[1] {
+		case "on":
+			enable = true
+		case "off":
+		default:
+			vervet.PrintFatal(fmt.Sprintf("invalid KDF setting '%s', use on or off", args[1]), 1)
+		}
+
+		if err := vervet.SetKDF(sn, enable); err != nil {
+			vervet.PrintFatal(err.Error(), 1)
+		}
+	},
+}
+
+var yubikeyTouchPolicySubCmd = &cobra.Command{
+	Use:   "touch-policy <serial number> <off|on|fixed|cached|cached-fixed>",
+	Short: "Set touch policy of YubiKey key slot",
+	Long: `Set whether the YubiKey must be touched to use the key in a key slot. With
+cached policies, a touch is remembered for 15 seconds. Fixed policies can only be
+changed by resetting the OpenPGP application. Requires the admin PIN.`,
+	Args:      cobra.ExactArgs(2),
+	ValidArgs: []string{"off", "on", "fixed", "cached", "cached-fixed"},
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := vervet.SetTouchPolicy(args[0], touchPolicySlot, args[1]); err != nil {
+			vervet.PrintFatal(err.Error(), 1)
+		}
+	},
+}
+
+var yubikeyAttestSubCmd = &cobra.Command{
+	Use:   "attest <serial number>",
+	Short: "Attest YubiKey key with Yubico attestation",
+	Long: `Have the YubiKey attest the key in a key slot with the Yubico attestation
+command, which reports whether the key was generated on the YubiKey or imported.
+The attestation certificate is verified against the Yubico attestation CA
+certificates in the PEM bundle provided with --ca or attestation_ca in the config
+file, which is required, and the attested key is checked against the public key and fingerprint on
+the YubiKey. Requires the PIN and a YubiKey with firmware 5.2 or newer. The
+attestation certificate replaces the cardholder certificate of the key slot.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		sn := args[0]
+
+		caPath := attestCAFile
+		if caPath == "" {
+			caPath = config.AttestationCA
+		}
+
+		if err := vervet.AttestKey(sn, attestSlot, caPath); err != nil {
+			vervet.PrintFatal(err.Error(), 1)
+		}
+	},
+}
+
+var yubikeyDumpSubCmd = &cobra.Command{
+	Use:   "dump <serial number>",
+	Short: "Dump data objects of YubiKey",
+	Long: `Read every data object of the OpenPGP application that can be read with GET
+DATA and print the decoded data objects as a tree, with the names of the OpenPGP
+card specification. Data objects the card does not support or that require a PIN
+to read are shown as not available.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := vervet.DumpYubiKey(args[0]); err != nil {
+			vervet.PrintFatal(err.Error(), 1)
+		}
+	},
+}
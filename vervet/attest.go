@@ -0,0 +1,171 @@
+package vervet
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"vervet/yubikeypgp"
+	"vervet/yubikeyscard"
+)
+
+const caFileSizeMax int64 = 1048576
+
+// AttestKey will have the YubiKey with the specified serial number attest the
+// key in the key slot, after verifying the PIN, and report whether the key was
+// generated on the YubiKey and matches the fingerprint on the card. The
+// certificate chain is verified against the self-signed certificates in the
+// PEM bundle at caPath, with the other certificates used as intermediates.
+// Vervet does not ship the Yubico certificates, so caPath is required.
+func AttestKey(sn string, slotName string, caPath string) error {
+	slot, err := yubikeyscard.KeySlotByName(slotName)
+	if err != nil {
+		return err
+	}
+
+	if caPath == "" {
+		return errors.New("no attestation CA bundle provided, pass the Yubico attestation CA certificates with --ca or set attestation_ca in the config file")
+	}
+
+	roots, intermediates, err := readCABundle(caPath)
+	if err != nil {
+		return err
+	}
+
+	yks, err := connectYubiKeys()
+	if err != nil {
+		return err
+	}
+
+	defer yks.Disconnect()
+
+	yk := yks.FindBySN(sn)
+	if yk == nil {
+		return fmt.Errorf("could not locate YubiKey that supports OpenPGP with serial number '%s'", sn)
+	}
+
+	if yk.AppRelatedData.AID.Manufacturer != yubikeyscard.ManufacturerYubico {
+		return fmt.Errorf("card %s is made by %s, only YubiKeys support attestation", sn, yk.AppRelatedData.AID.ManufacturerName())
+	}
+
+	_, fp, _ := yk.AppRelatedData.Key(slot)
+	if fp == [20]byte{} {
+		return fmt.Errorf("%s key slot of YubiKey %s is empty", slot, sn)
+	}
+
+	if err := verifyPIN(yk); err != nil {
+		return err
+	}
+
+	att, err := yk.Attest(slot)
+	if err != nil {
+		return err
+	}
+
+	material, err := yubikeyscard.ReadPublicKey(yk.Card, slot)
+	if err != nil {
+		return err
+	}
+
+	// the public key on the card must also hash to the fingerprint on the card
+	_, pkErr := yubikeypgp.CardPublicKey(yk, slot)
+
+	fpMatch := bytes.Equal(att.Fingerprint, fp[:])
+	keyMatch := material.Matches(att.Certificate.PublicKey)
+
+	chainErr := att.Verify(roots, intermediates)
+
+	PrintHeader("YubiKey Attestation")
+
+	PrintKV("Key slot", slot.String())
+	PrintKV("Fingerprint", fmtFingerprint(fp))
+	PrintKV("Attested fingerprint", fmtFingerprintBytes(att.Fingerprint))
+	PrintKV("Fingerprint match", fmtYesNo(fpMatch))
+	PrintKV("Public key match", fmtYesNo(keyMatch && pkErr == nil))
+
+	if att.Generated() {
+		PrintKV("Key source", "generated on YubiKey")
+	} else {
+		PrintKV("Key source", "imported")
+	}
+
+	PrintKV("Created", att.Created.String())
+	PrintKV("Touch policy", att.TouchPolicy.String())
+	PrintKV("Firmware version", fmt.Sprintf("%d.%d.%d", att.Version[0], att.Version[1], att.Version[2]))
+	PrintKV("Serial number", fmt.Sprintf("%d", att.Serial))
+	PrintKV("Attested by", att.Intermediate.Subject.CommonName)
+
+	if chainErr != nil {
+		PrintKV("Certificate chain", "invalid")
+	} else {
+		PrintKV("Certificate chain", "verified")
+	}
+
+	fmt.Println()
+
+	if pkErr != nil {
+		return pkErr
+	}
+
+	if !fpMatch || !keyMatch {
+		return fmt.Errorf("attested %s key does not match the key on YubiKey %s", slot, sn)
+	}
+
+	if chainErr != nil {
+		return fmt.Errorf("attestation certificate chain could not be verified: %s", chainErr)
+	}
+
+	if !att.Generated() {
+		PrintWarning(fmt.Sprintf("%s key was imported, copies may exist outside the YubiKey", slot))
+		return nil
+	}
+
+	PrintSuccess(fmt.Sprintf("%s key %s was generated on YubiKey %s", slot, fmtFingerprintTerse(fp), sn))
+
+	return nil
+}
+
+// readCABundle will read PEM-encoded certificates from the provided path and
+// return the self-signed certificates as roots and the others as
+// intermediates.
+func readCABundle(path string) (roots *x509.CertPool, intermediates *x509.CertPool, err error) {
+	buf, err := readFile(path, caFileSizeMax)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	roots, intermediates = x509.NewCertPool(), x509.NewCertPool()
+	nRoots := 0
+
+	for {
+		var block *pem.Block
+
+		block, buf = pem.Decode(buf)
+		if block == nil {
+			break
+		}
+
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid certificate in %s: %s", path, err)
+		}
+
+		if bytes.Equal(cert.RawIssuer, cert.RawSubject) && cert.CheckSignatureFrom(cert) == nil {
+			roots.AddCert(cert)
+			nRoots++
+		} else {
+			intermediates.AddCert(cert)
+		}
+	}
+
+	if nRoots == 0 {
+		return nil, nil, errors.New("attestation CA bundle does not contain a root certificate")
+	}
+
+	return roots, intermediates, nil
+}
@@ -0,0 +1,149 @@
+package vervet
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"vervet/yubikeyscard"
+	"vervet/yubikeysim"
+)
+
+// CardOptions controls how vervet connects to OpenPGP smart cards.
+type CardOptions struct {
+	SimulatorKeyFile string   // private key backing a simulated card, replaces PC/SC when set
+	TraceFile        string   // file to record exchanged APDUs to
+	ReplayFile       string   // recorded APDU trace to replay, replaces PC/SC when set
+	ReaderFilter     string   // regular expression selecting PC/SC readers by name
+	Serials          []string // serial numbers of the YubiKeys to use, all if empty
+	Manufacturers    []string // names or hex IDs of the allowed card manufacturers, Yubico if empty
+}
+
+var cardOptions CardOptions
+
+// SetCardOptions sets the options used whenever vervet connects to YubiKeys.
+func SetCardOptions(opts CardOptions) {
+	cardOptions = opts
+}
+
+// connectYubiKeys opens exclusive sessions with the available YubiKeys. If a
+// simulator key file or APDU trace replay is configured, the simulated or
+// replayed cards are attached instead of connecting to PC/SC readers.
+func connectYubiKeys() (*yubikeyscard.YubiKeys, error) {
+	return openYubiKeys(false)
+}
+
+// connectYubiKeysShared opens sessions with the available YubiKeys that are
+// shared with other applications, such as gpg-agent, for reading card details.
+func connectYubiKeysShared() (*yubikeyscard.YubiKeys, error) {
+	return openYubiKeys(true)
+}
+
+// openYubiKeys opens sessions with the YubiKeys selected by the reader filter
+// and serial numbers of the card options. Simulated and replayed cards are
+// selected by serial number only.
+func openYubiKeys(shared bool) (*yubikeyscard.YubiKeys, error) {
+	yks := &yubikeyscard.YubiKeys{Shared: shared}
+	yks.Filter.Serials = cardOptions.Serials
+
+	if cardOptions.ReaderFilter != "" {
+		re, err := regexp.Compile(cardOptions.ReaderFilter)
+		if err != nil {
+			return nil, fmt.Errorf("invalid reader filter: %s", err)
+		}
+
+		yks.Filter.Reader = re
+	}
+
+	for _, m := range cardOptions.Manufacturers {
+		id, err := yubikeyscard.ParseManufacturer(m)
+		if err != nil {
+			return nil, err
+		}
+
+		yks.Manufacturers = append(yks.Manufacturers, id)
+	}
+
+	if cardOptions.TraceFile != "" {
+		tracer, err := yubikeyscard.CreateTrace(cardOptions.TraceFile)
+		if err != nil {
+			return nil, err
+		}
+
+		yks.Tracer = tracer
+		PrintWarning(fmt.Sprintf("recording APDU trace to %s", cardOptions.TraceFile))
+	}
+
+	err := attachYubiKeys(yks)
+
+	// the YubiKeys are returned with ErrNoYubiKeys, so that callers can wait
+	// for YubiKeys to be inserted, otherwise the sessions opened so far and
+	// the trace are closed
+	if err != nil && !errors.Is(err, yubikeyscard.ErrNoYubiKeys) {
+		yks.Disconnect()
+		return nil, err
+	}
+
+	return yks, err
+}
+
+// attachYubiKeys attaches the replayed or simulated cards if configured, or
+// connects to the YubiKeys in the PC/SC readers.
+func attachYubiKeys(yks *yubikeyscard.YubiKeys) error {
+	if cardOptions.ReplayFile != "" {
+		return replayYubiKeys(yks)
+	}
+
+	if cardOptions.SimulatorKeyFile != "" {
+		card, err := yubikeysim.Load(cardOptions.SimulatorKeyFile)
+		if err != nil {
+			return err
+		}
+
+		_, err = yks.Attach(card)
+		if errors.Is(err, yubikeyscard.ErrNotYubiKey) {
+			return fmt.Errorf("simulated card %x is not one of the selected YubiKeys", card.Serial)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		PrintWarning("using simulated OpenPGP card, hardware YubiKeys are ignored")
+
+		return nil
+	}
+
+	return yks.Connect()
+}
+
+// replayYubiKeys attaches a replay transport for each reader recorded in the
+// configured APDU trace. Readers holding cards other than the selected
+// YubiKeys are skipped, as they would be when connecting.
+func replayYubiKeys(yks *yubikeyscard.YubiKeys) error {
+	f, err := os.Open(cardOptions.ReplayFile)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	replays, err := yubikeyscard.ReadTrace(f)
+	if err != nil {
+		return err
+	}
+
+	for _, rp := range replays {
+		if _, err := yks.Attach(rp); err != nil && !errors.Is(err, yubikeyscard.ErrNotYubiKey) {
+			return err
+		}
+	}
+
+	if len(yks.YubiKeys) == 0 {
+		return errors.New("no selected YubiKeys found in APDU trace")
+	}
+
+	PrintWarning(fmt.Sprintf("replaying APDU trace from %s, hardware YubiKeys are ignored", cardOptions.ReplayFile))
+
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"syscall"
+	"time"
 	"vervet/yubikeypgp"
 	"vervet/yubikeyscard"
 
@@ -17,18 +18,26 @@ const (
 )
 
 // decryptUnsealKeys wraps decryptUnsealKey to decrypt a slice of unseal keys
-// and provide console messages.
+// and provide console messages. YubiKeys inserted while decrypting are
+// connected as they appear.
 func decryptUnsealKeys(encryptedKeys []string) ([]string, error) {
-	yks := new(yubikeyscard.YubiKeys)
-	if err := yks.Connect(); err != nil {
+	yks, err := connectYubiKeys()
+	if err != nil && !errors.Is(err, yubikeyscard.ErrNoYubiKeys) {
 		return nil, err
 	}
 
 	defer yks.Disconnect()
 
+	w, err := watchYubiKeys(yks)
+	if err != nil {
+		return nil, err
+	}
+
+	defer w.stop()
+
 	var keys []string
 	for _, ek := range encryptedKeys {
-		key, err := decryptUnsealKey(yks, ek)
+		key, err := decryptUnsealKey(yks, w, ek)
 		if err != nil {
 			PrintError(err.Error())
 		} else {
@@ -47,8 +56,9 @@ func decryptUnsealKeys(encryptedKeys []string) ([]string, error) {
 }
 
 // decryptUnsealKey performs a base64 decode, then decrypts a PGP-encrypted
-// Vault unseal key.
-func decryptUnsealKey(yks *yubikeyscard.YubiKeys, cipherTxtB64 string) (unsealKey string, err error) {
+// Vault unseal key. If none of the YubiKeys holds the decryption key and the
+// YubiKeys are watched, the officer is asked to insert the YubiKey holding it.
+func decryptUnsealKey(yks *yubikeyscard.YubiKeys, w *cardWatcher, cipherTxtB64 string) (unsealKey string, err error) {
 	encryptedKey, err := base64.StdEncoding.DecodeString(cipherTxtB64)
 	if err != nil {
 		err = errors.New("encrypted unseal key is not base64 encoded")
@@ -57,11 +67,27 @@ func decryptUnsealKey(yks *yubikeyscard.YubiKeys, cipherTxtB64 string) (unsealKe
 
 	retries := 1
 	for retries > 0 {
-		md, retries, err := yubikeypgp.ReadMessage(yks, encryptedKey, promptPIN)
+		if err := w.sync(); err != nil {
+			return "", err
+		}
+
+		md, retries, err := yubikeypgp.ReadMessage(yks, encryptedKey, promptPIN, promptTouch)
 		if err != nil {
+			var knf *yubikeypgp.KeyNotFoundError
+
 			switch {
+			case errors.As(err, &knf) && w != nil:
+				if err := w.waitForKey(knf.KeyIDs); err != nil {
+					return "", err
+				}
+
+				continue
 			case retries == 0:
-				PrintFatal("PIN bank locked, no retries remaining", 1)
+				if err := offerUnblockPIN(md.YubiKey); err != nil {
+					PrintFatal(err.Error(), 1)
+				}
+
+				continue
 			case retries < 0:
 				return "", err
 			default:
@@ -91,6 +117,58 @@ func decryptUnsealKey(yks *yubikeyscard.YubiKeys, cipherTxtB64 string) (unsealKe
 	return
 }
 
+// encryptUnsealKey encrypts a Vault unseal key to the recipients and returns
+// the base64-encoded PGP message.
+func encryptUnsealKey(unsealKey string, recipients []*yubikeypgp.PublicKey) (string, error) {
+	msg, err := yubikeypgp.Encrypt([]byte(unsealKey), recipients)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(msg), nil
+}
+
+// loadRecipients reads the PGP public keys to encrypt to from the provided
+// files and from the encryption key slot of the YubiKeys with the provided
+// serial numbers.
+func loadRecipients(yks *yubikeyscard.YubiKeys, paths []string, serials []string) ([]*yubikeypgp.PublicKey, error) {
+	var recipients []*yubikeypgp.PublicKey
+
+	for _, path := range paths {
+		buf, err := readFile(path, keyFileSizeMax)
+		if err != nil {
+			return nil, err
+		}
+
+		pks, err := yubikeypgp.ParsePublicKeys(buf)
+		if err != nil {
+			return nil, fmt.Errorf("public key file '%s': %s", path, err)
+		}
+
+		recipients = append(recipients, pks...)
+	}
+
+	for _, sn := range serials {
+		yk := yks.FindBySN(sn)
+		if yk == nil {
+			return nil, fmt.Errorf("could not locate YubiKey that supports OpenPGP with serial number '%s'", sn)
+		}
+
+		pk, err := yubikeypgp.CardPublicKey(yk, yubikeyscard.KeySlotEnc)
+		if err != nil {
+			return nil, err
+		}
+
+		recipients = append(recipients, pk)
+	}
+
+	if len(recipients) == 0 {
+		return nil, errors.New("no recipients provided, specify a public key file or YubiKey serial number")
+	}
+
+	return recipients, nil
+}
+
 // promptPin will read a PIN from an interactive terminal.
 func promptPIN() ([]byte, error) {
 	fmt.Print("\U0001F513 Enter YubiKey OpenPGP PIN: ")
@@ -105,11 +183,88 @@ func promptPIN() ([]byte, error) {
 		return []byte{}, errors.New("expected PIN length of 6-127 characters")
 	}
 
-	for i := range p {
-		if p[i] < 0x30 || p[i] > 0x39 {
-			return []byte{}, errors.New("only digits 0-9 are valid PIN characters")
+	if err := checkPINDigits(p); err != nil {
+		return []byte{}, err
+	}
+
+	return p, nil
+}
+
+// promptTouch will ask the officer to touch the YubiKey to confirm decryption.
+func promptTouch(yk *yubikeyscard.YubiKey, timeout time.Duration) {
+	PrintInfo(fmt.Sprintf("touch YubiKey %x to confirm decryption, waiting up to %s",
+		yk.AppRelatedData.AID.Serial, timeout))
+}
+
+// verifyPIN prompts for the PIN of the YubiKey and verifies it with the
+// OpenPGP application for operations other than decryption.
+func verifyPIN(yk *yubikeyscard.YubiKey) error {
+	pin, err := promptPIN()
+	if err != nil {
+		return err
+	}
+
+	retries, err := yk.VerifyPIN(1, pin)
+	if err != nil {
+		if retries == 0 {
+			return errors.New("PIN locked, no retries remaining")
 		}
+
+		return err
 	}
 
+	return nil
+}
+
+// verifyAdminPIN prompts for the admin PIN of the YubiKey and verifies it with
+// the OpenPGP application.
+func verifyAdminPIN(yk *yubikeyscard.YubiKey) error {
+	pin, err := promptAdminPIN()
+	if err != nil {
+		return err
+	}
+
+	retries, err := yk.VerifyPIN(3, pin)
+	if err != nil {
+		if retries == 0 {
+			return errors.New("admin PIN locked, no retries remaining")
+		}
+
+		return err
+	}
+
+	yk.SetCachedPIN(3, pin)
+
+	return nil
+}
+
+// promptAdminPIN will read the admin PIN from an interactive terminal.
+func promptAdminPIN() ([]byte, error) {
+	fmt.Print("\U0001F511 Enter YubiKey OpenPGP admin PIN: ")
+	p, err := term.ReadPassword(int(syscall.Stdin))
+	if err != nil {
+		return []byte{}, err
+	}
+
+	fmt.Println()
+
+	if len(p) < 8 || len(p) > 127 {
+		return []byte{}, errors.New("expected admin PIN length of 8-127 characters")
+	}
+
+	return p, nil
+}
+
+// promptPassphrase will read the passphrase of a PGP secret key from an
+// interactive terminal.
+func promptPassphrase(keyID uint64) ([]byte, error) {
+	fmt.Printf("\U0001F511 Enter passphrase for PGP secret key %X: ", keyID)
+	p, err := term.ReadPassword(int(syscall.Stdin))
+	if err != nil {
+		return []byte{}, err
+	}
+
+	fmt.Println()
+
 	return p, nil
 }
@@ -0,0 +1,125 @@
+package vervet
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"vervet/bertlv"
+	"vervet/yubikeyscard"
+
+	"github.com/logrusorgru/aurora"
+)
+
+// dumpHexWidth is the number of bytes per line of dumped binary values.
+const dumpHexWidth = 32
+
+// DumpYubiKey reads every data object of the OpenPGP application that is read
+// with GET DATA and prints the decoded data objects as a tree.
+func DumpYubiKey(sn string) error {
+	// connect YubiKey smart card interface, disconnect on return
+	yks, err := connectYubiKeysShared()
+	if err != nil {
+		return err
+	}
+
+	defer yks.Disconnect()
+
+	yk := yks.FindBySN(sn)
+	if yk == nil {
+		return fmt.Errorf("could not locate YubiKey that supports OpenPGP with serial number '%s'", sn)
+	}
+
+	PrintHeader("YubiKey Data Objects")
+
+	// data objects contained in others are printed with their parent, the
+	// discretionary data objects are only returned within the application
+	// related data by some cards
+	printed := make(map[uint32]bool)
+
+	for _, do := range yubikeyscard.DataObjects {
+		if do.Parent() != 0 || printed[uint32(do.Tag())] {
+			continue
+		}
+
+		tlv, err := yk.ReadDataObject(do)
+
+		var se *yubikeyscard.StatusError
+		if errors.As(err, &se) {
+			printDataObjectValue(0, uint32(do.Tag()), do.Description(), []string{fmt.Sprintf("not available (status %04x)", se.SW)})
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		printDataObject(tlv, 0, printed)
+	}
+
+	return nil
+}
+
+// printDataObject prints the data object and the data objects it contains,
+// indented by depth.
+func printDataObject(t bertlv.TLV, depth int, printed map[uint32]bool) {
+	printed[t.Tag] = true
+
+	var desc string
+	if do, ok := yubikeyscard.LookupDataObject(t.Tag); ok {
+		desc = do.Description()
+	}
+
+	if len(t.Children) > 0 {
+		printDataObjectValue(depth, t.Tag, desc, nil)
+
+		for _, c := range t.Children {
+			printDataObject(c, depth+1, printed)
+		}
+
+		return
+	}
+
+	printDataObjectValue(depth, t.Tag, desc, fmtDataObjectValue(t))
+}
+
+// printDataObjectValue prints the tag and description, if known, of a data
+// object, followed by the lines of its value aligned with the first line.
+func printDataObjectValue(depth int, tag uint32, desc string, lines []string) {
+	label := fmt.Sprintf("%s%04X", strings.Repeat("  ", depth), tag)
+	if desc != "" {
+		label += " " + desc
+	}
+
+	if len(lines) == 0 {
+		fmt.Println(aurora.Bold(label))
+		return
+	}
+
+	fmt.Println(aurora.Bold(label+":"), lines[0])
+
+	pad := strings.Repeat(" ", len(label)+1)
+	for _, l := range lines[1:] {
+		fmt.Println(pad, l)
+	}
+}
+
+// fmtDataObjectValue formats the value of a data object as text if it is a
+// text data object, and as hex otherwise.
+func fmtDataObjectValue(t bertlv.TLV) []string {
+	if len(t.Value) == 0 {
+		return []string{"(empty)"}
+	}
+
+	if do, ok := yubikeyscard.LookupDataObject(t.Tag); ok && !do.Binary() {
+		return []string{fmt.Sprintf("%q", t.Value)}
+	}
+
+	var lines []string
+	for v := t.Value; len(v) > 0; {
+		n := min(len(v), dumpHexWidth)
+		lines = append(lines, fmt.Sprintf("%x", v[:n]))
+		v = v[n:]
+	}
+
+	return lines
+}
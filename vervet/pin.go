@@ -0,0 +1,327 @@
+package vervet
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"syscall"
+	"vervet/yubikeyscard"
+
+	"golang.org/x/term"
+)
+
+// ChangePIN will change the user PIN of the YubiKey with the specified serial
+// number after prompting for the current and the new PIN.
+func ChangePIN(sn string) error {
+	yks, err := connectYubiKeys()
+	if err != nil {
+		return err
+	}
+
+	defer yks.Disconnect()
+
+	yk := yks.FindBySN(sn)
+	if yk == nil {
+		return fmt.Errorf("could not locate YubiKey that supports OpenPGP with serial number '%s'", sn)
+	}
+
+	if yk.AppRelatedData.PWStatus.PW1RetryCtr == 0 {
+		return errors.New("PIN bank locked, no retries remaining")
+	}
+
+	pin, err := promptPIN()
+	if err != nil {
+		return err
+	}
+
+	newPIN, err := promptNewPIN("PIN")
+	if err != nil {
+		return err
+	}
+
+	if err := checkPINDigits(newPIN); err != nil {
+		return err
+	}
+
+	if _, err := yk.ChangePIN(1, pin, newPIN); err != nil {
+		return err
+	}
+
+	PrintSuccess(fmt.Sprintf("changed PIN of YubiKey %s", sn))
+
+	return nil
+}
+
+// ChangeAdminPIN will change the admin PIN of the YubiKey with the specified
+// serial number after prompting for the current and the new admin PIN.
+func ChangeAdminPIN(sn string) error {
+	yks, err := connectYubiKeys()
+	if err != nil {
+		return err
+	}
+
+	defer yks.Disconnect()
+
+	yk := yks.FindBySN(sn)
+	if yk == nil {
+		return fmt.Errorf("could not locate YubiKey that supports OpenPGP with serial number '%s'", sn)
+	}
+
+	if yk.AppRelatedData.PWStatus.PW3RetryCtr == 0 {
+		return errors.New("admin PIN locked, no retries remaining")
+	}
+
+	pin, err := promptAdminPIN()
+	if err != nil {
+		return err
+	}
+
+	newPIN, err := promptNewPIN("admin PIN")
+	if err != nil {
+		return err
+	}
+
+	if _, err := yk.ChangePIN(3, pin, newPIN); err != nil {
+		return err
+	}
+
+	PrintSuccess(fmt.Sprintf("changed admin PIN of YubiKey %s", sn))
+
+	return nil
+}
+
+// SetResetCode will set the reset code of the YubiKey with the specified
+// serial number, after verifying the admin PIN. The reset code allows the
+// user PIN to be unblocked without the admin PIN.
+func SetResetCode(sn string) error {
+	yks, err := connectYubiKeys()
+	if err != nil {
+		return err
+	}
+
+	defer yks.Disconnect()
+
+	yk := yks.FindBySN(sn)
+	if yk == nil {
+		return fmt.Errorf("could not locate YubiKey that supports OpenPGP with serial number '%s'", sn)
+	}
+
+	if err := verifyAdminPIN(yk); err != nil {
+		return err
+	}
+
+	rc, err := promptNewPIN("reset code")
+	if err != nil {
+		return err
+	}
+
+	if err := yk.SetResetCode(rc); err != nil {
+		return err
+	}
+
+	PrintSuccess(fmt.Sprintf("set reset code of YubiKey %s", sn))
+	PrintKV("Reset code retry counter", fmt.Sprintf("%d", yk.AppRelatedData.PWStatus.PW1RCRetryCtr))
+
+	return nil
+}
+
+// UnblockPIN will set a new user PIN for the YubiKey with the specified serial
+// number and reset its retry counter. The reset code is used to authenticate,
+// unless useAdminPIN is set or no reset code is available. The retry counters
+// are shown before and after.
+func UnblockPIN(sn string, useAdminPIN bool) error {
+	yks, err := connectYubiKeys()
+	if err != nil {
+		return err
+	}
+
+	defer yks.Disconnect()
+
+	yk := yks.FindBySN(sn)
+	if yk == nil {
+		return fmt.Errorf("could not locate YubiKey that supports OpenPGP with serial number '%s'", sn)
+	}
+
+	printPINRetries(yk)
+
+	if err := unblockPIN(yk, useAdminPIN); err != nil {
+		return err
+	}
+
+	PrintSuccess(fmt.Sprintf("unblocked PIN of YubiKey %s", sn))
+	printPINRetries(yk)
+
+	return nil
+}
+
+// offerUnblockPIN asks the officer whether the blocked PIN of the YubiKey
+// should be unblocked, and unblocks it if confirmed.
+func offerUnblockPIN(yk *yubikeyscard.YubiKey) error {
+	errLocked := errors.New("PIN bank locked, no retries remaining")
+	if yk == nil {
+		return errLocked
+	}
+
+	sn := fmt.Sprintf("%x", yk.AppRelatedData.AID.Serial)
+	PrintWarning(fmt.Sprintf("PIN of YubiKey %s is blocked", sn))
+
+	if !promptConfirm("Unblock the PIN now?") {
+		return fmt.Errorf("%s, run 'vervet pin unblock %s' to unblock it", errLocked, sn)
+	}
+
+	if err := unblockPIN(yk, false); err != nil {
+		return err
+	}
+
+	PrintSuccess(fmt.Sprintf("unblocked PIN of YubiKey %s", sn))
+
+	return nil
+}
+
+// unblockPIN prompts for the reset code, or verifies the admin PIN if
+// useAdminPIN is set or no reset code is available, and sets a new user PIN.
+func unblockPIN(yk *yubikeyscard.YubiKey, useAdminPIN bool) error {
+	if !useAdminPIN && yk.AppRelatedData.PWStatus.PW1RCRetryCtr == 0 {
+		PrintInfo("no reset code available, the admin PIN is required to unblock the PIN")
+		useAdminPIN = true
+	}
+
+	var rc []byte
+
+	if useAdminPIN {
+		if err := verifyAdminPIN(yk); err != nil {
+			return err
+		}
+	} else {
+		var err error
+
+		rc, err = promptResetCode()
+		if err != nil {
+			return err
+		}
+	}
+
+	newPIN, err := promptNewPIN("PIN")
+	if err != nil {
+		return err
+	}
+
+	if err := checkPINDigits(newPIN); err != nil {
+		return err
+	}
+
+	_, err = yk.UnblockPIN(rc, newPIN)
+
+	return err
+}
+
+// printPINRetries prints the remaining retries of the user PIN and reset code.
+func printPINRetries(yk *yubikeyscard.YubiKey) {
+	pws := yk.AppRelatedData.PWStatus
+
+	PrintKV("PIN retry counter", fmt.Sprintf("%d", pws.PW1RetryCtr))
+	PrintKV("Reset code retry counter", fmt.Sprintf("%d", pws.PW1RCRetryCtr))
+}
+
+// SetKDF will enable or disable hashing of PINs with a KDF on the YubiKey with
+// the specified serial number, after verifying the admin PIN. Changing the KDF
+// setting resets the PIN and admin PIN to their defaults.
+func SetKDF(sn string, enable bool) error {
+	yks, err := connectYubiKeys()
+	if err != nil {
+		return err
+	}
+
+	defer yks.Disconnect()
+
+	yk := yks.FindBySN(sn)
+	if yk == nil {
+		return fmt.Errorf("could not locate YubiKey that supports OpenPGP with serial number '%s'", sn)
+	}
+
+	if yk.KDF.Enabled() == enable {
+		PrintInfo(fmt.Sprintf("KDF is already %s for YubiKey %s", fmtOnOff(enable), sn))
+		return nil
+	}
+
+	PrintWarning("changing the KDF setting resets the PIN to 123456 and the admin PIN to 12345678")
+	if !promptConfirm("Continue?") {
+		return errors.New("KDF setting not changed")
+	}
+
+	if err := verifyAdminPIN(yk); err != nil {
+		return err
+	}
+
+	if err := yk.SetKDF(enable); err != nil {
+		return err
+	}
+
+	PrintSuccess(fmt.Sprintf("turned %s KDF for YubiKey %s", fmtOnOff(enable), sn))
+	PrintWarning(fmt.Sprintf("change the default PINs with 'vervet pin change-admin %s' and 'vervet pin change %s'", sn, sn))
+
+	return nil
+}
+
+// promptResetCode will read the reset code from an interactive terminal.
+func promptResetCode() ([]byte, error) {
+	fmt.Print("\U0001F511 Enter YubiKey OpenPGP reset code: ")
+	p, err := term.ReadPassword(int(syscall.Stdin))
+	if err != nil {
+		return []byte{}, err
+	}
+
+	fmt.Println()
+
+	return p, nil
+}
+
+// promptConfirm will ask a yes or no question on an interactive terminal and
+// report whether it was answered with yes.
+func promptConfirm(question string) bool {
+	fmt.Printf("\u2753 %s [y/N]: ", question)
+
+	var answer string
+	fmt.Scanln(&answer)
+
+	return strings.EqualFold(answer, "y") || strings.EqualFold(answer, "yes")
+}
+
+// promptNewPIN will read a new PIN, admin PIN or reset code from an interactive
+// terminal twice and check that both entries match.
+func promptNewPIN(label string) ([]byte, error) {
+	fmt.Printf("\U0001F511 Enter new YubiKey OpenPGP %s: ", label)
+	p, err := term.ReadPassword(int(syscall.Stdin))
+	if err != nil {
+		return []byte{}, err
+	}
+
+	fmt.Println()
+
+	fmt.Printf("\U0001F511 Repeat new YubiKey OpenPGP %s: ", label)
+	repeat, err := term.ReadPassword(int(syscall.Stdin))
+	if err != nil {
+		return []byte{}, err
+	}
+
+	fmt.Println()
+
+	if !bytes.Equal(p, repeat) {
+		return []byte{}, fmt.Errorf("new %s entries do not match", label)
+	}
+
+	return p, nil
+}
+
+// checkPINDigits checks that a user PIN only contains digits, as the PIN
+// prompt used for decryption only accepts digits.
+func checkPINDigits(pin []byte) error {
+	for i := range pin {
+		if pin[i] < 0x30 || pin[i] > 0x39 {
+			return errors.New("only digits 0-9 are valid PIN characters")
+		}
+	}
+
+	return nil
+}
@@ -1,15 +1,19 @@
 package vervet
 
 import (
+	"encoding/base64"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"runtime"
 	"strings"
+	"vervet/yubikeypgp"
 
 	"github.com/logrusorgru/aurora"
 )
 
-const keyFileSizeMax int64 = 8192
+const keyFileSizeMax int64 = 65536
 
 const (
 	printKVPadWidth     int = 30
@@ -18,13 +22,109 @@ const (
 
 // ReadFile will read an unseal key file from the provided path and return a
 // slice of strings containing base64-encoded PGP-encrypted Vault unseal keys.
+// The file may contain any mix of base64-encoded keys, one per line, and
+// ASCII-armored PGP messages.
 func ReadKeyFile(path string) ([]string, error) {
 	buf, err := readFile(path, keyFileSizeMax)
 	if err != nil {
 		return nil, err
 	}
 
-	return strings.Split(strings.TrimSpace(string(buf)), "\n"), nil
+	keys, err := decodeKeys(buf)
+	if err != nil {
+		return nil, fmt.Errorf("unseal key file '%s': %s", path, err)
+	}
+
+	return keys, nil
+}
+
+// NormalizeKeys accepts PGP-encrypted Vault unseal keys that are either
+// base64-encoded or ASCII-armored and returns them base64-encoded.
+func NormalizeKeys(keys []string) ([]string, error) {
+	var normalized []string
+
+	for _, key := range keys {
+		decoded, err := decodeKeys([]byte(key))
+		if err != nil {
+			return nil, err
+		}
+
+		normalized = append(normalized, decoded...)
+	}
+
+	return normalized, nil
+}
+
+// decodeKeys decodes the base64-encoded and ASCII-armored keys in buf and
+// returns them base64-encoded.
+func decodeKeys(buf []byte) ([]string, error) {
+	msgs, err := yubikeypgp.DecodeMessages(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, len(msgs))
+	for i, msg := range msgs {
+		keys[i] = base64.StdEncoding.EncodeToString(msg)
+	}
+
+	return keys, nil
+}
+
+// writeKeyFile writes the base64-encoded keys to the provided path, one per
+// line. The file is replaced atomically so that an interrupted write can not
+// lose unseal keys.
+func writeKeyFile(path string, keys []string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if _, err := tmp.WriteString(strings.Join(keys, "\n") + "\n"); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	// the keys must be on disk before they replace the key file
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir flushes the directory entries of the directory, so that a rename
+// within it survives a crash. Directories can not be opened for syncing on
+// Windows, so the rename is left to the file system there.
+func syncDir(path string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	defer d.Close()
+
+	return d.Sync()
 }
 
 // readFile will read a file from the provided path up to the byte length
@@ -150,6 +250,19 @@ func fmtFingerprint(fp [20]byte) string {
 	return strings.TrimSpace(fpString[:24] + " " + fpString[24:])
 }
 
+// fmtFingerprintBytes formats a fingerprint of unchecked length, such as one
+// read from a certificate.
+func fmtFingerprintBytes(b []byte) string {
+	var fp [20]byte
+	if len(b) != len(fp) {
+		return fmt.Sprintf("%X", b)
+	}
+
+	copy(fp[:], b)
+
+	return fmtFingerprint(fp)
+}
+
 // fmtFingerprintTerse accepts a byte array containing a PGP fingerprint and
 // returns a short form formatted string that displays the last 8 bytes of the
 // fingerprint in 2-byte hexadecimal blocks.
@@ -162,3 +275,21 @@ func fmtFingerprintTerse(fp [20]byte) string {
 
 	return fpString
 }
+
+// fmtOnOff formats a setting as on or off.
+func fmtOnOff(on bool) string {
+	if on {
+		return "on"
+	}
+
+	return "off"
+}
+
+// fmtYesNo formats a check result as yes or no.
+func fmtYesNo(yes bool) string {
+	if yes {
+		return "yes"
+	}
+
+	return "no"
+}
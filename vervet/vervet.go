@@ -1,10 +1,14 @@
 package vervet
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"os"
 	"strings"
 	"time"
+	"vervet/yubikeypgp"
 	"vervet/yubikeyscard"
 )
 
@@ -62,6 +66,72 @@ func GenerateRoot(vaultAddr string, encryptedKeys []string) error {
 	return nil
 }
 
+// RewrapKeyFile will decrypt the unseal keys in the key file that are
+// encrypted to a connected YubiKey and encrypt them to the recipients loaded
+// from public key files and YubiKeys. Keys that can not be decrypted are kept
+// as they are. The updated key file is written to outPath, or replaces the key
+// file if outPath is empty. Decrypted keys are only held in memory.
+func RewrapKeyFile(keyPath string, outPath string, recipientFiles []string, recipientSNs []string) error {
+	encryptedKeys, err := ReadKeyFile(keyPath)
+	if err != nil {
+		return err
+	}
+
+	yks, err := connectYubiKeys()
+	if err != nil {
+		return err
+	}
+
+	defer yks.Disconnect()
+
+	recipients, err := loadRecipients(yks, recipientFiles, recipientSNs)
+	if err != nil {
+		return err
+	}
+
+	for _, pk := range recipients {
+		PrintInfo(fmt.Sprintf("encrypting to key ID %X", pk.KeyID))
+	}
+
+	rewrapped := 0
+	keys := make([]string, len(encryptedKeys))
+
+	for i, ek := range encryptedKeys {
+		keys[i] = ek
+
+		// keys encrypted to other YubiKeys are left as they are, so there is
+		// no waiting for YubiKeys to be inserted
+		key, err := decryptUnsealKey(yks, nil, ek)
+		if err != nil {
+			PrintWarning(fmt.Sprintf("unseal key %d left unchanged: %s", i+1, err))
+			continue
+		}
+
+		keys[i], err = encryptUnsealKey(key, recipients)
+		if err != nil {
+			return err
+		}
+
+		rewrapped++
+	}
+
+	if rewrapped == 0 {
+		return errors.New("no unseal keys could be decrypted, key file left unchanged")
+	}
+
+	if outPath == "" {
+		outPath = keyPath
+	}
+
+	if err := writeKeyFile(outPath, keys); err != nil {
+		return err
+	}
+
+	PrintSuccess(fmt.Sprintf("re-encrypted %d unseal key(s) to %s", rewrapped, outPath))
+
+	return nil
+}
+
 // ListVaultStatus will output of the status the provided Vault address.
 func ListVaultStatus(vaultAddr string) error {
 	vault, err := newVaultClient(vaultAddr)
@@ -82,8 +152,8 @@ func ListVaultStatus(vaultAddr string) error {
 // ListYubiKeys will output the basic details of connected YubiKeys.
 func ListYubiKeys() error {
 	// connect YubiKey smart card interface, disconnect on return
-	yks := new(yubikeyscard.YubiKeys)
-	if err := yks.Connect(); err != nil {
+	yks, err := connectYubiKeysShared()
+	if err != nil {
 		return err
 	}
 
@@ -94,21 +164,21 @@ func ListYubiKeys() error {
 		crd := yk.CardRelatedData
 
 		PrintHeader(fmt.Sprint(i+1, ": ", yk.ReaderLabel))
-		PrintKV("Manufacturer", "Yubico")
+		PrintKV("Manufacturer", ard.AID.ManufacturerName())
 		PrintKV("Serial number", fmt.Sprintf("%x", ard.AID.Serial))
 
 		if crd.Name != nil {
 			PrintKV("Name of cardholder", strings.Replace(fmt.Sprintf("%s", crd.Name), "<<", " ", -1))
 		}
 
-		PrintKV("Signature key", fmt.Sprintf("rsa%d/%s",
-			binary.BigEndian.Uint16(ard.AlgoAttrSign.RSAModLen[:]),
+		PrintKV("Signature key", fmt.Sprintf("%s/%s",
+			ard.AlgoAttrSign.Name(),
 			fmtFingerprintTerse(ard.Fingerprints.Sign)))
-		PrintKV("Encryption key", fmt.Sprintf("rsa%d/%s",
-			binary.BigEndian.Uint16(ard.AlgoAttrEnc.RSAModLen[:]),
+		PrintKV("Encryption key", fmt.Sprintf("%s/%s",
+			ard.AlgoAttrEnc.Name(),
 			fmtFingerprintTerse(ard.Fingerprints.Enc)))
-		PrintKV("Authentication key", fmt.Sprintf("rsa%d/%s",
-			binary.BigEndian.Uint16(ard.AlgoAttrAuth.RSAModLen[:]),
+		PrintKV("Authentication key", fmt.Sprintf("%s/%s",
+			ard.AlgoAttrAuth.Name(),
 			fmtFingerprintTerse(ard.Fingerprints.Auth)))
 
 		if i < len(yks.YubiKeys)-1 {
@@ -119,13 +189,240 @@ func ListYubiKeys() error {
 	return nil
 }
 
+// ExportPublicKeys will read the public keys of the YubiKey with the specified
+// serial number and write them as an armored PGP certificate for the user ID
+// to outPath, or stdout if outPath is empty. The signature key is the primary
+// key and certifies the user ID, the encryption and authentication keys are
+// bound to it as subkeys. The self-signatures are made on the card after the
+// PIN is verified.
+func ExportPublicKeys(sn string, userID string, outPath string) error {
+	if userID == "" {
+		return errors.New("a user ID is required to certify the exported keys")
+	}
+
+	yks, err := connectYubiKeys()
+	if err != nil {
+		return err
+	}
+
+	defer yks.Disconnect()
+
+	yk := yks.FindBySN(sn)
+	if yk == nil {
+		return fmt.Errorf("could not locate YubiKey that supports OpenPGP with serial number '%s'", sn)
+	}
+
+	if yk.AppRelatedData.Fingerprints.Sign == [20]byte{} {
+		return fmt.Errorf("YubiKey %s has no signature key, which is required to certify the exported keys", sn)
+	}
+
+	pin, err := promptPIN()
+	if err != nil {
+		return err
+	}
+
+	if yk.AppRelatedData.UIF.Sign.Policy.Required() {
+		PrintInfo(fmt.Sprintf("touch YubiKey %s to confirm each signature", sn))
+	}
+
+	cert, err := yubikeypgp.CardCertificate(yk, userID, pin)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+
+	comment := fmt.Sprintf("keys of YubiKey %x", yk.AppRelatedData.AID.Serial)
+	if err := cert.WriteArmored(&buf, comment); err != nil {
+		return err
+	}
+
+	if outPath == "" {
+		_, err = os.Stdout.Write(buf.Bytes())
+		return err
+	}
+
+	if err := os.WriteFile(outPath, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+
+	PrintSuccess(fmt.Sprintf("exported public keys of YubiKey %s to %s", sn, outPath))
+
+	return nil
+}
+
+// GenerateKey will generate a new key pair of the specified algorithm in the
+// key slot of the YubiKey with the specified serial number, after verifying
+// the admin PIN, and output the new public key. A key already in the slot is
+// only replaced if force is set.
+func GenerateKey(sn string, slotName string, algo string, force bool) error {
+	slot, err := yubikeyscard.KeySlotByName(slotName)
+	if err != nil {
+		return err
+	}
+
+	attr, err := yubikeyscard.AlgoAttrByName(algo, slot)
+	if err != nil {
+		return err
+	}
+
+	yks, err := connectYubiKeys()
+	if err != nil {
+		return err
+	}
+
+	defer yks.Disconnect()
+
+	yk := yks.FindBySN(sn)
+	if yk == nil {
+		return fmt.Errorf("could not locate YubiKey that supports OpenPGP with serial number '%s'", sn)
+	}
+
+	if _, fp, _ := yk.AppRelatedData.Key(slot); fp != [20]byte{} && !force {
+		return fmt.Errorf("%s key slot already contains key %s, use --force to replace it", slot, fmtFingerprint(fp))
+	}
+
+	if err := verifyAdminPIN(yk); err != nil {
+		return err
+	}
+
+	PrintInfo(fmt.Sprintf("generating %s key in %s key slot, this may take a while", attr.Name(), slot))
+
+	pk, err := yubikeypgp.GenerateKey(yk, slot, attr)
+	if err != nil {
+		return err
+	}
+
+	PrintSuccess(fmt.Sprintf("generated %s key on YubiKey %s", slot, sn))
+	PrintKV("Fingerprint", fmtFingerprint(pk.Fingerprint))
+	PrintKV("Algorithm", attr.Name())
+	PrintKV("Created", pk.Created.String())
+	fmt.Println()
+
+	comment := fmt.Sprintf("%s key of YubiKey %x", slot, yk.AppRelatedData.AID.Serial)
+
+	return pk.WriteArmored(os.Stdout, comment)
+}
+
+// ImportKey will import the PGP secret key in the key file into the key slot
+// of the YubiKey with the specified serial number, after verifying the admin
+// PIN. Passphrase protected keys are decrypted first. A key already in the
+// slot is only replaced if force is set.
+func ImportKey(sn string, keyPath string, slotName string, force bool) error {
+	slot, err := yubikeyscard.KeySlotByName(slotName)
+	if err != nil {
+		return err
+	}
+
+	buf, err := readFile(keyPath, keyFileSizeMax)
+	if err != nil {
+		return err
+	}
+
+	sk, err := yubikeypgp.ReadSecretKey(buf, slot)
+	if err != nil {
+		return fmt.Errorf("secret key file '%s': %s", keyPath, err)
+	}
+
+	yks, err := connectYubiKeys()
+	if err != nil {
+		return err
+	}
+
+	defer yks.Disconnect()
+
+	yk := yks.FindBySN(sn)
+	if yk == nil {
+		return fmt.Errorf("could not locate YubiKey that supports OpenPGP with serial number '%s'", sn)
+	}
+
+	if _, fp, _ := yk.AppRelatedData.Key(slot); fp != [20]byte{} && !force {
+		return fmt.Errorf("%s key slot already contains key %s, use --force to replace it", slot, fmtFingerprint(fp))
+	}
+
+	if sk.Encrypted {
+		passphrase, err := promptPassphrase(sk.KeyID)
+		if err != nil {
+			return err
+		}
+
+		if err := sk.Decrypt(passphrase); err != nil {
+			return err
+		}
+	}
+
+	if err := verifyAdminPIN(yk); err != nil {
+		return err
+	}
+
+	if err := yubikeypgp.ImportKey(yk, slot, sk); err != nil {
+		return err
+	}
+
+	attr, fp, created := yk.AppRelatedData.Key(slot)
+
+	PrintSuccess(fmt.Sprintf("imported key ID %X into %s key slot of YubiKey %s", sk.KeyID, slot, sn))
+	PrintKV("Fingerprint", fmtFingerprint(fp))
+	PrintKV("Algorithm", attr.Name())
+	PrintKV("Created", created.String())
+
+	return nil
+}
+
+// SetTouchPolicy will change the touch policy of the key slot of the YubiKey
+// with the specified serial number, after verifying the admin PIN. Fixed
+// policies can not be undone without resetting the OpenPGP application, so
+// they must be confirmed.
+func SetTouchPolicy(sn string, slotName string, policyName string) error {
+	slot, err := yubikeyscard.KeySlotByName(slotName)
+	if err != nil {
+		return err
+	}
+
+	policy, err := yubikeyscard.TouchPolicyByName(policyName)
+	if err != nil {
+		return err
+	}
+
+	yks, err := connectYubiKeys()
+	if err != nil {
+		return err
+	}
+
+	defer yks.Disconnect()
+
+	yk := yks.FindBySN(sn)
+	if yk == nil {
+		return fmt.Errorf("could not locate YubiKey that supports OpenPGP with serial number '%s'", sn)
+	}
+
+	if policy.Fixed() {
+		PrintWarning("a fixed touch policy can only be changed by resetting the OpenPGP application, which deletes all keys")
+		if !promptConfirm("Continue?") {
+			return errors.New("touch policy not changed")
+		}
+	}
+
+	if err := verifyAdminPIN(yk); err != nil {
+		return err
+	}
+
+	if err := yk.SetTouchPolicy(slot, policy); err != nil {
+		return err
+	}
+
+	PrintSuccess(fmt.Sprintf("set touch policy of %s key slot of YubiKey %s to %s", slot, sn, policy))
+
+	return nil
+}
+
 // ShowYubiKey will search the connected YubiKeys for the specified serial
 // number and output the details including smart card and application-related
 // data.
 func ShowYubiKey(sn string) error {
 	// connect YubiKey smart card interface, disconnect on return
-	yks := new(yubikeyscard.YubiKeys)
-	if err := yks.Connect(); err != nil {
+	yks, err := connectYubiKeysShared()
+	if err != nil {
 		return err
 	}
 
@@ -147,7 +444,7 @@ func ShowYubiKey(sn string) error {
 		ard.AID.Manufacturer, ard.AID.Serial, ard.AID.RFU))
 	PrintKV("Application type", "OpenPGP")
 	PrintKV("Version", fmt.Sprintf("%d.%d", ard.AID.Version[0], ard.AID.Version[1]))
-	PrintKV("Manufacturer", "Yubico")
+	PrintKV("Manufacturer", ard.AID.ManufacturerName())
 	PrintKV("Serial number", fmt.Sprintf("%x", ard.AID.Serial))
 	PrintKV("Name of cardholder", strings.Replace(fmt.Sprintf("%s", crd.Name), "<<", " ", -1))
 	PrintKV("Language prefs", string(crd.LanguagePrefs))
@@ -171,24 +468,60 @@ func ShowYubiKey(sn string) error {
 		ard.PWStatus.PW1RetryCtr,
 		ard.PWStatus.PW1RCRetryCtr,
 		ard.PWStatus.PW3RetryCtr))
+	PrintKV("KDF setting", fmtOnOff(yk.KDF.Enabled()))
+	PrintKV("Extended length", fmtYesNo(ard.CardCaps.ExtendedLength))
+	PrintKV("Command chaining", fmtYesNo(ard.CardCaps.CommandChaining))
+
+	if ard.ExtCaps.Announced {
+		PrintKV("Key import", fmtYesNo(ard.ExtCaps.KeyImport))
+		PrintKV("KDF support", fmtYesNo(ard.ExtCaps.KDF))
+		PrintKV("AES support", fmtYesNo(ard.ExtCaps.AES))
+	}
+
+	if ard.Features.Announced {
+		PrintKV("PIN pad", fmtYesNo(ard.Features.Keypad))
+	}
 
 	PrintKV("Signature key", fmtFingerprint(ard.Fingerprints.Sign))
-	PrintKV("    algorithm", fmt.Sprintf("rsa%d",
-		binary.BigEndian.Uint16(ard.AlgoAttrSign.RSAModLen[:])))
+	PrintKV("    algorithm", ard.AlgoAttrSign.Name())
+	printSupportedAlgos(ard.AlgoInfo.Sign)
 	signGenDate := int64(binary.BigEndian.Uint32(ard.KeyGenDates.Sign[:]))
 	PrintKV("    created", time.Unix(signGenDate, 0).String())
+	printTouchPolicy(ard.UIF.Sign)
 
 	PrintKV("Encryption key", fmtFingerprint(ard.Fingerprints.Enc))
-	PrintKV("    algorithm", fmt.Sprintf("rsa%d",
-		binary.BigEndian.Uint16(ard.AlgoAttrEnc.RSAModLen[:])))
+	PrintKV("    algorithm", ard.AlgoAttrEnc.Name())
+	printSupportedAlgos(ard.AlgoInfo.Enc)
 	encGenDate := int64(binary.BigEndian.Uint32(ard.KeyGenDates.Enc[:]))
 	PrintKV("    created", time.Unix(encGenDate, 0).String())
+	printTouchPolicy(ard.UIF.Enc)
 
 	PrintKV("Authentication key", fmtFingerprint(ard.Fingerprints.Auth))
-	PrintKV("    algorithm", fmt.Sprintf("rsa%d",
-		binary.BigEndian.Uint16(ard.AlgoAttrAuth.RSAModLen[:])))
+	PrintKV("    algorithm", ard.AlgoAttrAuth.Name())
+	printSupportedAlgos(ard.AlgoInfo.Auth)
 	authGenDate := int64(binary.BigEndian.Uint32(ard.KeyGenDates.Auth[:]))
 	PrintKV("    created", time.Unix(authGenDate, 0).String())
+	printTouchPolicy(ard.UIF.Auth)
+
+	if ard.UIF.Att.Supported {
+		PrintKV("Attestation touch policy", ard.UIF.Att.Policy.String())
+	}
 
 	return nil
 }
+
+// printSupportedAlgos prints the algorithms supported in a key slot, if the
+// card lists them.
+func printSupportedAlgos(attrs []yubikeyscard.AlgoAttr) {
+	if len(attrs) > 0 {
+		PrintKV("    supported", strings.Join(yubikeyscard.AlgoNames(attrs), " "))
+	}
+}
+
+// printTouchPolicy prints the touch policy of a key slot, if the YubiKey
+// supports touch policies.
+func printTouchPolicy(uif yubikeyscard.UIF) {
+	if uif.Supported {
+		PrintKV("    touch policy", uif.Policy.String())
+	}
+}
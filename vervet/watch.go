@@ -0,0 +1,155 @@
+package vervet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"vervet/yubikeyscard"
+)
+
+// cardWaitTimeout is how long vervet waits for an officer to insert the
+// YubiKey holding a decryption key.
+const cardWaitTimeout = 5 * time.Minute
+
+// cardWatcher keeps the connected YubiKeys up to date as officers insert and
+// remove YubiKeys.
+type cardWatcher struct {
+	yks    *yubikeyscard.YubiKeys
+	events <-chan yubikeyscard.CardEvent
+	cancel context.CancelFunc
+}
+
+// watchYubiKeys starts watching for YubiKeys being inserted and removed. Cards
+// present when watching starts are already connected, so their events are
+// ignored. Simulated and replayed cards are not watched, and nil is returned.
+func watchYubiKeys(yks *yubikeyscard.YubiKeys) (*cardWatcher, error) {
+	if cardOptions.SimulatorKeyFile != "" || cardOptions.ReplayFile != "" {
+		return nil, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	events, err := yks.Watch(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	return &cardWatcher{yks: yks, events: events, cancel: cancel}, nil
+}
+
+// stop stops watching for card events.
+func (w *cardWatcher) stop() {
+	if w != nil {
+		w.cancel()
+	}
+}
+
+// sync applies the card events received since the last call, so that removed
+// YubiKeys are not used.
+func (w *cardWatcher) sync() error {
+	if w == nil {
+		return nil
+	}
+
+	for {
+		select {
+		case ev, ok := <-w.events:
+			if !ok {
+				return errors.New("stopped watching for YubiKeys")
+			}
+
+			if _, err := w.apply(ev); err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+	}
+}
+
+// waitForKey asks the officer to insert the YubiKey holding one of the
+// decryption keys and waits until it is connected. A key ID of 0 is a wildcard
+// recipient, which any YubiKey may hold.
+func (w *cardWatcher) waitForKey(keyIDs []uint64) error {
+	var ids []string
+	wildcard := false
+
+	for _, id := range keyIDs {
+		if id == 0 {
+			wildcard = true
+		} else {
+			ids = append(ids, fmt.Sprintf("%X", id))
+		}
+	}
+
+	switch {
+	case len(ids) == 0:
+		PrintInfo("insert a YubiKey holding the decryption key")
+	case len(ids) == 1 && !wildcard:
+		PrintInfo(fmt.Sprintf("insert the YubiKey holding key %s", ids[0]))
+	default:
+		PrintInfo(fmt.Sprintf("insert a YubiKey holding one of the keys %s", strings.Join(ids, ", ")))
+	}
+
+	timeout := time.After(cardWaitTimeout)
+
+	for {
+		select {
+		case ev, ok := <-w.events:
+			if !ok {
+				return errors.New("stopped watching for YubiKeys")
+			}
+
+			yk, err := w.apply(ev)
+			if err != nil {
+				return err
+			}
+
+			if yk == nil || ev.Type != yubikeyscard.CardInserted {
+				continue
+			}
+
+			if wildcard {
+				return nil
+			}
+
+			for _, id := range keyIDs {
+				if w.yks.FindByKeyID(id) == yk {
+					return nil
+				}
+			}
+
+			PrintWarning(fmt.Sprintf("YubiKey %x does not hold the decryption key", yk.AppRelatedData.AID.Serial))
+		case <-timeout:
+			return fmt.Errorf("no YubiKey holding the decryption key was inserted within %s", cardWaitTimeout)
+		}
+	}
+}
+
+// apply applies a card event to the connected YubiKeys and returns the
+// inserted or removed YubiKey, or nil if the card is not a YubiKey.
+func (w *cardWatcher) apply(ev yubikeyscard.CardEvent) (*yubikeyscard.YubiKey, error) {
+	if ev.Err != nil {
+		return nil, fmt.Errorf("could not watch for YubiKeys: %s", ev.Err)
+	}
+
+	yk, err := w.yks.Update(ev)
+	if errors.Is(err, yubikeyscard.ErrNotYubiKey) {
+		return nil, nil
+	}
+
+	if err != nil {
+		// a card may be pulled again before it is connected
+		PrintWarning(fmt.Sprintf("could not connect to card in reader '%s': %s", ev.Reader, err))
+		return nil, nil
+	}
+
+	if yk != nil {
+		PrintInfo(fmt.Sprintf("YubiKey %x %s", yk.AppRelatedData.AID.Serial, ev.Type))
+	}
+
+	return yk, nil
+}
@@ -0,0 +1,161 @@
+package yubikeypgp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+const (
+	armorMessageType = "PGP MESSAGE"
+	armorBegin       = "-----BEGIN "
+	armorEnd         = "-----END "
+)
+
+// DecodeMessages decodes the encrypted messages in data, which may contain any
+// mix of base64 encoded messages, one per line as output by Vault, and ASCII
+// armored messages as output by gpg. The CRC24 checksum of armored messages is
+// verified.
+func DecodeMessages(data []byte) ([][]byte, error) {
+	var msgs [][]byte
+
+	s := bufio.NewScanner(bytes.NewReader(data))
+	s.Buffer(nil, len(data)+1)
+
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+
+		switch {
+		case text == "":
+			continue
+		case strings.HasPrefix(text, armorBegin):
+			// collect the armored block up to its end line
+			start := line
+			block := []string{text}
+
+			for !strings.HasPrefix(text, armorEnd) {
+				if !s.Scan() {
+					return nil, fmt.Errorf("armored message starting on line %d is not terminated", start)
+				}
+
+				line++
+				text = strings.TrimSpace(s.Text())
+				block = append(block, text)
+			}
+
+			msg, err := decodeArmor(strings.Join(block, "\n"), armorMessageType)
+			if err != nil {
+				return nil, fmt.Errorf("invalid armored message on line %d: %s", start, err)
+			}
+
+			msgs = append(msgs, msg)
+		default:
+			msg, err := base64.StdEncoding.DecodeString(text)
+			if err != nil {
+				return nil, fmt.Errorf("encrypted message on line %d is not base64 encoded", line)
+			}
+
+			msgs = append(msgs, msg)
+		}
+	}
+
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	return msgs, nil
+}
+
+// encodeArmor writes data as an armored block of the provided type, with an
+// optional comment header.
+func encodeArmor(w io.Writer, blockType string, comment string, data []byte) error {
+	var headers map[string]string
+	if comment != "" {
+		headers = map[string]string{"Comment": comment}
+	}
+
+	aw, err := armor.Encode(w, blockType, headers)
+	if err != nil {
+		return err
+	}
+
+	if _, err := aw.Write(data); err != nil {
+		return err
+	}
+
+	if err := aw.Close(); err != nil {
+		return err
+	}
+
+	// the armor encoder does not terminate the end line
+	_, err = io.WriteString(w, "\n")
+
+	return err
+}
+
+// decodeArmoredBlocks decodes every armored block in data, which must all be
+// of the provided type, and returns the concatenated contents.
+func decodeArmoredBlocks(data []byte, blockType string) ([]byte, error) {
+	var out []byte
+
+	text := string(data)
+
+	for {
+		start := strings.Index(text, armorBegin)
+		if start < 0 {
+			break
+		}
+
+		// the end line starts with the end marker and ends with five dashes
+		end := strings.Index(text[start:], armorEnd)
+		if end < 0 {
+			return nil, errors.New("armored block is not terminated")
+		}
+
+		end += start + len(armorEnd)
+		if eol := strings.Index(text[end:], "-----"); eol >= 0 {
+			end += eol + len("-----")
+		}
+
+		b, err := decodeArmor(text[start:end], blockType)
+		if err != nil {
+			return nil, err
+		}
+
+		out = append(out, b...)
+		text = text[end:]
+	}
+
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no armored '%s' found", blockType)
+	}
+
+	return out, nil
+}
+
+// decodeArmor decodes a single armored block of the provided type.
+func decodeArmor(text string, blockType string) ([]byte, error) {
+	block, err := armor.Decode(strings.NewReader(text))
+	if err != nil {
+		return nil, err
+	}
+
+	if block.Type != blockType {
+		return nil, fmt.Errorf("unexpected armor type '%s', expected '%s'", block.Type, blockType)
+	}
+
+	msg, err := io.ReadAll(block.Body)
+	if err == armor.ArmorCorrupt {
+		return nil, errors.New("armor is corrupt or checksum does not match")
+	} else if err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
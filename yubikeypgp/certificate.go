@@ -0,0 +1,192 @@
+package yubikeypgp
+
+import (
+	"crypto"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+	"vervet/yubikeyscard"
+
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// sha256DigestInfoPrefix is the DER encoding of a PKCS #1 DigestInfo for
+// SHA-256, which precedes the hash in RSA signatures.
+var sha256DigestInfoPrefix = []byte{0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20}
+
+// Certificate is an OpenPGP certificate built from the keys of a YubiKey. The
+// signature key is the primary key and certifies the user ID, and the
+// encryption and authentication keys are bound to it as subkeys.
+type Certificate struct {
+	PrimaryKey *PublicKey
+	Subkeys    []*PublicKey
+	UserID     string
+
+	packets []byte
+}
+
+// Serialize returns the packets of the certificate.
+func (c *Certificate) Serialize() []byte {
+	return c.packets
+}
+
+// WriteArmored writes the certificate as an ASCII armored public key block
+// with an optional comment header.
+func (c *Certificate) WriteArmored(w io.Writer, comment string) error {
+	return encodeArmor(w, armorPublicKeyType, comment, c.packets)
+}
+
+// CardCertificate builds a certificate for the user ID from the public keys on
+// the YubiKey, with self-signatures made by the signature key on the card.
+// The signature key slot must hold a key. The PIN is verified before each
+// signature, as cards may only allow one signature per verification.
+func CardCertificate(yk *yubikeyscard.YubiKey, userID string, pin []byte) (*Certificate, error) {
+	if err := yk.BeginTransaction(); err != nil {
+		return nil, err
+	}
+
+	defer yk.EndTransaction()
+
+	primary, err := CardPublicKey(yk, yubikeyscard.KeySlotSign)
+	if err != nil {
+		return nil, err
+	}
+
+	created := time.Unix(time.Now().Unix(), 0)
+	uid := []byte(userID)
+
+	sig, err := signCard(yk, pin, primary, nil, uid, sigTypePositiveCert, created, keyFlagSign|keyFlagCertify)
+	if err != nil {
+		return nil, err
+	}
+
+	b := serializePacket(packetTagPublicKey, primary.body)
+	b = append(b, serializePacket(packetTagUserID, uid)...)
+	b = append(b, serializePacket(packetTagSignature, sig)...)
+
+	subkeys := 0
+
+	for _, slot := range []yubikeyscard.KeySlot{yubikeyscard.KeySlotEnc, yubikeyscard.KeySlotAuth} {
+		if _, fp, _ := yk.AppRelatedData.Key(slot); fp == [20]byte{} {
+			continue
+		}
+
+		pk, err := CardPublicKey(yk, slot)
+		if err != nil {
+			return nil, err
+		}
+
+		flags := keyFlagAuthenticate
+		if slot == yubikeyscard.KeySlotEnc {
+			flags = keyFlagEncryptComms | keyFlagEncryptStorage
+		}
+
+		sig, err := signCard(yk, pin, primary, pk, nil, sigTypeSubkeyBinding, created, flags)
+		if err != nil {
+			return nil, err
+		}
+
+		b = append(b, serializePacket(packetTagPublicSubkey, pk.body)...)
+		b = append(b, serializePacket(packetTagSignature, sig)...)
+		subkeys++
+	}
+
+	// check the signatures made by the card
+	certs, err := readCertificates(b)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(certs) != 1 || len(certs[0]) != 1+subkeys {
+		return nil, errors.New("YubiKey made an invalid subkey binding signature")
+	}
+
+	return &Certificate{
+		PrimaryKey: certs[0][0],
+		Subkeys:    certs[0][1:],
+		UserID:     userID,
+		packets:    b,
+	}, nil
+}
+
+// signCard makes a version 4 signature of the type with the signature key on
+// the YubiKey, the primary key, over the subkey or the user ID. The signature
+// carries the creation time, key flags and issuer, and certifications of the
+// user ID the preferred ciphers (AES-256, AES-128) and hashes (SHA-256,
+// SHA-512), without which other implementations fall back to algorithms they
+// may not support.
+func signCard(yk *yubikeyscard.YubiKey, pin []byte, primary, subkey *PublicKey, userID []byte, sigType uint8, created time.Time, flags uint8) ([]byte, error) {
+	hashID, hash := signingHash(primary)
+
+	var subpackets []byte
+	subpackets = append(subpackets, 5, sigSubpacketCreationTime)
+	subpackets = binary.BigEndian.AppendUint32(subpackets, uint32(created.Unix()))
+	subpackets = append(subpackets, 2, sigSubpacketKeyFlags, flags)
+	if userID != nil {
+		subpackets = append(subpackets, 3, sigSubpacketPreferredCipher, 9, 7)
+		subpackets = append(subpackets, 3, sigSubpacketPreferredHash, 8, 10)
+	}
+	subpackets = append(subpackets, 22, sigSubpacketIssuerFingerprint, publicKeyVersion4)
+	subpackets = append(subpackets, primary.Fingerprint[:]...)
+
+	hashed := []byte{4, sigType, uint8(primary.Algo), hashID}
+	hashed = binary.BigEndian.AppendUint16(hashed, uint16(len(subpackets)))
+	hashed = append(hashed, subpackets...)
+
+	digest := signatureDigest(hash, primary, subkey, userIDHashPrefix, userID, hashed)
+
+	input := digest
+	if primary.Algo == packet.PubKeyAlgoRSA {
+		input = append(append([]byte{}, sha256DigestInfoPrefix...), digest...)
+	}
+
+	if _, err := yk.VerifyPIN(1, pin); err != nil {
+		return nil, err
+	}
+
+	raw, err := yubikeyscard.ComputeDigitalSignature(yk.Card, input)
+	if err != nil {
+		return nil, err
+	}
+
+	body := append([]byte{}, hashed...)
+	body = append(body, 0, 10, 9, sigSubpacketIssuer)
+	body = binary.BigEndian.AppendUint64(body, primary.KeyID)
+	body = append(body, digest[:2]...)
+
+	switch primary.Algo {
+	case packet.PubKeyAlgoRSA:
+		body = appendMPI(body, raw)
+	case packet.PubKeyAlgoECDSA, pubKeyAlgoEdDSA:
+		// r and s are returned concatenated, each the size of the field
+		if len(raw) == 0 || len(raw)%2 != 0 {
+			return nil, fmt.Errorf("invalid %d byte signature from YubiKey", len(raw))
+		}
+
+		body = appendMPI(body, raw[:len(raw)/2])
+		body = appendMPI(body, raw[len(raw)/2:])
+	default:
+		return nil, fmt.Errorf("unsupported signature key algorithm %d", primary.Algo)
+	}
+
+	return body, nil
+}
+
+// signingHash returns the OpenPGP ID and hash function for signatures made by
+// the key. ECDSA keys on the larger NIST curves use a hash of matching size.
+func signingHash(pk *PublicKey) (uint8, crypto.Hash) {
+	if pk.Algo == packet.PubKeyAlgoECDSA {
+		if c := yubikeyscard.CurveByOID(pk.oid); c != nil {
+			switch c.Name {
+			case yubikeyscard.CurveP384.Name:
+				return 9, crypto.SHA384
+			case yubikeyscard.CurveP521.Name:
+				return 10, crypto.SHA512
+			}
+		}
+	}
+
+	return 8, crypto.SHA256
+}
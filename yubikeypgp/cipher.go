@@ -0,0 +1,121 @@
+package yubikeypgp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/blowfish"
+	"golang.org/x/crypto/cast5"
+	"golang.org/x/crypto/twofish"
+)
+
+const (
+	cipherIDEA      uint8 = 1
+	cipherTripleDES uint8 = 2
+	cipherCAST5     uint8 = 3
+	cipherBlowfish  uint8 = 4
+	cipherAES128    uint8 = 7
+	cipherAES192    uint8 = 8
+	cipherAES256    uint8 = 9
+	cipherTwofish   uint8 = 10
+
+	sessionKeyChecksumLength = 2
+)
+
+// symmetricCipher describes a symmetric key algorithm from RFC 4880 section
+// 9.2.
+type symmetricCipher struct {
+	name      string
+	keySize   int
+	newCipher func(key []byte) (cipher.Block, error)
+}
+
+var symmetricCiphers = map[uint8]symmetricCipher{
+	cipherIDEA:      {"IDEA", 16, newIDEACipher},
+	cipherTripleDES: {"3DES", 24, des.NewTripleDESCipher},
+	cipherCAST5:     {"CAST5", cast5.KeySize, newCAST5Cipher},
+	cipherBlowfish:  {"Blowfish", 16, newBlowfishCipher},
+	cipherAES128:    {"AES-128", 16, aes.NewCipher},
+	cipherAES192:    {"AES-192", 24, aes.NewCipher},
+	cipherAES256:    {"AES-256", 32, aes.NewCipher},
+	cipherTwofish:   {"Twofish", 32, newTwofishCipher},
+}
+
+// cipherByID returns the symmetric cipher with the provided algorithm ID.
+func cipherByID(id uint8) (symmetricCipher, error) {
+	c, ok := symmetricCiphers[id]
+	if !ok {
+		return symmetricCipher{}, fmt.Errorf("unsupported symmetric cipher %d", id)
+	}
+
+	return c, nil
+}
+
+// sessionKey is a decrypted session key. The cipher is zero for session keys
+// from version 6 encrypted key packets, where the cipher is named by the
+// encrypted data packet instead.
+type sessionKey struct {
+	cipher uint8
+	key    []byte
+}
+
+// decodeSessionKey splits a decrypted session key, as described in RFC 4880
+// section 5.1 and RFC 9580 section 5.1, into the cipher algorithm and key.
+// Version 3 packets prefix the key with the cipher octet, which determines
+// the key length. The two-octet checksum is verified for both versions.
+func decodeSessionKey(version uint8, sk []byte) (sessionKey, error) {
+	if len(sk) < 1+sessionKeyChecksumLength {
+		return sessionKey{}, errors.New("unable to decipher PGP session key")
+	}
+
+	var k sessionKey
+	keyEnd := len(sk) - sessionKeyChecksumLength
+
+	if version == encryptedKeyPacketVersion3 {
+		c, err := cipherByID(sk[0])
+		if err != nil {
+			return sessionKey{}, err
+		}
+
+		if keyEnd != 1+c.keySize {
+			return sessionKey{}, fmt.Errorf("unable to decipher PGP session key, invalid length for %s", c.name)
+		}
+
+		k.cipher = sk[0]
+		k.key = sk[1:keyEnd]
+	} else {
+		k.key = sk[:keyEnd]
+	}
+
+	if binary.BigEndian.Uint16(sk[keyEnd:]) != sessionKeyChecksum(k.key) {
+		return sessionKey{}, errors.New("unable to decipher PGP session key, checksum mismatch")
+	}
+
+	return k, nil
+}
+
+// sessionKeyChecksum returns the sum of the key octets modulo 65536.
+func sessionKeyChecksum(key []byte) uint16 {
+	var sum uint16
+	for _, b := range key {
+		sum += uint16(b)
+	}
+
+	return sum
+}
+
+func newCAST5Cipher(key []byte) (cipher.Block, error) {
+	return cast5.NewCipher(key)
+}
+
+func newBlowfishCipher(key []byte) (cipher.Block, error) {
+	return blowfish.NewCipher(key)
+}
+
+func newTwofishCipher(key []byte) (cipher.Block, error) {
+	return twofish.NewCipher(key)
+}
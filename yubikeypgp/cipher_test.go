@@ -0,0 +1,63 @@
+package yubikeypgp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// encodeSessionKey prefixes the key with the cipher octet, if not zero, and
+// appends the checksum.
+func encodeSessionKey(cipher uint8, key []byte) []byte {
+	var b []byte
+	if cipher != 0 {
+		b = append(b, cipher)
+	}
+
+	b = append(b, key...)
+
+	return binary.BigEndian.AppendUint16(b, sessionKeyChecksum(key))
+}
+
+func TestDecodeSessionKey(t *testing.T) {
+	key16 := bytes.Repeat([]byte{0xa5}, 16)
+	key32 := bytes.Repeat([]byte{0x5a}, 32)
+
+	badChecksum := encodeSessionKey(cipherAES128, key16)
+	badChecksum[len(badChecksum)-1] ^= 0x01
+
+	badChecksumV6 := encodeSessionKey(0, key32)
+	badChecksumV6[len(badChecksumV6)-1] ^= 0x01
+
+	tests := []struct {
+		name    string
+		version uint8
+		data    []byte
+		want    sessionKey
+		wantErr bool
+	}{
+		{"AES-128", encryptedKeyPacketVersion3, encodeSessionKey(cipherAES128, key16), sessionKey{cipherAES128, key16}, false},
+		{"AES-256", encryptedKeyPacketVersion3, encodeSessionKey(cipherAES256, key32), sessionKey{cipherAES256, key32}, false},
+		{"IDEA", encryptedKeyPacketVersion3, encodeSessionKey(cipherIDEA, key16), sessionKey{cipherIDEA, key16}, false},
+		{"version 6", encryptedKeyPacketVersion6, encodeSessionKey(0, key32), sessionKey{0, key32}, false},
+		{"bad checksum", encryptedKeyPacketVersion3, badChecksum, sessionKey{}, true},
+		{"bad checksum version 6", encryptedKeyPacketVersion6, badChecksumV6, sessionKey{}, true},
+		{"key too short for cipher", encryptedKeyPacketVersion3, encodeSessionKey(cipherAES256, key16), sessionKey{}, true},
+		{"key too long for cipher", encryptedKeyPacketVersion3, encodeSessionKey(cipherAES128, key32), sessionKey{}, true},
+		{"unknown cipher", encryptedKeyPacketVersion3, encodeSessionKey(5, key16), sessionKey{}, true},
+		{"too short", encryptedKeyPacketVersion3, []byte{cipherAES128, 0x00}, sessionKey{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeSessionKey(tt.version, tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decodeSessionKey() error = %v, want error %v", err, tt.wantErr)
+			}
+
+			if got.cipher != tt.want.cipher || !bytes.Equal(got.key, tt.want.key) {
+				t.Errorf("decodeSessionKey() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
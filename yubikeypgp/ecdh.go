@@ -0,0 +1,282 @@
+package yubikeypgp
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"vervet/yubikeyscard"
+
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+const (
+	hashAlgoSHA256 uint8 = 8
+	hashAlgoSHA384 uint8 = 9
+	hashAlgoSHA512 uint8 = 10
+)
+
+var (
+	ecdhAnonymousSender = []byte("Anonymous Sender    ")
+	keyWrapIV           = []byte{0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6}
+)
+
+// ecdhKDFParams are the key derivation parameters of an ECDH public key.
+type ecdhKDFParams struct {
+	hash   uint8
+	cipher packet.CipherFunction
+}
+
+// defaultECDHKDFParams returns the KDF parameters GnuPG assigns to ECDH keys
+// based on the curve size. GnuPG 2.3 and newer use AES256 for 384 bit curves,
+// older versions AES192 as RFC 6637 recommends, which ecdhKDFCandidates covers.
+// The parameters are part of the public key, which is not stored on the card.
+func defaultECDHKDFParams(curve *yubikeyscard.Curve) ecdhKDFParams {
+	switch {
+	case curve.Bits <= 256:
+		return ecdhKDFParams{hash: hashAlgoSHA256, cipher: packet.CipherAES128}
+	case curve.Bits <= 384:
+		return ecdhKDFParams{hash: hashAlgoSHA384, cipher: packet.CipherAES256}
+	default:
+		return ecdhKDFParams{hash: hashAlgoSHA512, cipher: packet.CipherAES256}
+	}
+}
+
+// ecdhKDFCandidates returns the KDF parameters that may have been assigned to
+// an ECDH key on the curve, starting with the GnuPG defaults.
+func ecdhKDFCandidates(curve *yubikeyscard.Curve) []ecdhKDFParams {
+	candidates := []ecdhKDFParams{defaultECDHKDFParams(curve)}
+
+	for _, hash := range []uint8{hashAlgoSHA256, hashAlgoSHA384, hashAlgoSHA512} {
+		for _, cipher := range []packet.CipherFunction{packet.CipherAES128, packet.CipherAES192, packet.CipherAES256} {
+			params := ecdhKDFParams{hash: hash, cipher: cipher}
+			if params != candidates[0] {
+				candidates = append(candidates, params)
+			}
+		}
+	}
+
+	return candidates
+}
+
+// decryptECDH recovers the session key from an ECDH encrypted key packet. The
+// shared secret is computed on the YubiKey, the key derivation and unwrapping
+// of the session key are performed in software as described in RFC 6637. The
+// KDF parameters are those that reproduce the fingerprint of the key on the
+// card, or if the public key can not be rebuilt, each candidate is tried until
+// the session key unwraps.
+func decryptECDH(yk *yubikeyscard.YubiKey, ek encryptedKeyPacket) ([]byte, error) {
+	attr := yk.AppRelatedData.AlgoAttrEnc
+	if attr.ID != yubikeyscard.AlgoIdECDH {
+		return nil, errors.New("encryption key on YubiKey is not an ECDH key")
+	}
+
+	curve := yubikeyscard.CurveByOID(attr.ECurveOID)
+	if curve == nil {
+		return nil, fmt.Errorf("unsupported ECDH curve %x", attr.ECurveOID)
+	}
+
+	// Curve25519 points are prefixed with 0x40 in OpenPGP, the card expects
+	// the native encoding
+	point := ek.ephemeralPoint
+	if curve.Name == yubikeyscard.CurveCv25519.Name {
+		if len(point) != 33 || point[0] != 0x40 {
+			return nil, errors.New("invalid Curve25519 ephemeral public key")
+		}
+
+		point = point[1:]
+	}
+
+	shared, err := yubikeyscard.DecipherECDH(yk.Card, point)
+	if err != nil {
+		return nil, err
+	}
+
+	x, err := ecdhSharedX(shared, (curve.Bits+7)/8)
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := ecdhKDFCandidates(curve)
+	if pk, err := CardPublicKey(yk, yubikeyscard.KeySlotEnc); err == nil {
+		candidates = []ecdhKDFParams{pk.kdf}
+	}
+
+	fp := yk.AppRelatedData.Fingerprints.Enc
+
+	for _, params := range candidates {
+		var kek, m []byte
+
+		if kek, err = ecdhKDF(params, x, curve.OID, fp[:]); err != nil {
+			continue
+		}
+
+		if m, err = aesKeyUnwrap(kek, ek.wrappedKey); err != nil {
+			continue
+		}
+
+		return unpadPKCS5(m)
+	}
+
+	// none of the key derivations unwraps the session key
+	return nil, &sessionKeyError{err}
+}
+
+// ecdhSharedX extracts the x-coordinate from the shared secret returned by the
+// card, which may be the bare coordinate, a prefixed coordinate or an
+// uncompressed point.
+func ecdhSharedX(shared []byte, n int) ([]byte, error) {
+	switch {
+	case len(shared) == n:
+		return shared, nil
+	case len(shared) == n+1 && (shared[0] == 0x40 || shared[0] == 0x41):
+		return shared[1:], nil
+	case len(shared) == 2*n+1 && shared[0] == 0x04:
+		return shared[1 : n+1], nil
+	}
+
+	return nil, errors.New("unexpected ECDH shared secret format returned by YubiKey")
+}
+
+// ecdhKDF derives the key encryption key from the shared secret using the KDF
+// from RFC 6637 section 7.
+func ecdhKDF(params ecdhKDFParams, x, oid, fingerprint []byte) ([]byte, error) {
+	var h crypto.Hash
+
+	switch params.hash {
+	case hashAlgoSHA256:
+		h = crypto.SHA256
+	case hashAlgoSHA384:
+		h = crypto.SHA384
+	case hashAlgoSHA512:
+		h = crypto.SHA512
+	default:
+		return nil, fmt.Errorf("unsupported ECDH KDF hash algorithm %d", params.hash)
+	}
+
+	keySize := params.cipher.KeySize()
+	if h.Size() < keySize {
+		return nil, errors.New("ECDH KDF hash is too short for key encryption key")
+	}
+
+	buf := new(bytes.Buffer)
+	buf.WriteByte(uint8(len(oid)))
+	buf.Write(oid)
+	buf.Write([]byte{uint8(packet.PubKeyAlgoECDH), 0x03, 0x01, params.hash, uint8(params.cipher)})
+	buf.Write(ecdhAnonymousSender)
+	buf.Write(fingerprint)
+
+	d := h.New()
+	d.Write([]byte{0, 0, 0, 1})
+	d.Write(x)
+	d.Write(buf.Bytes())
+
+	return d.Sum(nil)[:keySize], nil
+}
+
+// aesKeyUnwrap unwraps a key with the AES key wrap algorithm from RFC 3394.
+func aesKeyUnwrap(kek, wrapped []byte) ([]byte, error) {
+	if len(wrapped)%8 != 0 || len(wrapped) < 24 {
+		return nil, errors.New("invalid length of wrapped session key")
+	}
+
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	n := len(wrapped)/8 - 1
+	a := make([]byte, 8)
+	copy(a, wrapped[:8])
+	r := make([]byte, len(wrapped)-8)
+	copy(r, wrapped[8:])
+
+	b := make([]byte, 16)
+	for j := 5; j >= 0; j-- {
+		for i := n; i >= 1; i-- {
+			t := uint64(n*j + i)
+			binary.BigEndian.PutUint64(b[:8], binary.BigEndian.Uint64(a)^t)
+			copy(b[8:], r[(i-1)*8:i*8])
+
+			block.Decrypt(b, b)
+
+			copy(a, b[:8])
+			copy(r[(i-1)*8:i*8], b[8:])
+		}
+	}
+
+	if subtle.ConstantTimeCompare(a, keyWrapIV) != 1 {
+		return nil, errors.New("session key unwrap failed, integrity check mismatch")
+	}
+
+	return r, nil
+}
+
+// aesKeyWrap wraps a key with the AES key wrap algorithm from RFC 3394.
+func aesKeyWrap(kek, key []byte) ([]byte, error) {
+	if len(key)%8 != 0 || len(key) < 16 {
+		return nil, errors.New("invalid length of session key to wrap")
+	}
+
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	n := len(key) / 8
+	a := make([]byte, 8)
+	copy(a, keyWrapIV)
+	r := make([]byte, len(key))
+	copy(r, key)
+
+	b := make([]byte, 16)
+	for j := 0; j <= 5; j++ {
+		for i := 1; i <= n; i++ {
+			copy(b[:8], a)
+			copy(b[8:], r[(i-1)*8:i*8])
+
+			block.Encrypt(b, b)
+
+			t := uint64(n*j + i)
+			binary.BigEndian.PutUint64(a, binary.BigEndian.Uint64(b[:8])^t)
+			copy(r[(i-1)*8:i*8], b[8:])
+		}
+	}
+
+	return append(a, r...), nil
+}
+
+// padPKCS5 pads the session key to a multiple of eight bytes before it is
+// wrapped.
+func padPKCS5(m []byte) []byte {
+	p := 8 - len(m)%8
+
+	return append(append([]byte{}, m...), bytes.Repeat([]byte{uint8(p)}, p)...)
+}
+
+// unpadPKCS5 removes the PKCS #5 padding applied to the session key before it
+// was wrapped.
+func unpadPKCS5(m []byte) ([]byte, error) {
+	if len(m) == 0 {
+		return nil, errors.New("invalid session key padding")
+	}
+
+	p := int(m[len(m)-1])
+	if p == 0 || p > 8 || p > len(m) {
+		return nil, errors.New("invalid session key padding")
+	}
+
+	for _, b := range m[len(m)-p:] {
+		if int(b) != p {
+			return nil, errors.New("invalid session key padding")
+		}
+	}
+
+	return m[:len(m)-p], nil
+}
@@ -0,0 +1,186 @@
+package yubikeypgp
+
+import (
+	"crypto/aes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"vervet/yubikeyscard"
+
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+const literalDataFormatBinary uint8 = 'b'
+
+// Encrypt encrypts the message to each of the recipients and returns the
+// binary OpenPGP message. The message is encrypted with AES-256 in a version 1
+// integrity protected data packet, which every OpenPGP implementation can
+// decrypt.
+func Encrypt(msg []byte, recipients []*PublicKey) ([]byte, error) {
+	if len(recipients) == 0 {
+		return nil, errors.New("no recipients to encrypt to")
+	}
+
+	sk := sessionKey{cipher: cipherAES256, key: make([]byte, 32)}
+	if _, err := rand.Read(sk.key); err != nil {
+		return nil, err
+	}
+
+	var out []byte
+
+	for _, pk := range recipients {
+		body, err := encryptSessionKey(pk, sk)
+		if err != nil {
+			return nil, fmt.Errorf("encrypt to PGP key %X: %s", pk.KeyID, err)
+		}
+
+		out = append(out, serializePacket(packetTagEncryptedKey, body)...)
+	}
+
+	body, err := encryptSEIPDv1(msg, sk)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(out, serializePacket(packetTagSymEncMDC, body)...), nil
+}
+
+// encryptSessionKey returns the body of a version 3 public-key encrypted
+// session key packet for the recipient, as described in RFC 4880 section 5.1.
+func encryptSessionKey(pk *PublicKey, sk sessionKey) ([]byte, error) {
+	// cipher octet, session key and checksum
+	m := append([]byte{sk.cipher}, sk.key...)
+	m = binary.BigEndian.AppendUint16(m, sessionKeyChecksum(sk.key))
+
+	body := []byte{encryptedKeyPacketVersion3}
+	body = binary.BigEndian.AppendUint64(body, pk.KeyID)
+	body = append(body, uint8(pk.Algo))
+
+	switch pk.Algo {
+	case packet.PubKeyAlgoRSA:
+		pub := &rsa.PublicKey{
+			N: new(big.Int).SetBytes(pk.n),
+			E: int(new(big.Int).SetBytes(pk.e).Int64()),
+		}
+
+		c, err := rsa.EncryptPKCS1v15(rand.Reader, pub, m)
+		if err != nil {
+			return nil, err
+		}
+
+		return appendMPI(body, c), nil
+	case packet.PubKeyAlgoECDH:
+		ephemeral, wrapped, err := encryptECDH(pk, m)
+		if err != nil {
+			return nil, err
+		}
+
+		body = appendMPI(body, ephemeral)
+		body = append(body, uint8(len(wrapped)))
+
+		return append(body, wrapped...), nil
+	}
+
+	return nil, fmt.Errorf("unsupported public key algorithm %d", pk.Algo)
+}
+
+// encryptECDH wraps the session key with a key encryption key derived from an
+// ephemeral key agreement with the recipient, as described in RFC 6637. The
+// ephemeral public point and the wrapped key are returned.
+func encryptECDH(pk *PublicKey, m []byte) (ephemeral, wrapped []byte, err error) {
+	curve := yubikeyscard.CurveByOID(pk.oid)
+	if curve == nil {
+		return nil, nil, fmt.Errorf("unsupported ECDH curve %x", pk.oid)
+	}
+
+	var c ecdh.Curve
+	point := pk.point
+
+	switch curve.Name {
+	case yubikeyscard.CurveCv25519.Name:
+		// Curve25519 points are prefixed with 0x40 in OpenPGP
+		if len(point) != 33 || point[0] != 0x40 {
+			return nil, nil, errors.New("invalid Curve25519 public key")
+		}
+
+		c, point = ecdh.X25519(), point[1:]
+	case yubikeyscard.CurveP256.Name:
+		c = ecdh.P256()
+	case yubikeyscard.CurveP384.Name:
+		c = ecdh.P384()
+	case yubikeyscard.CurveP521.Name:
+		c = ecdh.P521()
+	default:
+		return nil, nil, fmt.Errorf("encryption to %s keys is not supported", curve.Name)
+	}
+
+	remote, err := c.NewPublicKey(point)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	priv, err := c.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	x, err := priv.ECDH(remote)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ephemeral = priv.PublicKey().Bytes()
+	if curve.Name == yubikeyscard.CurveCv25519.Name {
+		ephemeral = append([]byte{0x40}, ephemeral...)
+	}
+
+	kek, err := ecdhKDF(pk.kdf, x, pk.oid, pk.Fingerprint[:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	wrapped, err = aesKeyWrap(kek, padPKCS5(m))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return ephemeral, wrapped, nil
+}
+
+// encryptSEIPDv1 returns the body of a version 1 symmetrically encrypted
+// integrity protected data packet containing the message as literal data.
+func encryptSEIPDv1(msg []byte, sk sessionKey) ([]byte, error) {
+	block, err := aes.NewCipher(sk.key)
+	if err != nil {
+		return nil, err
+	}
+
+	bs := block.BlockSize()
+
+	// random prefix with a repeat of its last two octets
+	plaintext := make([]byte, bs+2, bs+2+len(msg)+64)
+	if _, err := rand.Read(plaintext[:bs]); err != nil {
+		return nil, err
+	}
+
+	copy(plaintext[bs:], plaintext[bs-2:bs])
+
+	// binary literal data without file name or date
+	literal := append([]byte{literalDataFormatBinary, 0, 0, 0, 0, 0}, msg...)
+	plaintext = append(plaintext, serializePacket(packetTagLiteralData, literal)...)
+	plaintext = append(plaintext, mdcPacketHeader...)
+
+	h := sha1.Sum(plaintext)
+	plaintext = append(plaintext, h[:]...)
+
+	body := make([]byte, 1+len(plaintext))
+	body[0] = seipdVersion1
+	cfbEncrypt(block, body[1:], plaintext)
+
+	return body, nil
+}
@@ -0,0 +1,164 @@
+package yubikeypgp
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	ideaBlockSize = 8
+	ideaKeySize   = 16
+	ideaRounds    = 8
+	ideaSubkeys   = 6*ideaRounds + 4
+)
+
+// ideaCipher is an implementation of the IDEA block cipher, which is not
+// provided by the Go standard library or golang.org/x/crypto but is still
+// listed by RFC 4880 for older OpenPGP messages.
+type ideaCipher struct {
+	ek [ideaSubkeys]uint16 // encryption subkeys
+	dk [ideaSubkeys]uint16 // decryption subkeys
+}
+
+func newIDEACipher(key []byte) (cipher.Block, error) {
+	if len(key) != ideaKeySize {
+		return nil, errors.New("invalid IDEA key size")
+	}
+
+	c := new(ideaCipher)
+
+	// subkeys are taken 16 bits at a time from the key, which is rotated
+	// left by 25 bits after every eight subkeys
+	hi := binary.BigEndian.Uint64(key[:8])
+	lo := binary.BigEndian.Uint64(key[8:])
+
+	for i := 0; i < ideaSubkeys; i++ {
+		switch j := i % 8; {
+		case j < 4:
+			c.ek[i] = uint16(hi >> (48 - 16*j))
+		default:
+			c.ek[i] = uint16(lo >> (48 - 16*(j-4)))
+		}
+
+		if i%8 == 7 {
+			hi, lo = hi<<25|lo>>39, lo<<25|hi>>39
+		}
+	}
+
+	// decryption subkeys are the inverses of the encryption subkeys in
+	// reverse round order
+	ek, dk := c.ek[:], c.dk[:]
+	for r := 0; r <= ideaRounds; r++ {
+		e := ek[6*r:]
+		d := dk[6*(ideaRounds-r):]
+
+		d[0] = ideaMulInv(e[0])
+		d[3] = ideaMulInv(e[3])
+
+		// the additive subkeys are swapped except in the first and last round
+		if r == 0 || r == ideaRounds {
+			d[1] = -e[1]
+			d[2] = -e[2]
+		} else {
+			d[1] = -e[2]
+			d[2] = -e[1]
+		}
+
+		if r < ideaRounds {
+			dm := dk[6*(ideaRounds-r-1):]
+			dm[4] = e[4]
+			dm[5] = e[5]
+		}
+	}
+
+	return c, nil
+}
+
+func (c *ideaCipher) BlockSize() int {
+	return ideaBlockSize
+}
+
+func (c *ideaCipher) Encrypt(dst, src []byte) {
+	ideaCrypt(&c.ek, dst, src)
+}
+
+func (c *ideaCipher) Decrypt(dst, src []byte) {
+	ideaCrypt(&c.dk, dst, src)
+}
+
+func ideaCrypt(k *[ideaSubkeys]uint16, dst, src []byte) {
+	x1 := binary.BigEndian.Uint16(src[0:2])
+	x2 := binary.BigEndian.Uint16(src[2:4])
+	x3 := binary.BigEndian.Uint16(src[4:6])
+	x4 := binary.BigEndian.Uint16(src[6:8])
+
+	for r := 0; r < ideaRounds; r++ {
+		sk := k[6*r:]
+
+		x1 = ideaMul(x1, sk[0])
+		x2 += sk[1]
+		x3 += sk[2]
+		x4 = ideaMul(x4, sk[3])
+
+		s3 := x3
+		x3 = ideaMul(x3^x1, sk[4])
+		s2 := x2
+		x2 = ideaMul((x2^x4)+x3, sk[5])
+		x3 += x2
+
+		x1 ^= x2
+		x4 ^= x3
+		x2 ^= s3
+		x3 ^= s2
+	}
+
+	sk := k[6*ideaRounds:]
+	binary.BigEndian.PutUint16(dst[0:2], ideaMul(x1, sk[0]))
+	binary.BigEndian.PutUint16(dst[2:4], x3+sk[1])
+	binary.BigEndian.PutUint16(dst[4:6], x2+sk[2])
+	binary.BigEndian.PutUint16(dst[6:8], ideaMul(x4, sk[3]))
+}
+
+// ideaMul multiplies modulo 2^16+1, where zero represents 2^16.
+func ideaMul(a, b uint16) uint16 {
+	if a == 0 {
+		return 1 - b
+	}
+
+	if b == 0 {
+		return 1 - a
+	}
+
+	p := uint32(a) * uint32(b)
+	lo, hi := uint16(p), uint16(p>>16)
+
+	if lo < hi {
+		return lo - hi + 1
+	}
+
+	return lo - hi
+}
+
+// ideaMulInv returns the multiplicative inverse modulo 2^16+1.
+func ideaMulInv(x uint16) uint16 {
+	if x <= 1 {
+		return x
+	}
+
+	// extended Euclidean algorithm
+	t0, t1 := int64(0), int64(1)
+	r0, r1 := int64(0x10001), int64(x)
+
+	for r1 != 0 {
+		q := r0 / r1
+		t0, t1 = t1, t0-q*t1
+		r0, r1 = r1, r0-q*r1
+	}
+
+	if t0 < 0 {
+		t0 += 0x10001
+	}
+
+	return uint16(t0)
+}
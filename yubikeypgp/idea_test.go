@@ -0,0 +1,49 @@
+package yubikeypgp
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestIDEA(t *testing.T) {
+	// the first vector is from the IDEA specification, the others were
+	// checked against OpenSSL
+	tests := []struct {
+		key, plaintext, ciphertext string
+	}{
+		{"00010002000300040005000600070008", "0000000100020003", "11fbed2b01986de5"},
+		{"80000000000000000000000000000000", "0000000000000000", "b1f5f7f87901370f"},
+		{"000102030405060708090a0b0c0d0e0f", "0011223344556677", "f526ab9a62c0d258"},
+		{"2bd6459f82c5b300952c49104881ff48", "ea024714ad5c4d84", "c8fb51d3516627a8"},
+	}
+
+	for _, tt := range tests {
+		key, _ := hex.DecodeString(tt.key)
+		plaintext, _ := hex.DecodeString(tt.plaintext)
+		ciphertext, _ := hex.DecodeString(tt.ciphertext)
+
+		c, err := newIDEACipher(key)
+		if err != nil {
+			t.Fatalf("newIDEACipher() error = %v", err)
+		}
+
+		got := make([]byte, ideaBlockSize)
+
+		c.Encrypt(got, plaintext)
+		if !bytes.Equal(got, ciphertext) {
+			t.Errorf("Encrypt() key %s = %x, want %x", tt.key, got, ciphertext)
+		}
+
+		c.Decrypt(got, ciphertext)
+		if !bytes.Equal(got, plaintext) {
+			t.Errorf("Decrypt() key %s = %x, want %x", tt.key, got, plaintext)
+		}
+	}
+}
+
+func TestIDEAKeySize(t *testing.T) {
+	if _, err := newIDEACipher(make([]byte, 15)); err == nil {
+		t.Error("newIDEACipher() accepted a 15 byte key")
+	}
+}
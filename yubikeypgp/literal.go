@@ -0,0 +1,116 @@
+package yubikeypgp
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/flate"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	compressionNone  uint8 = 0
+	compressionZIP   uint8 = 1
+	compressionZLIB  uint8 = 2
+	compressionBZip2 uint8 = 3
+
+	// maxCompressionDepth bounds the nesting of compressed data packets
+	maxCompressionDepth = 8
+)
+
+// readLiteralData returns the contents of the literal data packet, as
+// described in RFC 4880 section 5.9, in the decrypted message. Compressed data
+// packets are decompressed and searched in turn, signature packets are
+// skipped.
+func readLiteralData(r io.Reader, depth int) ([]byte, error) {
+	for {
+		p, err := readPacket(r)
+		if err == io.EOF {
+			return nil, errors.New("invalid PGP message, no literal data packet found")
+		} else if err != nil {
+			return nil, err
+		}
+
+		switch p.tag {
+		case packetTagLiteralData:
+			// format octet, length prefixed file name and four octet date
+			if len(p.body) < 2 || len(p.body) < 2+int(p.body[1])+4 {
+				return nil, errors.New("invalid PGP literal data packet, header too short")
+			}
+
+			return p.body[2+int(p.body[1])+4:], nil
+		case packetTagCompressed:
+			if depth >= maxCompressionDepth {
+				return nil, errors.New("invalid PGP message, compressed data packets nested too deeply")
+			}
+
+			data, err := decompress(p.body)
+			if err != nil {
+				return nil, err
+			}
+
+			return readLiteralData(data, depth+1)
+		case packetTagSignature, packetTagOnePassSignature, packetTagMarker:
+			// signatures are not verified, the message is authenticated by
+			// the integrity protection of the encrypted data packet
+		default:
+			return nil, errors.New("unexpected PGP packet type encountered")
+		}
+	}
+}
+
+// decompress returns a reader of the packets in the body of a compressed data
+// packet, as described in RFC 4880 section 5.6. The decompressed length is
+// limited to the maximum packet length.
+func decompress(body []byte) (io.Reader, error) {
+	if len(body) == 0 {
+		return nil, errors.New("invalid PGP compressed data packet, body too short")
+	}
+
+	r := bytes.NewReader(body[1:])
+
+	var d io.Reader
+	switch body[0] {
+	case compressionNone:
+		d = r
+	case compressionZIP:
+		d = flate.NewReader(r)
+	case compressionZLIB:
+		z, err := zlib.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+
+		d = z
+	case compressionBZip2:
+		d = bzip2.NewReader(r)
+	default:
+		return nil, fmt.Errorf("unsupported compression algorithm %d", body[0])
+	}
+
+	return &limitedReader{r: d, n: maxPacketLength}, nil
+}
+
+// limitedReader reads from r until n bytes have been read, further reads fail
+// rather than returning a truncated stream.
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		return 0, errors.New("invalid PGP compressed data packet, decompressed data too long")
+	}
+
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+
+	return n, err
+}
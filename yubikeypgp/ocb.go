@@ -0,0 +1,219 @@
+package yubikeypgp
+
+import (
+	"crypto/cipher"
+	"crypto/subtle"
+	"errors"
+	"math/bits"
+)
+
+const (
+	ocbBlockSize = 16
+	ocbTagSize   = 16
+	ocbNonceSize = 15
+)
+
+// ocb implements the OCB3 authenticated encryption mode from RFC 7253 with a
+// 128-bit tag, which is not provided by the Go standard library.
+type ocb struct {
+	block   cipher.Block
+	lStar   [ocbBlockSize]byte
+	lDollar [ocbBlockSize]byte
+	l       [][ocbBlockSize]byte
+}
+
+func newOCB(block cipher.Block) (cipher.AEAD, error) {
+	if block.BlockSize() != ocbBlockSize {
+		return nil, errors.New("OCB requires a 128-bit block cipher")
+	}
+
+	o := &ocb{block: block}
+
+	block.Encrypt(o.lStar[:], o.lStar[:])
+	o.lDollar = ocbDouble(o.lStar)
+	o.l = [][ocbBlockSize]byte{ocbDouble(o.lDollar)}
+
+	return o, nil
+}
+
+func (o *ocb) NonceSize() int {
+	return ocbNonceSize
+}
+
+func (o *ocb) Overhead() int {
+	return ocbTagSize
+}
+
+func (o *ocb) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	ret, out := sliceForAppend(dst, len(plaintext)+ocbTagSize)
+	tag := o.crypt(true, out, nonce, plaintext, additionalData)
+	copy(out[len(plaintext):], tag[:])
+
+	return ret
+}
+
+func (o *ocb) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < ocbTagSize {
+		return nil, errors.New("OCB ciphertext too short")
+	}
+
+	n := len(ciphertext) - ocbTagSize
+	ret, out := sliceForAppend(dst, n)
+	tag := o.crypt(false, out, nonce, ciphertext[:n], additionalData)
+
+	if subtle.ConstantTimeCompare(tag[:], ciphertext[n:]) != 1 {
+		clear(out)
+		return nil, errors.New("OCB authentication failed")
+	}
+
+	return ret, nil
+}
+
+// crypt encrypts or decrypts src into dst and returns the authentication tag.
+func (o *ocb) crypt(encrypt bool, dst, nonce, src, adata []byte) [ocbBlockSize]byte {
+	if len(nonce) > ocbNonceSize {
+		panic("OCB nonce too long")
+	}
+
+	// the nonce block is the tag length modulo 128, zero padding, a one bit
+	// and the nonce
+	var n [ocbBlockSize]byte
+	copy(n[ocbBlockSize-len(nonce):], nonce)
+	n[0] |= (ocbTagSize * 8 % 128) << 1
+	n[ocbBlockSize-len(nonce)-1] |= 1
+
+	bottom := uint(n[ocbBlockSize-1] & 0x3f)
+	n[ocbBlockSize-1] &= 0xc0
+
+	var stretch [ocbBlockSize + 8]byte
+	o.block.Encrypt(stretch[:ocbBlockSize], n[:])
+	for i := 0; i < 8; i++ {
+		stretch[ocbBlockSize+i] = stretch[i] ^ stretch[i+1]
+	}
+
+	var offset, checksum, buf [ocbBlockSize]byte
+	shiftLeft(offset[:], stretch[bottom/8:], bottom%8)
+
+	for i := 1; len(src) >= ocbBlockSize; i++ {
+		subtle.XORBytes(offset[:], offset[:], o.lAt(bits.TrailingZeros(uint(i))))
+
+		if encrypt {
+			subtle.XORBytes(checksum[:], checksum[:], src[:ocbBlockSize])
+		}
+
+		subtle.XORBytes(buf[:], src[:ocbBlockSize], offset[:])
+		if encrypt {
+			o.block.Encrypt(buf[:], buf[:])
+		} else {
+			o.block.Decrypt(buf[:], buf[:])
+		}
+		subtle.XORBytes(dst[:ocbBlockSize], buf[:], offset[:])
+
+		if !encrypt {
+			subtle.XORBytes(checksum[:], checksum[:], dst[:ocbBlockSize])
+		}
+
+		src, dst = src[ocbBlockSize:], dst[ocbBlockSize:]
+	}
+
+	if len(src) > 0 {
+		subtle.XORBytes(offset[:], offset[:], o.lStar[:])
+
+		var pad [ocbBlockSize]byte
+		o.block.Encrypt(pad[:], offset[:])
+		subtle.XORBytes(dst, src, pad[:len(src)])
+
+		plain := src
+		if !encrypt {
+			plain = dst[:len(src)]
+		}
+
+		var last [ocbBlockSize]byte
+		copy(last[:], plain)
+		last[len(plain)] = 0x80
+		subtle.XORBytes(checksum[:], checksum[:], last[:])
+	}
+
+	var tag [ocbBlockSize]byte
+	subtle.XORBytes(tag[:], checksum[:], offset[:])
+	subtle.XORBytes(tag[:], tag[:], o.lDollar[:])
+	o.block.Encrypt(tag[:], tag[:])
+
+	sum := o.hash(adata)
+	subtle.XORBytes(tag[:], tag[:], sum[:])
+
+	return tag
+}
+
+// hash processes the associated data.
+func (o *ocb) hash(adata []byte) [ocbBlockSize]byte {
+	var offset, sum, buf [ocbBlockSize]byte
+
+	for i := 1; len(adata) >= ocbBlockSize; i++ {
+		subtle.XORBytes(offset[:], offset[:], o.lAt(bits.TrailingZeros(uint(i))))
+		subtle.XORBytes(buf[:], adata[:ocbBlockSize], offset[:])
+		o.block.Encrypt(buf[:], buf[:])
+		subtle.XORBytes(sum[:], sum[:], buf[:])
+
+		adata = adata[ocbBlockSize:]
+	}
+
+	if len(adata) > 0 {
+		subtle.XORBytes(offset[:], offset[:], o.lStar[:])
+
+		buf = [ocbBlockSize]byte{}
+		copy(buf[:], adata)
+		buf[len(adata)] = 0x80
+
+		subtle.XORBytes(buf[:], buf[:], offset[:])
+		o.block.Encrypt(buf[:], buf[:])
+		subtle.XORBytes(sum[:], sum[:], buf[:])
+	}
+
+	return sum
+}
+
+// lAt returns L_i, computing and caching further values as needed.
+func (o *ocb) lAt(i int) []byte {
+	for len(o.l) <= i {
+		o.l = append(o.l, ocbDouble(o.l[len(o.l)-1]))
+	}
+
+	return o.l[i][:]
+}
+
+// ocbDouble multiplies by two in GF(2^128).
+func ocbDouble(s [ocbBlockSize]byte) [ocbBlockSize]byte {
+	var d [ocbBlockSize]byte
+
+	shiftLeft(d[:], s[:], 1)
+	if s[0]&0x80 != 0 {
+		d[ocbBlockSize-1] ^= 0x87
+	}
+
+	return d
+}
+
+// shiftLeft stores the leftmost len(dst) bytes of src shifted left by n bits,
+// with n less than eight, into dst.
+func shiftLeft(dst, src []byte, n uint) {
+	for i := range dst {
+		dst[i] = src[i] << n
+		if n > 0 && i+1 < len(src) {
+			dst[i] |= src[i+1] >> (8 - n)
+		}
+	}
+}
+
+// sliceForAppend extends in by n bytes and returns the extended slice and the
+// appended part.
+func sliceForAppend(in []byte, n int) (head, tail []byte) {
+	if total := len(in) + n; cap(in) >= total {
+		head = in[:total]
+	} else {
+		head = make([]byte, total)
+		copy(head, in)
+	}
+
+	return head, head[len(in):]
+}
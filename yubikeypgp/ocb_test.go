@@ -0,0 +1,115 @@
+package yubikeypgp
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+)
+
+// ocbVectors are the AES-128 test vectors of RFC 7253 appendix A. The
+// associated data and plaintext are the bytes 00, 01, 02... of the lengths.
+var ocbVectors = []struct {
+	nonce      string
+	adataLen   int
+	plainLen   int
+	ciphertext string
+}{
+	{"BBAA99887766554433221100", 0, 0, "785407BFFFC8AD9EDCC5520AC9111EE6"},
+	{"BBAA99887766554433221101", 8, 8, "6820B3657B6F615A5725BDA0D3B4EB3A257C9AF1F8F03009"},
+	{"BBAA99887766554433221102", 8, 0, "81017F8203F081277152FADE694A0A00"},
+	{"BBAA99887766554433221103", 0, 8, "45DD69F8F5AAE72414054CD1F35D82760B2CD00D2F99BFA9"},
+	{"BBAA99887766554433221104", 16, 16, "571D535B60B277188BE5147170A9A22C3AD7A4FF3835B8C5701C1CCEC8FC3358"},
+	{"BBAA99887766554433221105", 16, 0, "8CF761B6902EF764462AD86498CA6B97"},
+	{"BBAA99887766554433221106", 0, 16, "5CE88EC2E0692706A915C00AEB8B2396F40E1C743F52436BDF06D8FA1ECA343D"},
+	{"BBAA99887766554433221107", 24, 24, "1CA2207308C87C010756104D8840CE1952F09673A448A122C92C62241051F57356D7F3C90BB0E07F"},
+	{"BBAA99887766554433221108", 24, 0, "6DC225A071FC1B9F7C69F93B0F1E10DE"},
+	{"BBAA99887766554433221109", 0, 24, "221BD0DE7FA6FE993ECCD769460A0AF2D6CDED0C395B1C3CE725F32494B9F914D85C0B1EB38357FF"},
+	{"BBAA9988776655443322110A", 32, 32, "BD6F6C496201C69296C11EFD138A467ABD3C707924B964DEAFFC40319AF5A48540FBBA186C5553C68AD9F592A79A4240"},
+	{"BBAA9988776655443322110B", 32, 0, "FE80690BEE8A485D11F32965BC9D2A32"},
+	{"BBAA9988776655443322110C", 0, 32, "2942BFC773BDA23CABC6ACFD9BFD5835BD300F0973792EF46040C53F1432BCDFB5E1DDE3BC18A5F840B52E653444D5DF"},
+	{"BBAA9988776655443322110D", 40, 40, "D5CA91748410C1751FF8A2F618255B68A0A12E093FF454606E59F9C1D0DDC54B65E8628E568BAD7AED07BA06A4A69483A7035490C5769E60"},
+	{"BBAA9988776655443322110E", 40, 0, "C5CD9D1850C141E358649994EE701B68"},
+	{"BBAA9988776655443322110F", 0, 40, "4412923493C57D5DE0D700F753CCE0D1D2D95060122E9F15A5DDBFC5787E50B5CC55EE507BCB084E479AD363AC366B95A98CA5F3000B1479"},
+}
+
+func countingBytes(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i)
+	}
+
+	return b
+}
+
+func newTestOCB(t *testing.T, key []byte) *ocb {
+	t.Helper()
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aead, err := newOCB(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return aead.(*ocb)
+}
+
+func TestOCBVectors(t *testing.T) {
+	aead := newTestOCB(t, countingBytes(16))
+
+	for _, v := range ocbVectors {
+		nonce, _ := hex.DecodeString(v.nonce)
+		want, _ := hex.DecodeString(v.ciphertext)
+		adata := countingBytes(v.adataLen)
+		plaintext := countingBytes(v.plainLen)
+
+		got := aead.Seal(nil, nonce, plaintext, adata)
+		if !bytes.Equal(got, want) {
+			t.Errorf("Seal() nonce %s = %X, want %X", v.nonce, got, want)
+			continue
+		}
+
+		opened, err := aead.Open(nil, nonce, got, adata)
+		if err != nil || !bytes.Equal(opened, plaintext) {
+			t.Errorf("Open() nonce %s = %X, %v, want %X", v.nonce, opened, err, plaintext)
+		}
+
+		got[0] ^= 0x01
+		if _, err := aead.Open(nil, nonce, got, adata); err == nil {
+			t.Errorf("Open() nonce %s accepted a modified ciphertext", v.nonce)
+		}
+	}
+}
+
+// TestOCBIterative runs the iterative test of RFC 7253 appendix A for AES-128
+// with a 128-bit tag, which covers messages of up to 127 bytes.
+func TestOCBIterative(t *testing.T) {
+	key := make([]byte, 16)
+	key[15] = 128
+	aead := newTestOCB(t, key)
+
+	nonce := func(i int) []byte {
+		n := make([]byte, 12)
+		binary.BigEndian.PutUint32(n[8:], uint32(i))
+
+		return n
+	}
+
+	var c []byte
+	for i := 0; i < 128; i++ {
+		s := make([]byte, i)
+		c = aead.Seal(c, nonce(3*i+1), s, s)
+		c = aead.Seal(c, nonce(3*i+2), s, nil)
+		c = aead.Seal(c, nonce(3*i+3), nil, s)
+	}
+
+	got := aead.Seal(nil, nonce(385), nil, c)
+	if want, _ := hex.DecodeString("67E944D23256C5E0B6C61FA22FDF1EA2"); !bytes.Equal(got, want) {
+		t.Errorf("iterative tag = %X, want %X", got, want)
+	}
+}
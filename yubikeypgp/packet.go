@@ -0,0 +1,223 @@
+package yubikeypgp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+const (
+	packetTagEncryptedKey     uint8 = 1
+	packetTagSignature        uint8 = 2
+	packetTagSymKeyEnc        uint8 = 3
+	packetTagOnePassSignature uint8 = 4
+	packetTagCompressed       uint8 = 8
+	packetTagSymEnc           uint8 = 9
+	packetTagMarker           uint8 = 10
+	packetTagLiteralData      uint8 = 11
+	packetTagSymEncMDC        uint8 = 18
+
+	// maxPacketLength bounds the body of a single packet, encrypted unseal
+	// keys are a few hundred bytes
+	maxPacketLength = 1 << 24
+)
+
+// rawPacket is an OpenPGP packet with its body read into memory.
+type rawPacket struct {
+	tag  uint8
+	body []byte
+}
+
+// readPacket reads the next packet from r as described in RFC 4880 section 4.2.
+// Old and new format headers are supported with every length form, including
+// indeterminate lengths and partial body lengths, which are reassembled into
+// a single body. io.EOF is returned if r holds no further packets.
+func readPacket(r io.Reader) (p rawPacket, err error) {
+	var ctb [1]byte
+
+	if _, err = io.ReadFull(r, ctb[:]); err != nil {
+		return
+	}
+
+	if ctb[0]&0x80 == 0 {
+		err = errors.New("invalid PGP packet header, tag bit not set")
+		return
+	}
+
+	// old format header, length type in the two low bits
+	if ctb[0]&0x40 == 0 {
+		p.tag = (ctb[0] >> 2) & 0x0f
+
+		var length int64
+		switch ctb[0] & 0x03 {
+		case 0:
+			length, err = readLength(r, 1)
+		case 1:
+			length, err = readLength(r, 2)
+		case 2:
+			length, err = readLength(r, 4)
+		case 3:
+			// indeterminate length, the packet extends to the end of input
+			length = -1
+		}
+		if err != nil {
+			return
+		}
+
+		p.body, err = readBody(r, length)
+		return
+	}
+
+	// new format header, followed by one or more length headers
+	p.tag = ctb[0] & 0x3f
+
+	for {
+		length, partial, lerr := readNewFormatLength(r)
+		if lerr != nil {
+			err = lerr
+			return
+		}
+
+		body, berr := readBody(r, length)
+		if berr != nil {
+			err = berr
+			return
+		}
+
+		p.body = append(p.body, body...)
+		if len(p.body) > maxPacketLength {
+			err = errors.New("invalid PGP packet, body too long")
+			return
+		}
+
+		if !partial {
+			return
+		}
+	}
+}
+
+// readNewFormatLength reads a one, two or five octet new format body length,
+// or a partial body length.
+func readNewFormatLength(r io.Reader) (length int64, partial bool, err error) {
+	var b [1]byte
+
+	if _, err = io.ReadFull(r, b[:]); err != nil {
+		return 0, false, unexpectedEOF(err)
+	}
+
+	switch {
+	case b[0] < 192:
+		return int64(b[0]), false, nil
+	case b[0] < 224:
+		var b2 [1]byte
+		if _, err = io.ReadFull(r, b2[:]); err != nil {
+			return 0, false, unexpectedEOF(err)
+		}
+
+		return (int64(b[0])-192)<<8 + int64(b2[0]) + 192, false, nil
+	case b[0] == 255:
+		length, err = readLength(r, 4)
+		return length, false, err
+	default:
+		return 1 << (b[0] & 0x1f), true, nil
+	}
+}
+
+// readLength reads a big-endian length field of n octets.
+func readLength(r io.Reader, n int) (int64, error) {
+	var buf [4]byte
+
+	if _, err := io.ReadFull(r, buf[4-n:]); err != nil {
+		return 0, unexpectedEOF(err)
+	}
+
+	return int64(binary.BigEndian.Uint32(buf[:])), nil
+}
+
+// readBody reads a packet body of the provided length, or up to the end of
+// input if length is negative.
+func readBody(r io.Reader, length int64) ([]byte, error) {
+	if length > maxPacketLength {
+		return nil, fmt.Errorf("invalid PGP packet, body length %d too long", length)
+	}
+
+	if length < 0 {
+		return io.ReadAll(io.LimitReader(r, maxPacketLength))
+	}
+
+	// read through a limited reader, so a bogus length can not force a large
+	// allocation
+	body, err := io.ReadAll(io.LimitReader(r, length))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(body)) != length {
+		return nil, errors.New("invalid PGP packet, body shorter than header length")
+	}
+
+	return body, nil
+}
+
+// readMPI reads a multiprecision integer as described in RFC 4880 section 3.2
+// and returns its value and the remaining bytes.
+func readMPI(b []byte) (value []byte, bits uint16, rest []byte, err error) {
+	if len(b) < 2 {
+		return nil, 0, nil, errors.New("invalid PGP packet, MPI too short")
+	}
+
+	bits = binary.BigEndian.Uint16(b[:2])
+	n := (int(bits) + 7) / 8
+
+	if len(b)-2 < n {
+		return nil, 0, nil, errors.New("invalid PGP packet, MPI longer than packet")
+	}
+
+	return b[2 : 2+n], bits, b[2+n:], nil
+}
+
+// serializePacket returns a packet with a new format header as described in
+// RFC 4880 section 4.2.2.
+func serializePacket(tag uint8, body []byte) []byte {
+	b := []byte{0xc0 | tag}
+
+	switch n := len(body); {
+	case n < 192:
+		b = append(b, uint8(n))
+	case n < 8384:
+		n -= 192
+		b = append(b, uint8(n>>8)+192, uint8(n))
+	default:
+		b = append(b, 0xff)
+		b = binary.BigEndian.AppendUint32(b, uint32(n))
+	}
+
+	return append(b, body...)
+}
+
+// appendMPI appends the value as a multiprecision integer, leading zeros are
+// stripped.
+func appendMPI(b, value []byte) []byte {
+	for len(value) > 0 && value[0] == 0 {
+		value = value[1:]
+	}
+
+	n := 0
+	if len(value) > 0 {
+		n = 8*len(value) - bits.LeadingZeros8(value[0])
+	}
+
+	b = binary.BigEndian.AppendUint16(b, uint16(n))
+
+	return append(b, value...)
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+
+	return err
+}
@@ -0,0 +1,510 @@
+package yubikeypgp
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+	"vervet/yubikeyscard"
+
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+const (
+	packetTagSecretKey    uint8 = 5
+	packetTagPublicKey    uint8 = 6
+	packetTagSecretSubkey uint8 = 7
+	packetTagPublicSubkey uint8 = 14
+
+	publicKeyVersion4 uint8 = 4
+
+	sigTypeSubkeyBinding    uint8 = 0x18
+	sigTypeKeyRevocation    uint8 = 0x20
+	sigTypeSubkeyRevocation uint8 = 0x28
+	sigSubpacketKeyFlags    uint8 = 27
+
+	keyFlagCertify        uint8 = 0x01
+	keyFlagSign           uint8 = 0x02
+	keyFlagEncryptComms   uint8 = 0x04
+	keyFlagEncryptStorage uint8 = 0x08
+	keyFlagAuthenticate   uint8 = 0x20
+
+	pubKeyAlgoEdDSA packet.PublicKeyAlgorithm = 22
+
+	armorPublicKeyType = "PGP PUBLIC KEY BLOCK"
+)
+
+// PublicKey is an OpenPGP version 4 public key, as described in RFC 4880
+// section 5.5.2.
+type PublicKey struct {
+	Algo        packet.PublicKeyAlgorithm
+	Created     time.Time
+	Fingerprint [20]byte
+	KeyID       uint64
+	Flags       uint8 // key flags from the self-signature, zero if absent
+
+	body     []byte // serialized packet body the fingerprint is computed over
+	n, e     []byte // RSA only
+	oid      []byte // ECC only
+	point    []byte // ECC only
+	kdf      ecdhKDFParams
+	secret   []byte // secret portion of secret key packets
+	revoked  bool
+	verified bool // a self-signature or binding signature was verified
+	hasFlags bool // keys read from certificates without key flags are usable for any purpose
+}
+
+// CanEncrypt reports whether messages can be encrypted to the key.
+func (pk *PublicKey) CanEncrypt() bool {
+	if pk.Algo != packet.PubKeyAlgoRSA && pk.Algo != packet.PubKeyAlgoECDH {
+		return false
+	}
+
+	return !pk.hasFlags || pk.Flags&(keyFlagEncryptComms|keyFlagEncryptStorage) != 0
+}
+
+// Serialize returns the key as a public key packet. User IDs and
+// self-signatures are not included.
+func (pk *PublicKey) Serialize() []byte {
+	return serializePacket(packetTagPublicKey, pk.body)
+}
+
+// WriteArmored writes the key as an ASCII armored public key block with an
+// optional comment header.
+func (pk *PublicKey) WriteArmored(w io.Writer, comment string) error {
+	return encodeArmor(w, armorPublicKeyType, comment, pk.Serialize())
+}
+
+// ParsePublicKeys returns the key to encrypt to from each certificate in data,
+// which may be ASCII armored or binary. The newest key whose key flags allow
+// encryption is chosen, revoked keys are skipped. Key flags and revocations
+// are only taken from self-signatures that verify against the primary key,
+// and subkeys without a verified binding signature are ignored.
+func ParsePublicKeys(data []byte) ([]*PublicKey, error) {
+	if bytes.Contains(data, []byte(armorBegin)) {
+		var err error
+
+		data, err = decodeArmoredBlocks(data, armorPublicKeyType)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	certs, err := readCertificates(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(certs) == 0 {
+		return nil, errors.New("no PGP public keys found")
+	}
+
+	var recipients []*PublicKey
+
+	for _, keys := range certs {
+		chosen, err := chooseKey(keys, "encryption", (*PublicKey).CanEncrypt)
+		if err != nil {
+			return nil, err
+		}
+
+		recipients = append(recipients, chosen)
+	}
+
+	return recipients, nil
+}
+
+// readCertificates reads the public or secret keys of each certificate in
+// data, with the primary key first. Key flags and revocations are taken from
+// the verified self-signatures following each key. The primary key of each
+// certificate must have a verified self-signature, and subkeys without a
+// verified binding signature are dropped.
+func readCertificates(data []byte) ([][]*PublicKey, error) {
+	var certs [][]*PublicKey
+	var primary, last *PublicKey
+	var userID []byte
+	var userIDTag uint8
+
+	r := bytes.NewReader(data)
+
+	for {
+		p, err := readPacket(r)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		switch p.tag {
+		case packetTagPublicKey, packetTagPublicSubkey, packetTagSecretKey, packetTagSecretSubkey:
+			pk, rest, err := parsePublicKey(p.body)
+			if err != nil {
+				return nil, err
+			}
+
+			if p.tag == packetTagSecretKey || p.tag == packetTagSecretSubkey {
+				pk.secret = rest
+			}
+
+			if p.tag == packetTagPublicKey || p.tag == packetTagSecretKey {
+				certs = append(certs, nil)
+				primary = pk
+			} else if len(certs) == 0 {
+				return nil, errors.New("invalid PGP certificate, subkey without primary key")
+			}
+
+			certs[len(certs)-1] = append(certs[len(certs)-1], pk)
+			last = pk
+			userID = nil
+		case packetTagUserID:
+			userID, userIDTag = p.body, userIDHashPrefix
+		case packetTagUserAttribute:
+			userID, userIDTag = p.body, userAttributeHashPrefix
+		case packetTagSignature:
+			if last != nil {
+				applySignature(primary, last, userIDTag, userID, p.body)
+			}
+		}
+	}
+
+	for i, keys := range certs {
+		if !keys[0].verified {
+			return nil, fmt.Errorf("PGP key %X has no valid self-signature", keys[0].KeyID)
+		}
+
+		bound := keys[:1]
+		for _, pk := range keys[1:] {
+			if pk.verified {
+				bound = append(bound, pk)
+			}
+		}
+
+		certs[i] = bound
+	}
+
+	return certs, nil
+}
+
+// chooseKey returns the newest key of the certificate that is not revoked and
+// is usable for the purpose. A revoked primary key revokes the entire
+// certificate.
+func chooseKey(keys []*PublicKey, purpose string, usable func(*PublicKey) bool) (*PublicKey, error) {
+	if keys[0].revoked {
+		return nil, fmt.Errorf("PGP key %X is revoked", keys[0].KeyID)
+	}
+
+	var chosen *PublicKey
+	for _, pk := range keys {
+		if pk.revoked || !usable(pk) {
+			continue
+		}
+
+		if chosen == nil || !pk.Created.Before(chosen.Created) {
+			chosen = pk
+		}
+	}
+
+	if chosen == nil {
+		return nil, fmt.Errorf("PGP key %X has no usable %s key", keys[0].KeyID, purpose)
+	}
+
+	return chosen, nil
+}
+
+// CardPublicKey reads the public key in the key slot of the YubiKey and
+// rebuilds the OpenPGP public key from the key material, algorithm attributes
+// and generation time on the card. The KDF parameters of ECDH keys are not
+// stored on the card, so the combinations used by OpenPGP implementations are
+// tried until the fingerprint matches the fingerprint on the card.
+func CardPublicKey(yk *yubikeyscard.YubiKey, slot yubikeyscard.KeySlot) (*PublicKey, error) {
+	attr, fp, created := yk.AppRelatedData.Key(slot)
+
+	if fp == [20]byte{} {
+		return nil, fmt.Errorf("%s key slot of YubiKey %x is empty", slot, yk.AppRelatedData.AID.Serial)
+	}
+
+	material, err := yubikeyscard.ReadPublicKey(yk.Card, slot)
+	if err != nil {
+		return nil, err
+	}
+
+	pk, candidates, err := newCardPublicKey(attr, material, created)
+	if err != nil {
+		return nil, fmt.Errorf("%s key slot: %s", slot, err)
+	}
+
+	for _, kdf := range candidates {
+		pk.kdf = kdf
+		pk.serializeBody()
+
+		if pk.Fingerprint == fp {
+			return pk, nil
+		}
+	}
+
+	return nil, fmt.Errorf("public key in %s key slot does not match fingerprint %X on YubiKey", slot, fp)
+}
+
+// GenerateKey generates a new key pair in the key slot of the YubiKey and
+// returns the OpenPGP public key. The fingerprint and generation time of the
+// key are written to the card. ECDH keys are assigned the GnuPG default KDF
+// parameters. The admin PIN must be verified.
+func GenerateKey(yk *yubikeyscard.YubiKey, slot yubikeyscard.KeySlot, attr yubikeyscard.AlgoAttr) (*PublicKey, error) {
+	if err := yk.BeginTransaction(); err != nil {
+		return nil, err
+	}
+
+	defer yk.EndTransaction()
+
+	material, err := yk.GenerateKeyPair(slot, attr)
+	if err != nil {
+		return nil, err
+	}
+
+	created := time.Unix(time.Now().Unix(), 0)
+
+	pk, candidates, err := newCardPublicKey(attr, material, created)
+	if err != nil {
+		return nil, err
+	}
+
+	pk.kdf = candidates[0]
+	pk.serializeBody()
+
+	if err := yk.SetKeyInfo(slot, pk.Fingerprint, created); err != nil {
+		return nil, err
+	}
+
+	return pk, nil
+}
+
+// newCardPublicKey builds a public key from the key material and algorithm
+// attributes of a key slot. The KDF parameters an ECDH key may have been
+// created with are returned, the fingerprint must be computed once the KDF
+// parameters are set.
+func newCardPublicKey(attr yubikeyscard.AlgoAttr, material *yubikeyscard.PublicKey, created time.Time) (*PublicKey, []ecdhKDFParams, error) {
+	pk := &PublicKey{Created: created}
+
+	candidates := []ecdhKDFParams{{}}
+
+	switch attr.ID {
+	case yubikeyscard.AlgoIdRSA:
+		pk.Algo = packet.PubKeyAlgoRSA
+		pk.n = material.Modulus
+		pk.e = material.Exponent
+	case yubikeyscard.AlgoIdECDH, yubikeyscard.AlgoIdECDSA, yubikeyscard.AlgoIdEdDSA:
+		curve := yubikeyscard.CurveByOID(attr.ECurveOID)
+		if curve == nil {
+			return nil, nil, fmt.Errorf("unsupported curve %x", attr.ECurveOID)
+		}
+
+		pk.Algo = packet.PublicKeyAlgorithm(attr.ID)
+		pk.oid = curve.OID
+		pk.point = material.Point
+
+		// native Curve25519 and Ed25519 points are prefixed with 0x40
+		if curve.Bits == 255 && len(pk.point) == 32 {
+			pk.point = append([]byte{0x40}, pk.point...)
+		}
+
+		if attr.ID == yubikeyscard.AlgoIdECDH {
+			candidates = ecdhKDFCandidates(curve)
+		}
+	default:
+		return nil, nil, fmt.Errorf("unsupported algorithm %d", attr.ID)
+	}
+
+	if pk.n == nil && pk.point == nil {
+		return nil, nil, errors.New("card did not return the public key")
+	}
+
+	return pk, candidates, nil
+}
+
+// parsePublicKey parses the public portion of a public key or secret key
+// packet body. The remainder of the body, the secret portion of secret keys,
+// is returned.
+func parsePublicKey(body []byte) (*PublicKey, []byte, error) {
+	if len(body) < 6 {
+		return nil, nil, errors.New("invalid PGP public key packet, body too short")
+	}
+
+	if body[0] != publicKeyVersion4 {
+		return nil, nil, fmt.Errorf("unsupported PGP public key version %d, only version 4 supported", body[0])
+	}
+
+	pk := &PublicKey{
+		Algo:    packet.PublicKeyAlgorithm(body[5]),
+		Created: time.Unix(int64(binary.BigEndian.Uint32(body[1:5])), 0),
+	}
+
+	fields := body[6:]
+
+	var err error
+
+	switch pk.Algo {
+	case packet.PubKeyAlgoRSA, packet.PubKeyAlgoRSAEncryptOnly:
+		pk.Algo = packet.PubKeyAlgoRSA
+		if pk.n, _, fields, err = readMPI(fields); err != nil {
+			return nil, nil, err
+		}
+		if pk.e, _, fields, err = readMPI(fields); err != nil {
+			return nil, nil, err
+		}
+	case packet.PubKeyAlgoECDH, packet.PubKeyAlgoECDSA, pubKeyAlgoEdDSA:
+		if len(fields) == 0 || len(fields) < 1+int(fields[0]) {
+			return nil, nil, errors.New("invalid PGP public key packet, curve OID too short")
+		}
+
+		pk.oid = fields[1 : 1+fields[0]]
+		if pk.point, _, fields, err = readMPI(fields[1+fields[0]:]); err != nil {
+			return nil, nil, err
+		}
+
+		if pk.Algo == packet.PubKeyAlgoECDH {
+			// length, reserved octet, hash and cipher algorithm
+			if len(fields) < 4 || fields[0] != 3 || fields[1] != 1 {
+				return nil, nil, errors.New("invalid PGP public key packet, unsupported ECDH KDF parameters")
+			}
+
+			pk.kdf = ecdhKDFParams{hash: fields[2], cipher: packet.CipherFunction(fields[3])}
+			fields = fields[4:]
+		}
+	default:
+		// keys of other algorithms are not usable, the boundary of the
+		// public portion of their secret key packets is unknown
+		fields = nil
+	}
+
+	// the fingerprint covers the public portion only
+	pk.body = body[:len(body)-len(fields)]
+	pk.computeFingerprint()
+
+	return pk, fields, nil
+}
+
+// serializeBody serializes the key material into the packet body and updates
+// the fingerprint.
+func (pk *PublicKey) serializeBody() {
+	b := []byte{publicKeyVersion4, 0, 0, 0, 0, uint8(pk.Algo)}
+	binary.BigEndian.PutUint32(b[1:5], uint32(pk.Created.Unix()))
+
+	switch pk.Algo {
+	case packet.PubKeyAlgoRSA:
+		b = appendMPI(b, pk.n)
+		b = appendMPI(b, pk.e)
+	default:
+		b = append(b, uint8(len(pk.oid)))
+		b = append(b, pk.oid...)
+		b = appendMPI(b, pk.point)
+
+		if pk.Algo == packet.PubKeyAlgoECDH {
+			b = append(b, 3, 1, pk.kdf.hash, uint8(pk.kdf.cipher))
+		}
+	}
+
+	pk.body = b
+	pk.computeFingerprint()
+}
+
+// computeFingerprint computes the version 4 fingerprint and key ID as
+// described in RFC 4880 section 12.2.
+func (pk *PublicKey) computeFingerprint() {
+	h := sha1.New()
+	h.Write([]byte{0x99, uint8(len(pk.body) >> 8), uint8(len(pk.body))})
+	h.Write(pk.body)
+	copy(pk.Fingerprint[:], h.Sum(nil))
+
+	pk.KeyID = binary.BigEndian.Uint64(pk.Fingerprint[12:20])
+}
+
+// applySignature records the key flags and revocations of a self-signature
+// on the key the signature follows. Signatures that were not made by the
+// primary key, including third-party certifications, are ignored.
+func applySignature(primary, pk *PublicKey, userIDTag uint8, userID, body []byte) {
+	sig, err := parseSignature(body)
+	if err != nil {
+		return
+	}
+
+	var subkey *PublicKey
+	if pk != primary {
+		subkey = pk
+	}
+
+	switch sig.sigType {
+	case 0x10, 0x11, 0x12, 0x13:
+		// certifications of user IDs
+		if subkey != nil || userID == nil {
+			return
+		}
+
+		err = sig.verify(primary, nil, userIDTag, userID)
+	case sigTypeSubkeyBinding, sigTypeSubkeyRevocation:
+		if subkey == nil {
+			return
+		}
+
+		err = sig.verify(primary, subkey, 0, nil)
+	case sigTypeDirectKey, sigTypeKeyRevocation:
+		if subkey != nil {
+			return
+		}
+
+		err = sig.verify(primary, nil, 0, nil)
+	default:
+		return
+	}
+
+	if err != nil {
+		return
+	}
+
+	if sig.sigType == sigTypeKeyRevocation || sig.sigType == sigTypeSubkeyRevocation {
+		pk.revoked = true
+		return
+	}
+
+	pk.verified = true
+
+	subpackets := sig.subpackets
+
+	for len(subpackets) > 0 {
+		length, header := subpacketLength(subpackets)
+		if length == 0 || len(subpackets) < header+length {
+			return
+		}
+
+		sp := subpackets[header : header+length]
+		if sp[0]&0x7f == sigSubpacketKeyFlags && len(sp) > 1 {
+			pk.Flags |= sp[1]
+			pk.hasFlags = true
+		}
+
+		subpackets = subpackets[header+length:]
+	}
+}
+
+// subpacketLength decodes the length of a signature subpacket, as described
+// in RFC 4880 section 5.2.3.1, and returns it with the size of the length
+// header.
+func subpacketLength(b []byte) (length, header int) {
+	switch {
+	case b[0] < 192:
+		return int(b[0]), 1
+	case b[0] < 255:
+		if len(b) < 2 {
+			return 0, 0
+		}
+
+		return (int(b[0])-192)<<8 + int(b[1]) + 192, 2
+	default:
+		if len(b) < 5 {
+			return 0, 0
+		}
+
+		return int(binary.BigEndian.Uint32(b[1:5])), 5
+	}
+}
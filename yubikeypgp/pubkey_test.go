@@ -0,0 +1,228 @@
+package yubikeypgp
+
+import (
+	"bytes"
+	"crypto"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+func newTestEntity(t *testing.T, name string) *openpgp.Entity {
+	t.Helper()
+
+	return newTestEntityAt(t, name, time.Now())
+}
+
+func newTestEntityAt(t *testing.T, name string, created time.Time) *openpgp.Entity {
+	t.Helper()
+
+	config := &packet.Config{RSABits: 1024, Time: func() time.Time { return created }}
+
+	e, err := openpgp.NewEntity(name, "", name+"@example.com", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return e
+}
+
+// serializeEntity returns the public certificate of the entity, followed by
+// the extra packets, which follow the last subkey.
+func serializeEntity(t *testing.T, e *openpgp.Entity, extra ...interface{ Serialize(io.Writer) error }) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := e.Serialize(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range extra {
+		if err := p.Serialize(&buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return buf.Bytes()
+}
+
+// readTestCertificate reads a single certificate and checks the number of
+// keys that were accepted.
+func readTestCertificate(t *testing.T, data []byte, keys int) []*PublicKey {
+	t.Helper()
+
+	certs, err := readCertificates(data)
+	if err != nil {
+		t.Fatalf("readCertificates() error = %v", err)
+	}
+
+	if len(certs) != 1 || len(certs[0]) != keys {
+		t.Fatalf("readCertificates() returned %d certificates, want 1 with %d keys", len(certs), keys)
+	}
+
+	return certs[0]
+}
+
+func newTestSignature(sigType packet.SignatureType, signer *openpgp.Entity) *packet.Signature {
+	return &packet.Signature{
+		SigType:      sigType,
+		PubKeyAlgo:   signer.PrimaryKey.PubKeyAlgo,
+		Hash:         crypto.SHA256,
+		CreationTime: time.Now(),
+		IssuerKeyId:  &signer.PrimaryKey.KeyId,
+	}
+}
+
+func TestReadCertificatesSelfSignatures(t *testing.T) {
+	e := newTestEntity(t, "alice")
+	keys := readTestCertificate(t, serializeEntity(t, e), 2)
+
+	if !keys[0].hasFlags || keys[0].Flags != keyFlagSign|keyFlagCertify {
+		t.Errorf("primary key flags = %v, %#x", keys[0].hasFlags, keys[0].Flags)
+	}
+
+	if !keys[1].hasFlags || keys[1].Flags != keyFlagEncryptComms|keyFlagEncryptStorage {
+		t.Errorf("subkey flags = %v, %#x", keys[1].hasFlags, keys[1].Flags)
+	}
+
+	if keys[0].revoked || keys[1].revoked {
+		t.Error("keys are revoked")
+	}
+}
+
+func TestReadCertificatesThirdPartySignatures(t *testing.T) {
+	e := newTestEntity(t, "alice")
+	mallory := newTestEntity(t, "mallory")
+
+	// a certification of the user ID by another key that allows encryption
+	// with the primary key
+	cert := newTestSignature(packet.SigTypePositiveCert, mallory)
+	cert.FlagsValid = true
+	cert.FlagEncryptStorage = true
+
+	for id := range e.Identities {
+		if err := cert.SignUserId(id, e.PrimaryKey, mallory.PrivateKey, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		e.Identities[id].Signatures = append(e.Identities[id].Signatures, cert)
+	}
+
+	// a revocation of the subkey by another key
+	revocation := newTestSignature(packet.SigTypeSubkeyRevocation, mallory)
+	if err := revocation.SignKey(e.Subkeys[0].PublicKey, mallory.PrivateKey, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	keys := readTestCertificate(t, serializeEntity(t, e, revocation), 2)
+
+	if keys[0].CanEncrypt() {
+		t.Error("third-party certification allowed encryption with the primary key")
+	}
+
+	if keys[1].revoked {
+		t.Error("third-party revocation revoked the subkey")
+	}
+}
+
+func TestReadCertificatesSelfRevocation(t *testing.T) {
+	e := newTestEntity(t, "alice")
+
+	revocation := newTestSignature(packet.SigTypeSubkeyRevocation, e)
+	if err := revocation.SignKey(e.Subkeys[0].PublicKey, e.PrivateKey, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	keys := readTestCertificate(t, serializeEntity(t, e, revocation), 2)
+
+	if !keys[1].revoked {
+		t.Error("subkey revocation was not applied")
+	}
+
+	if _, err := ParsePublicKeys(serializeEntity(t, e, revocation)); err == nil {
+		t.Error("ParsePublicKeys() returned a revoked subkey")
+	}
+}
+
+func TestReadCertificatesModifiedSignature(t *testing.T) {
+	e := newTestEntity(t, "alice")
+	data := serializeEntity(t, e)
+
+	// the subkey binding signature is the last packet, flip a bit in its
+	// signature value
+	data[len(data)-1] ^= 0x01
+
+	keys := readTestCertificate(t, data, 1)
+	if keys[0].KeyID != e.PrimaryKey.KeyId {
+		t.Errorf("readCertificates() returned key %X", keys[0].KeyID)
+	}
+
+	// the primary key is not usable for encryption
+	if pks, err := ParsePublicKeys(data); err == nil {
+		t.Errorf("ParsePublicKeys() chose key %X of a modified subkey binding", pks[0].KeyID)
+	}
+}
+
+func TestReadCertificatesUnboundSubkey(t *testing.T) {
+	e := newTestEntity(t, "alice")
+	mallory := newTestEntityAt(t, "mallory", time.Now().Add(time.Hour))
+
+	// a newer subkey without a binding signature
+	data := serializeEntity(t, e, mallory.Subkeys[0].PublicKey)
+
+	readTestCertificate(t, data, 2)
+
+	pks, err := ParsePublicKeys(data)
+	if err != nil {
+		t.Fatalf("ParsePublicKeys() error = %v", err)
+	}
+
+	if pks[0].Fingerprint != e.Subkeys[0].PublicKey.Fingerprint {
+		t.Errorf("ParsePublicKeys() chose key %X, want the bound subkey %X", pks[0].KeyID, e.Subkeys[0].PublicKey.KeyId)
+	}
+}
+
+func TestReadCertificatesUnsigned(t *testing.T) {
+	e := newTestEntity(t, "alice")
+
+	var buf bytes.Buffer
+	if err := e.PrimaryKey.Serialize(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := readCertificates(buf.Bytes()); err == nil {
+		t.Error("readCertificates() accepted a primary key without self-signature")
+	}
+}
+
+// TestReadCertificatesGnuPG reads certificates exported by GnuPG with a
+// certification-only primary key and an encryption subkey.
+func TestReadCertificatesGnuPG(t *testing.T) {
+	for _, file := range []string{"testdata/ed25519.asc", "testdata/nistp384.asc"} {
+		t.Run(file, func(t *testing.T) {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			data, err = decodeArmoredBlocks(data, armorPublicKeyType)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			keys := readTestCertificate(t, data, 2)
+
+			if !keys[0].hasFlags || keys[0].Flags != keyFlagCertify {
+				t.Errorf("primary key flags = %v, %#x", keys[0].hasFlags, keys[0].Flags)
+			}
+
+			if !keys[1].hasFlags || keys[1].Flags != keyFlagEncryptComms|keyFlagEncryptStorage {
+				t.Errorf("subkey flags = %v, %#x", keys[1].hasFlags, keys[1].Flags)
+			}
+		})
+	}
+}
@@ -0,0 +1,399 @@
+package yubikeypgp
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"vervet/yubikeyscard"
+
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+const (
+	armorPrivateKeyType = "PGP PRIVATE KEY BLOCK"
+
+	s2kUsageNone     uint8 = 0
+	s2kUsageAEAD     uint8 = 253
+	s2kUsageSHA1     uint8 = 254
+	s2kUsageChecksum uint8 = 255
+
+	s2kSimple         uint8 = 0
+	s2kSalted         uint8 = 1
+	s2kIteratedSalted uint8 = 3
+	s2kGNU            uint8 = 101
+
+	s2kSaltLength = 8
+)
+
+// s2kHashes maps the OpenPGP hash algorithm IDs supported for string-to-key
+// specifiers to hash functions.
+var s2kHashes = map[uint8]crypto.Hash{
+	2:              crypto.SHA1,
+	hashAlgoSHA256: crypto.SHA256,
+	hashAlgoSHA384: crypto.SHA384,
+	hashAlgoSHA512: crypto.SHA512,
+	11:             crypto.SHA224,
+}
+
+// SecretKey is an OpenPGP version 4 secret key, as described in RFC 4880
+// section 5.5.3. The secret key material of passphrase protected keys is
+// available once the key is decrypted.
+type SecretKey struct {
+	*PublicKey
+	Encrypted bool
+
+	usage    uint8
+	cipher   uint8
+	s2k      []byte // string-to-key specifier
+	iv       []byte
+	data     []byte // encrypted or plain algorithm specific secret fields
+	material []byte // decrypted algorithm specific secret fields
+}
+
+// ReadSecretKey returns the key from the secret key certificate in data that
+// can be used in the key slot, which is the newest key whose algorithm and key
+// flags suit the slot. The certificate may be ASCII armored or binary.
+func ReadSecretKey(data []byte, slot yubikeyscard.KeySlot) (*SecretKey, error) {
+	if bytes.Contains(data, []byte(armorBegin)) {
+		var err error
+
+		data, err = decodeArmoredBlocks(data, armorPrivateKeyType)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	certs, err := readCertificates(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(certs) != 1 || certs[0][0].secret == nil {
+		return nil, errors.New("expected a single PGP secret key")
+	}
+
+	pk, err := chooseKey(certs[0], slot.String(), func(pk *PublicKey) bool {
+		return pk.secret != nil && pk.usableIn(slot)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return parseSecretKey(pk)
+}
+
+// usableIn reports whether the algorithm and key flags of the key suit the key
+// slot.
+func (pk *PublicKey) usableIn(slot yubikeyscard.KeySlot) bool {
+	switch slot {
+	case yubikeyscard.KeySlotEnc:
+		return pk.CanEncrypt()
+	case yubikeyscard.KeySlotSign, yubikeyscard.KeySlotAuth:
+		if pk.Algo != packet.PubKeyAlgoRSA && pk.Algo != packet.PubKeyAlgoECDSA && pk.Algo != pubKeyAlgoEdDSA {
+			return false
+		}
+
+		flag := keyFlagSign
+		if slot == yubikeyscard.KeySlotAuth {
+			flag = keyFlagAuthenticate
+		}
+
+		return !pk.hasFlags || pk.Flags&flag != 0
+	}
+
+	return false
+}
+
+// parseSecretKey parses the secret portion of a secret key packet, as
+// described in RFC 4880 section 5.5.3.
+func parseSecretKey(pk *PublicKey) (*SecretKey, error) {
+	sk := &SecretKey{PublicKey: pk}
+
+	b := pk.secret
+	if len(b) == 0 {
+		return nil, errors.New("invalid PGP secret key packet, body too short")
+	}
+
+	sk.usage, b = b[0], b[1:]
+
+	switch sk.usage {
+	case s2kUsageNone:
+		if len(b) < 2 {
+			return nil, errors.New("invalid PGP secret key packet, body too short")
+		}
+
+		sk.material = b[:len(b)-2]
+		if binary.BigEndian.Uint16(b[len(b)-2:]) != sessionKeyChecksum(sk.material) {
+			return nil, errors.New("PGP secret key checksum does not match")
+		}
+
+		return sk, nil
+	case s2kUsageSHA1, s2kUsageChecksum:
+	case s2kUsageAEAD:
+		return nil, errors.New("AEAD protected PGP secret keys are not supported")
+	default:
+		return nil, errors.New("PGP secret keys protected with legacy encryption are not supported")
+	}
+
+	if len(b) < 2 {
+		return nil, errors.New("invalid PGP secret key packet, body too short")
+	}
+
+	sk.cipher = b[0]
+	sk.Encrypted = true
+
+	// the string-to-key specifier, followed by the IV of the cipher
+	n := 2
+	switch b[1] {
+	case s2kSimple:
+	case s2kSalted:
+		n += s2kSaltLength
+	case s2kIteratedSalted:
+		n += s2kSaltLength + 1
+	case s2kGNU:
+		return nil, errors.New("PGP secret key is not present, it may already be stored on a smart card")
+	default:
+		return nil, fmt.Errorf("unsupported string-to-key specifier %d", b[1])
+	}
+
+	c, err := cipherByID(sk.cipher)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := c.newCipher(make([]byte, c.keySize))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b) < 1+n+block.BlockSize() {
+		return nil, errors.New("invalid PGP secret key packet, body too short")
+	}
+
+	sk.s2k = b[1 : 1+n]
+	sk.iv = b[1+n : 1+n+block.BlockSize()]
+	sk.data = b[1+n+block.BlockSize():]
+
+	return sk, nil
+}
+
+// Decrypt decrypts the secret key material with the passphrase.
+func (sk *SecretKey) Decrypt(passphrase []byte) error {
+	if !sk.Encrypted {
+		return nil
+	}
+
+	c, err := cipherByID(sk.cipher)
+	if err != nil {
+		return err
+	}
+
+	key, err := s2kDeriveKey(sk.s2k, passphrase, c.keySize)
+	if err != nil {
+		return err
+	}
+
+	block, err := c.newCipher(key)
+	if err != nil {
+		return err
+	}
+
+	plaintext := make([]byte, len(sk.data))
+	cfbDecrypt(block, sk.iv, plaintext, sk.data)
+
+	var material []byte
+
+	switch sk.usage {
+	case s2kUsageSHA1:
+		if len(plaintext) < sha1.Size {
+			return errors.New("invalid PGP secret key packet, encrypted data too short")
+		}
+
+		material = plaintext[:len(plaintext)-sha1.Size]
+		h := sha1.Sum(material)
+
+		if subtle.ConstantTimeCompare(h[:], plaintext[len(material):]) != 1 {
+			return errors.New("incorrect passphrase for PGP secret key")
+		}
+	default:
+		if len(plaintext) < 2 {
+			return errors.New("invalid PGP secret key packet, encrypted data too short")
+		}
+
+		material = plaintext[:len(plaintext)-2]
+		if binary.BigEndian.Uint16(plaintext[len(material):]) != sessionKeyChecksum(material) {
+			return errors.New("incorrect passphrase for PGP secret key")
+		}
+	}
+
+	sk.material = material
+	sk.Encrypted = false
+
+	return nil
+}
+
+// ImportKey imports the decrypted secret key into the key slot of the YubiKey
+// and writes the fingerprint and generation time of the key to the card. The
+// admin PIN must be verified.
+func ImportKey(yk *yubikeyscard.YubiKey, slot yubikeyscard.KeySlot, sk *SecretKey) error {
+	if sk.Encrypted {
+		return errors.New("PGP secret key must be decrypted before it is imported")
+	}
+
+	attr, key, err := sk.cardPrivateKey(slot)
+	if err != nil {
+		return err
+	}
+
+	if err := yk.BeginTransaction(); err != nil {
+		return err
+	}
+
+	defer yk.EndTransaction()
+
+	if err := yk.ImportKey(slot, attr, key); err != nil {
+		return err
+	}
+
+	return yk.SetKeyInfo(slot, sk.Fingerprint, sk.Created)
+}
+
+// AlgoAttr returns the algorithm attributes of the secret key in the key
+// slot, which are derived from the public key, so the key need not be
+// decrypted.
+func (sk *SecretKey) AlgoAttr(slot yubikeyscard.KeySlot) (yubikeyscard.AlgoAttr, error) {
+	var attr yubikeyscard.AlgoAttr
+	var err error
+
+	switch sk.Algo {
+	case packet.PubKeyAlgoRSA:
+		attr, err = yubikeyscard.AlgoAttrByName(fmt.Sprintf("rsa%d", new(big.Int).SetBytes(sk.n).BitLen()), slot)
+	default:
+		curve := yubikeyscard.CurveByOID(sk.oid)
+		if curve == nil {
+			return attr, fmt.Errorf("unsupported curve %x", sk.oid)
+		}
+
+		attr, err = yubikeyscard.AlgoAttrByName(curve.Name, slot)
+	}
+	if err != nil {
+		return attr, err
+	}
+
+	if (attr.ID == yubikeyscard.AlgoIdRSA) != (sk.Algo == packet.PubKeyAlgoRSA) {
+		return attr, fmt.Errorf("%s key can not be used in %s key slot", attr.Name(), slot)
+	}
+
+	return attr, nil
+}
+
+// cardPrivateKey returns the algorithm attributes and key material of the
+// secret key in the encoding expected by the card.
+func (sk *SecretKey) cardPrivateKey(slot yubikeyscard.KeySlot) (yubikeyscard.AlgoAttr, *yubikeyscard.PrivateKey, error) {
+	attr, err := sk.AlgoAttr(slot)
+	if err != nil {
+		return attr, nil, err
+	}
+
+	key := new(yubikeyscard.PrivateKey)
+
+	switch sk.Algo {
+	case packet.PubKeyAlgoRSA:
+		// d, p, q and u, only the primes are needed by the card
+		var fields []byte
+		if _, _, fields, err = readMPI(sk.material); err != nil {
+			return attr, nil, err
+		}
+		if key.P, _, fields, err = readMPI(fields); err != nil {
+			return attr, nil, err
+		}
+		if key.Q, _, _, err = readMPI(fields); err != nil {
+			return attr, nil, err
+		}
+
+		key.Exponent = sk.e
+		key.Modulus = sk.n
+	default:
+		curve := yubikeyscard.CurveByOID(sk.oid)
+
+		if key.Scalar, _, _, err = readMPI(sk.material); err != nil {
+			return attr, nil, err
+		}
+
+		key.Point = sk.point
+
+		if curve.Bits == 255 {
+			// native Curve25519 and Ed25519 public keys are not prefixed
+			if len(key.Point) == 33 && key.Point[0] == 0x40 {
+				key.Point = key.Point[1:]
+			}
+
+			key.Scalar = leftPad(key.Scalar, 32)
+
+			// Curve25519 secret keys are stored big endian in OpenPGP, the
+			// native encoding is little endian
+			if sk.Algo == packet.PubKeyAlgoECDH {
+				key.Scalar = reverse(key.Scalar)
+			}
+		}
+	}
+
+	return attr, key, nil
+}
+
+// s2kDeriveKey derives a key of the provided length from the passphrase with
+// the string-to-key specifier, as described in RFC 4880 section 3.7.
+func s2kDeriveKey(spec []byte, passphrase []byte, keySize int) ([]byte, error) {
+	h, ok := s2kHashes[spec[1]]
+	if !ok || !h.Available() {
+		return nil, fmt.Errorf("unsupported string-to-key hash algorithm %d", spec[1])
+	}
+
+	var salt []byte
+	count := 0
+
+	switch spec[0] {
+	case s2kSalted:
+		salt = spec[2 : 2+s2kSaltLength]
+	case s2kIteratedSalted:
+		salt = spec[2 : 2+s2kSaltLength]
+		c := int(spec[2+s2kSaltLength])
+		count = (16 + (c & 15)) << ((c >> 4) + 6)
+	}
+
+	input := append(append([]byte{}, salt...), passphrase...)
+	if count < len(input) {
+		count = len(input)
+	}
+
+	var key []byte
+
+	// each further hash context is preloaded with one more zero octet
+	for i := 0; len(key) < keySize; i++ {
+		d := h.New()
+		d.Write(make([]byte, i))
+
+		for n := count; n > 0; n -= len(input) {
+			d.Write(input[:min(n, len(input))])
+		}
+
+		key = d.Sum(key)
+	}
+
+	return key[:keySize], nil
+}
+
+// reverse returns a copy of b in reverse order.
+func reverse(b []byte) []byte {
+	r := make([]byte, len(b))
+	for i := range b {
+		r[len(b)-1-i] = b[i]
+	}
+
+	return r
+}
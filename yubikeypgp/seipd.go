@@ -0,0 +1,255 @@
+package yubikeypgp
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	seipdVersion1 uint8 = 1
+	seipdVersion2 uint8 = 2
+
+	aeadOCB uint8 = 2
+	aeadGCM uint8 = 3
+
+	mdcPacketHeaderLength = 2
+	mdcHashLength         = sha1.Size
+	seipdSaltLength       = 32
+	seipdMaxChunkSize     = 16
+	aeadTagLength         = 16
+)
+
+// ErrIntegrityCheck is returned when the modification detection code or the
+// authentication tag of an encrypted message does not match.
+var ErrIntegrityCheck = errors.New("PGP message failed integrity check, message has been modified or session key is incorrect")
+
+// mdcPacketHeader is the new format header of the modification detection code
+// packet, tag 19 with a length of 20 octets.
+var mdcPacketHeader = []byte{0xd3, 0x14}
+
+// aeadMode describes an AEAD algorithm from RFC 9580 section 9.6.
+type aeadMode struct {
+	nonceSize int
+	newAEAD   func(block cipher.Block) (cipher.AEAD, error)
+}
+
+var aeadModes = map[uint8]aeadMode{
+	aeadOCB: {ocbNonceSize, newOCB},
+	aeadGCM: {12, cipher.NewGCM},
+}
+
+// decryptDataPacket decrypts the symmetrically encrypted portion of the
+// message with the provided session key. Only integrity protected data packets
+// are accepted, legacy symmetrically encrypted data packets without a
+// modification detection code are rejected.
+func decryptDataPacket(p rawPacket, sk sessionKey) ([]byte, error) {
+	var err error
+
+	switch p.tag {
+	case packetTagSymEncMDC:
+	case packetTagSymEnc:
+		return nil, errors.New("PGP message is not integrity protected, symmetrically encrypted data packets without MDC are not supported")
+	default:
+		return nil, errors.New("unexpected PGP packet type encountered")
+	}
+
+	if len(p.body) == 0 {
+		return nil, errors.New("invalid PGP packet, empty symmetrically encrypted data packet")
+	}
+
+	var plaintext []byte
+
+	switch p.body[0] {
+	case seipdVersion1:
+		plaintext, err = decryptSEIPDv1(p.body[1:], sk)
+	case seipdVersion2:
+		plaintext, err = decryptSEIPDv2(p.body, sk)
+	default:
+		err = fmt.Errorf("unsupported symmetrically encrypted data packet version %d", p.body[0])
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return readLiteralData(bytes.NewReader(plaintext), 0)
+}
+
+// decryptSEIPDv1 decrypts a version 1 symmetrically encrypted integrity
+// protected data packet, as described in RFC 4880 section 5.13, and verifies
+// the modification detection code.
+func decryptSEIPDv1(data []byte, sk sessionKey) ([]byte, error) {
+	if sk.cipher == 0 {
+		return nil, errors.New("invalid PGP message, version 1 encrypted data requires a version 3 encrypted key packet")
+	}
+
+	c, err := cipherByID(sk.cipher)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := c.newCipher(sk.key)
+	if err != nil {
+		return nil, err
+	}
+
+	// the plaintext starts with a block of random data and a repeat of its last
+	// two octets, and ends with the modification detection code packet
+	prefixLength := block.BlockSize() + 2
+	if len(data) < prefixLength+mdcPacketHeaderLength+mdcHashLength {
+		return nil, errors.New("invalid PGP packet, symmetrically encrypted data too short")
+	}
+
+	plaintext := make([]byte, len(data))
+	cfbDecrypt(block, nil, plaintext, data)
+
+	mdcStart := len(plaintext) - mdcHashLength
+	h := sha1.New()
+	h.Write(plaintext[:mdcStart])
+
+	// the quick check of the prefix is not used, so that a tampered message
+	// can only be reported as such after the full plaintext is hashed
+	if !bytes.Equal(plaintext[mdcStart-mdcPacketHeaderLength:mdcStart], mdcPacketHeader) ||
+		subtle.ConstantTimeCompare(h.Sum(nil), plaintext[mdcStart:]) != 1 {
+		return nil, ErrIntegrityCheck
+	}
+
+	return plaintext[prefixLength : mdcStart-mdcPacketHeaderLength], nil
+}
+
+// decryptSEIPDv2 decrypts a version 2 symmetrically encrypted integrity
+// protected data packet, as described in RFC 9580 section 5.13.2. The body
+// includes the version octet, which is part of the associated data.
+func decryptSEIPDv2(body []byte, sk sessionKey) ([]byte, error) {
+	if sk.cipher != 0 {
+		return nil, errors.New("invalid PGP message, version 2 encrypted data requires a version 6 encrypted key packet")
+	}
+
+	if len(body) < 4+seipdSaltLength+aeadTagLength {
+		return nil, errors.New("invalid PGP packet, symmetrically encrypted data too short")
+	}
+
+	c, err := cipherByID(body[1])
+	if err != nil {
+		return nil, err
+	}
+
+	mode, ok := aeadModes[body[2]]
+	if !ok {
+		return nil, fmt.Errorf("unsupported AEAD algorithm %d", body[2])
+	}
+
+	if body[3] > seipdMaxChunkSize {
+		return nil, fmt.Errorf("invalid PGP packet, chunk size octet %d too large", body[3])
+	}
+
+	if len(sk.key) != c.keySize {
+		return nil, fmt.Errorf("unable to decipher PGP session key, invalid length for %s", c.name)
+	}
+
+	chunkSize := 1 << (body[3] + 6)
+	salt := body[4 : 4+seipdSaltLength]
+	data := body[4+seipdSaltLength:]
+
+	// the associated data is the packet header, version, algorithms and chunk
+	// size octet
+	adata := append([]byte{0xc0 | packetTagSymEncMDC}, body[:4]...)
+
+	// derive the message key and the leading nonce octets from the session key
+	keyMaterial, err := hkdf.Key(sha256.New, sk.key, salt, string(adata), c.keySize+mode.nonceSize-8)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := c.newCipher(keyMaterial[:c.keySize])
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := mode.newAEAD(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, mode.nonceSize)
+	copy(nonce, keyMaterial[c.keySize:])
+
+	// the final authentication tag follows the last chunk
+	finalTag := data[len(data)-aeadTagLength:]
+	data = data[:len(data)-aeadTagLength]
+
+	var plaintext []byte
+	var index uint64
+
+	for ; len(data) > 0; index++ {
+		n := min(len(data), chunkSize+aeadTagLength)
+
+		binary.BigEndian.PutUint64(nonce[len(nonce)-8:], index)
+
+		plaintext, err = aead.Open(plaintext, nonce, data[:n], adata)
+		if err != nil {
+			return nil, ErrIntegrityCheck
+		}
+
+		data = data[n:]
+	}
+
+	// the final tag authenticates the total plaintext length, over an empty
+	// chunk with the next chunk index
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], index)
+	adata = binary.BigEndian.AppendUint64(adata, uint64(len(plaintext)))
+
+	if _, err := aead.Open(nil, nonce, finalTag, adata); err != nil {
+		return nil, ErrIntegrityCheck
+	}
+
+	return plaintext, nil
+}
+
+// cfbDecrypt decrypts src into dst using CFB mode. Encrypted data packets use
+// the OpenPGP CFB mode without resynchronization, which is standard CFB mode
+// with an all zero IV, requested by passing a nil IV.
+func cfbDecrypt(block cipher.Block, iv, dst, src []byte) {
+	bs := block.BlockSize()
+	ks := make([]byte, bs)
+
+	if iv == nil {
+		iv = make([]byte, bs)
+	} else {
+		iv = append([]byte{}, iv...)
+	}
+
+	for len(src) > 0 {
+		block.Encrypt(ks, iv)
+
+		n := min(len(src), bs)
+		copy(iv, src[:n])
+		subtle.XORBytes(dst[:n], src[:n], ks[:n])
+
+		src, dst = src[n:], dst[n:]
+	}
+}
+
+// cfbEncrypt encrypts src into dst using the OpenPGP CFB mode without
+// resynchronization.
+func cfbEncrypt(block cipher.Block, dst, src []byte) {
+	bs := block.BlockSize()
+	iv := make([]byte, bs)
+	ks := make([]byte, bs)
+
+	for len(src) > 0 {
+		block.Encrypt(ks, iv)
+
+		n := min(len(src), bs)
+		subtle.XORBytes(dst[:n], src[:n], ks[:n])
+		copy(iv, dst[:n])
+
+		src, dst = src[n:], dst[n:]
+	}
+}
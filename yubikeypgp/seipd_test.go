@@ -0,0 +1,136 @@
+package yubikeypgp
+
+import (
+	"bytes"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// sealSEIPDv2 encrypts the plaintext into the body of a version 2 symmetrically
+// encrypted integrity protected data packet, as described in RFC 9580 section
+// 5.13.2.
+func sealSEIPDv2(t *testing.T, plaintext []byte, sk sessionKey, cipherID, aeadID, chunkOctet uint8) []byte {
+	t.Helper()
+
+	c, err := cipherByID(cipherID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mode := aeadModes[aeadID]
+
+	body := []byte{seipdVersion2, cipherID, aeadID, chunkOctet}
+	salt := make([]byte, seipdSaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		t.Fatal(err)
+	}
+
+	body = append(body, salt...)
+	adata := append([]byte{0xc0 | packetTagSymEncMDC}, body[:4]...)
+
+	keyMaterial, err := hkdf.Key(sha256.New, sk.key, salt, string(adata), c.keySize+mode.nonceSize-8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block, err := c.newCipher(keyMaterial[:c.keySize])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aead, err := mode.newAEAD(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nonce := make([]byte, mode.nonceSize)
+	copy(nonce, keyMaterial[c.keySize:])
+
+	chunkSize := 1 << (chunkOctet + 6)
+	data := plaintext
+
+	var index uint64
+	for ; len(data) > 0; index++ {
+		n := min(len(data), chunkSize)
+		binary.BigEndian.PutUint64(nonce[len(nonce)-8:], index)
+		body = aead.Seal(body, nonce, data[:n], adata)
+		data = data[n:]
+	}
+
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], index)
+	adata = binary.BigEndian.AppendUint64(adata, uint64(len(plaintext)))
+
+	return aead.Seal(body, nonce, nil, adata)
+}
+
+func TestSEIPDv2RoundTrip(t *testing.T) {
+	tests := []struct {
+		name       string
+		cipher     uint8
+		aead       uint8
+		chunkOctet uint8
+		length     int
+	}{
+		{"OCB AES-128 empty", cipherAES128, aeadOCB, 0, 0},
+		{"OCB AES-128 one chunk", cipherAES128, aeadOCB, 0, 50},
+		{"OCB AES-256 several chunks", cipherAES256, aeadOCB, 0, 200},
+		{"OCB AES-256 chunk boundary", cipherAES256, aeadOCB, 0, 128},
+		{"GCM AES-128 several chunks", cipherAES128, aeadGCM, 0, 200},
+		{"GCM AES-256 large chunks", cipherAES256, aeadGCM, 10, 100000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := cipherByID(tt.cipher)
+			sk := sessionKey{key: make([]byte, c.keySize)}
+			rand.Read(sk.key)
+
+			plaintext := make([]byte, tt.length)
+			rand.Read(plaintext)
+
+			body := sealSEIPDv2(t, plaintext, sk, tt.cipher, tt.aead, tt.chunkOctet)
+
+			got, err := decryptSEIPDv2(body, sk)
+			if err != nil {
+				t.Fatalf("decryptSEIPDv2() error = %v", err)
+			}
+
+			if !bytes.Equal(got, plaintext) {
+				t.Error("decryptSEIPDv2() returned a different plaintext")
+			}
+
+			// modified data, a modified header and a truncated final chunk
+			// must all fail authentication
+			modified := append([]byte{}, body...)
+			modified[len(modified)-aeadTagLength-1] ^= 0x01
+			if _, err := decryptSEIPDv2(modified, sk); !errors.Is(err, ErrIntegrityCheck) {
+				t.Errorf("decryptSEIPDv2() of modified data error = %v", err)
+			}
+
+			modified = append([]byte{}, body...)
+			modified[3] ^= 0x01
+			if _, err := decryptSEIPDv2(modified, sk); !errors.Is(err, ErrIntegrityCheck) {
+				t.Errorf("decryptSEIPDv2() of modified header error = %v", err)
+			}
+
+			if tt.length > 0 {
+				chunkSize := 1 << (tt.chunkOctet + 6)
+				last := (tt.length-1)%chunkSize + 1 + aeadTagLength
+				truncated := append(append([]byte{}, body[:len(body)-aeadTagLength-last]...), body[len(body)-aeadTagLength:]...)
+				if _, err := decryptSEIPDv2(truncated, sk); !errors.Is(err, ErrIntegrityCheck) {
+					t.Errorf("decryptSEIPDv2() of truncated data error = %v", err)
+				}
+			}
+
+			wrong := sessionKey{key: append([]byte{}, sk.key...)}
+			wrong.key[0] ^= 0x01
+			if _, err := decryptSEIPDv2(body, wrong); !errors.Is(err, ErrIntegrityCheck) {
+				t.Errorf("decryptSEIPDv2() with wrong key error = %v", err)
+			}
+		})
+	}
+}
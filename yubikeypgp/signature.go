@@ -0,0 +1,230 @@
+package yubikeypgp
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"vervet/yubikeyscard"
+
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+const (
+	packetTagUserID        uint8 = 13
+	packetTagUserAttribute uint8 = 17
+
+	sigTypePositiveCert uint8 = 0x13
+	sigTypeDirectKey    uint8 = 0x1f
+
+	// prefixes of user IDs and user attributes in signature hashes
+	userIDHashPrefix        uint8 = 0xb4
+	userAttributeHashPrefix uint8 = 0xd1
+
+	sigSubpacketCreationTime      uint8 = 2
+	sigSubpacketPreferredCipher   uint8 = 11
+	sigSubpacketIssuer            uint8 = 16
+	sigSubpacketPreferredHash     uint8 = 21
+	sigSubpacketIssuerFingerprint uint8 = 33
+)
+
+// signatureHashes maps the OpenPGP hash algorithm IDs accepted in
+// self-signatures to hash functions.
+var signatureHashes = map[uint8]crypto.Hash{
+	2:  crypto.SHA1,
+	8:  crypto.SHA256,
+	9:  crypto.SHA384,
+	10: crypto.SHA512,
+	11: crypto.SHA224,
+}
+
+// signature is a parsed version 4 signature packet, as described in RFC 4880
+// section 5.2.3.
+type signature struct {
+	sigType    uint8
+	pubKeyAlgo packet.PublicKeyAlgorithm
+	hashAlgo   uint8
+	hashed     []byte // version through hashed subpackets, which the signature covers
+	subpackets []byte // hashed subpackets
+	left16     []byte
+	mpis       [][]byte
+}
+
+// parseSignature parses a version 4 signature packet body.
+func parseSignature(body []byte) (*signature, error) {
+	if len(body) < 6 || body[0] != 4 {
+		return nil, errors.New("unsupported PGP signature version")
+	}
+
+	n := int(binary.BigEndian.Uint16(body[4:6]))
+	if len(body) < 6+n+2 {
+		return nil, errors.New("invalid PGP signature, hashed subpackets truncated")
+	}
+
+	sig := &signature{
+		sigType:    body[1],
+		pubKeyAlgo: packet.PublicKeyAlgorithm(body[2]),
+		hashAlgo:   body[3],
+		hashed:     body[:6+n],
+		subpackets: body[6 : 6+n],
+	}
+
+	rest := body[6+n:]
+	u := int(binary.BigEndian.Uint16(rest[:2]))
+	if len(rest) < 2+u+2 {
+		return nil, errors.New("invalid PGP signature, unhashed subpackets truncated")
+	}
+
+	rest = rest[2+u:]
+	sig.left16, rest = rest[:2], rest[2:]
+
+	for len(rest) > 0 {
+		mpi, _, r, err := readMPI(rest)
+		if err != nil {
+			return nil, err
+		}
+
+		sig.mpis = append(sig.mpis, mpi)
+		rest = r
+	}
+
+	return sig, nil
+}
+
+// verify checks that the signature was made by the primary key over the
+// primary key, the subkey if not nil and the user ID if not nil. userIDTag is
+// the hash prefix of the user ID or user attribute packet.
+func (sig *signature) verify(primary *PublicKey, subkey *PublicKey, userIDTag uint8, userID []byte) error {
+	hash, ok := signatureHashes[sig.hashAlgo]
+	if !ok || !hash.Available() {
+		return fmt.Errorf("unsupported signature hash algorithm %d", sig.hashAlgo)
+	}
+
+	algo := sig.pubKeyAlgo
+	if algo == packet.PubKeyAlgoRSASignOnly {
+		algo = packet.PubKeyAlgoRSA
+	}
+
+	if algo != primary.Algo {
+		return errors.New("signature algorithm does not match primary key")
+	}
+
+	digest := signatureDigest(hash, primary, subkey, userIDTag, userID, sig.hashed)
+	if digest[0] != sig.left16[0] || digest[1] != sig.left16[1] {
+		return errors.New("signature hash mismatch")
+	}
+
+	if !verifyDigest(primary, hash, digest, sig.mpis) {
+		return errors.New("invalid signature")
+	}
+
+	return nil
+}
+
+// signatureDigest hashes the primary key, the subkey if not nil and the user ID
+// if not nil, followed by the hashed portion of a version 4 signature and its
+// trailer, as described in RFC 4880 section 5.2.4.
+func signatureDigest(hash crypto.Hash, primary, subkey *PublicKey, userIDTag uint8, userID, hashed []byte) []byte {
+	h := hash.New()
+	writeKeyHash(h.Write, primary)
+
+	if subkey != nil {
+		writeKeyHash(h.Write, subkey)
+	}
+
+	if userID != nil {
+		h.Write([]byte{userIDTag})
+		h.Write(binary.BigEndian.AppendUint32(nil, uint32(len(userID))))
+		h.Write(userID)
+	}
+
+	h.Write(hashed)
+	h.Write([]byte{4, 0xff})
+	h.Write(binary.BigEndian.AppendUint32(nil, uint32(len(hashed))))
+
+	return h.Sum(nil)
+}
+
+// writeKeyHash writes the key packet in the form signatures are computed over.
+func writeKeyHash(write func([]byte) (int, error), pk *PublicKey) {
+	write([]byte{0x99, uint8(len(pk.body) >> 8), uint8(len(pk.body))})
+	write(pk.body)
+}
+
+// verifyDigest verifies the signature values over the digest with the key.
+// RSA, ECDSA on the NIST curves and EdDSA with Ed25519 are supported.
+func verifyDigest(pk *PublicKey, hash crypto.Hash, digest []byte, mpis [][]byte) bool {
+	switch pk.Algo {
+	case packet.PubKeyAlgoRSA:
+		if len(mpis) != 1 || len(pk.e) > 4 {
+			return false
+		}
+
+		pub := &rsa.PublicKey{
+			N: new(big.Int).SetBytes(pk.n),
+			E: int(new(big.Int).SetBytes(pk.e).Int64()),
+		}
+
+		return rsa.VerifyPKCS1v15(pub, hash, digest, leftPad(mpis[0], pub.Size())) == nil
+	case packet.PubKeyAlgoECDSA:
+		if len(mpis) != 2 {
+			return false
+		}
+
+		c := yubikeyscard.CurveByOID(pk.oid)
+		if c == nil {
+			return false
+		}
+
+		var curve elliptic.Curve
+
+		switch c.Name {
+		case yubikeyscard.CurveP256.Name:
+			curve = elliptic.P256()
+		case yubikeyscard.CurveP384.Name:
+			curve = elliptic.P384()
+		case yubikeyscard.CurveP521.Name:
+			curve = elliptic.P521()
+		default:
+			return false
+		}
+
+		size := (curve.Params().BitSize + 7) / 8
+		if len(pk.point) != 1+2*size || pk.point[0] != 0x04 {
+			return false
+		}
+
+		pub := &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(pk.point[1 : 1+size]),
+			Y:     new(big.Int).SetBytes(pk.point[1+size:]),
+		}
+
+		return ecdsa.Verify(pub, digest, new(big.Int).SetBytes(mpis[0]), new(big.Int).SetBytes(mpis[1]))
+	case pubKeyAlgoEdDSA:
+		if len(mpis) != 2 || len(mpis[0]) > 32 || len(mpis[1]) > 32 {
+			return false
+		}
+
+		// Ed25519 points are prefixed with 0x40
+		c := yubikeyscard.CurveByOID(pk.oid)
+		if c == nil || c.Name != yubikeyscard.CurveEd25519.Name || len(pk.point) != 33 || pk.point[0] != 0x40 {
+			return false
+		}
+
+		sig := append(leftPad(mpis[0], 32), leftPad(mpis[1], 32)...)
+
+		return ed25519.Verify(ed25519.PublicKey(pk.point[1:]), digest, sig)
+	}
+
+	return false
+}
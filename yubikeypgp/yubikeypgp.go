@@ -6,217 +6,443 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"strings"
+	"time"
 	"vervet/yubikeyscard"
 
 	"golang.org/x/crypto/openpgp/packet"
 )
 
 const (
-	sessionKeyLength                = 16
-	encryptedKeyPacketHeaderLength  = 3
-	encryptedKeyPacketKeyInfoLength = 12
-	symmetricallyEncryptedVersion   = 1
+	encryptedKeyPacketVersion3      uint8 = 3
+	encryptedKeyPacketVersion6      uint8 = 6
+	encryptedKeyPacketKeyInfoLength       = 10
 )
 
 type PinPromptFunction func() ([]byte, error)
 
+// TouchPromptFunction is called before a YubiKey whose touch policy requires
+// confirmation decrypts a session key, with the time decryption waits for the
+// YubiKey to be touched.
+type TouchPromptFunction func(yk *yubikeyscard.YubiKey, timeout time.Duration)
+
+// touchTimeout is how long a YubiKey waits to be touched before it fails the
+// operation.
+const touchTimeout = 15 * time.Second
+
 // MessageDetails contains the result of parsing an OpenPGP encrypted and/or
 // signed message.
 type MessageDetails struct {
 	IsEncrypted   bool                  // true if the message was encrypted.
 	DecryptedWith uint64                // key ID of decryption key used to decrypt session key
-	YubiKey       *yubikeyscard.YubiKey // YubiKey containing private key used to decrypt session key
+	YubiKey       *yubikeyscard.YubiKey // YubiKey containing private key used to decrypt session key, or that failed to, as when its PIN was rejected
 	Body          []byte                // the contents of the message.
 }
 
 type encryptedKeyPacket struct {
-	tag            uint8
-	length         int
 	version        uint8
 	keyID          uint64
 	keyAlgo        uint8
 	keySize        uint16
 	encryptedBytes []byte
+	ephemeralPoint []byte // ECDH only
+	wrappedKey     []byte // ECDH only
 }
 
 // ReadMessage will decrypt a PGP-encrypted message by using a YubiKey to first
 // obtain the session key (DEK). Decrypt will then decrypt the symmetrically
 // encrypted portion of the message and return the resultant plain text.
+// Messages encrypted to several recipients are decrypted with the first
+// encrypted key packet whose key ID matches a connected YubiKey, packets with
+// a wildcard key ID are tried against each YubiKey in turn, skipping YubiKeys
+// whose key the packet was not encrypted to.
+// If the touch policy of the YubiKey requires confirmation, touch is called
+// before the session key is decrypted.
 // In the event of an incorrect PIN, Decrypt will return an empty byte array
-// and the number of remaining PIN retries.
-func ReadMessage(yks *yubikeyscard.YubiKeys, msg []byte, prompt PinPromptFunction) (md *MessageDetails, retries int, err error) {
+// and the number of remaining PIN retries, and md.YubiKey is the YubiKey that
+// rejected the PIN.
+func ReadMessage(yks *yubikeyscard.YubiKeys, msg []byte, prompt PinPromptFunction, touch TouchPromptFunction) (md *MessageDetails, retries int, err error) {
 	md = new(MessageDetails)
 	retries = -1
 
-	// read encrypted key packet fields and deserialize to struct
-	ek, err := readEncKeyPacket(bytes.NewReader(msg))
+	// read all encrypted key packets and the encrypted data packet
+	eks, data, err := readEncryptedMessage(bytes.NewReader(msg))
 	if err != nil {
 		return
 	}
 
 	md.IsEncrypted = true
 
-	// locate YubiKey with matching decryption key
-	yk := yks.FindByKeyID(ek.keyID)
-	if yk == nil {
-		err = fmt.Errorf("decryption key %X could not be found on any YubiKeys", ek.keyID)
-		return
-	}
+	// locate YubiKey with matching decryption key, packets addressed to a key
+	// ID take precedence over wildcard packets
+	for _, ek := range eks {
+		if ek.keyID == 0 {
+			continue
+		}
 
-	// check if PIN is cached, if not retrieve PIN input from user, then validate format
-	pin := yk.CachedPIN(2)
+		yk := yks.FindByKeyID(ek.keyID)
+		if yk == nil {
+			continue
+		}
 
-	if pin == nil {
-		pin, err = prompt()
+		md.YubiKey = yk
+		md.Body, retries, err = readWithYubiKey(yk, ek, data, prompt, touch)
 		if err != nil {
 			return
 		}
-	}
 
-	// verify the PIN (bank 2) with the OpenPGP smart card applet
-	retries, err = yubikeyscard.Verify(yk.Card, 2, pin)
-	if err != nil {
+		md.DecryptedWith = ek.keyID
+
 		return
-	} else {
-		// add verified PIN to the cache
-		yk.SetCachedPIN(2, pin)
 	}
 
-	// decipher the session key
-	sk, err := yubikeyscard.Decipher(yk.Card, ek.encryptedBytes)
-	if err != nil {
-		return
+	for _, ek := range eks {
+		if ek.keyID != 0 {
+			continue
+		}
+
+		for _, yk := range yks.YubiKeys {
+			if !encryptionKeyMatches(yk, ek) {
+				continue
+			}
+
+			// failure to decipher may mean the packet was addressed to a key
+			// on another YubiKey, other failures such as a missing touch are
+			// returned
+			md.Body, retries, err = readWithYubiKey(yk, ek, data, prompt, touch)
+			if wrongKey(err) {
+				err = nil
+				continue
+			}
+
+			md.YubiKey = yk
+			if err != nil {
+				return
+			}
+
+			fp := yk.AppRelatedData.Fingerprints.Enc
+			md.DecryptedWith = binary.BigEndian.Uint64(fp[12:20])
+
+			return
+		}
 	}
 
-	if len(sk) != (sessionKeyLength + 3) {
-		err = errors.New("unable to decipher PGP session key")
-		return
+	err = keysNotFoundError(eks)
+
+	return
+}
+
+// readWithYubiKey verifies the PIN of the YubiKey, deciphers the session key
+// of the encrypted key packet and decrypts the encrypted data packet with it.
+// The PIN is verified and used without other applications sharing the card in
+// between, the transaction ends when the attempt is finished.
+func readWithYubiKey(yk *yubikeyscard.YubiKey, ek encryptedKeyPacket, data rawPacket, prompt PinPromptFunction, touch TouchPromptFunction) (body []byte, retries int, err error) {
+	if err = yk.BeginTransaction(); err != nil {
+		return nil, -1, err
 	}
 
-	// get cipher function from first octect
-	c := packet.CipherFunction(sk[0])
-	if c != packet.CipherAES128 {
-		err = errors.New("unsupported cipher function, only AES-128-CFB supported")
+	defer yk.EndTransaction()
+
+	retries, err = verifyPIN(yk, prompt)
+	if err != nil {
 		return
 	}
 
-	// after cipher function, the next 16 bytes contain the session key
-	sessionKey := sk[1 : sessionKeyLength+1]
-
-	// read the message from the symmetrically encrypted packet using session key
-	md.Body, err = readSymEncPacket(bytes.NewReader(msg[ek.length:]), sessionKey, c)
+	sk, err := decryptSessionKeyTouch(yk, ek, touch)
 	if err != nil {
 		return
 	}
 
-	md.DecryptedWith = ek.keyID
-	md.YubiKey = yk
+	body, err = decryptDataPacket(data, sk)
 
 	return
 }
 
-func readHeader(r io.Reader) (tag uint8, length int, contents io.Reader, err error) {
-	var buf [3]byte
+// verifyPIN verifies the PIN for the decryption key of the YubiKey. The number
+// of remaining PIN retries is returned if the PIN is incorrect, otherwise -1,
+// so that later failures are not mistaken for PIN failures.
+func verifyPIN(yk *yubikeyscard.YubiKey, prompt PinPromptFunction) (retries int, err error) {
+	retries = -1
 
-	_, err = io.ReadFull(r, buf[:])
+	// check if PIN is cached, if not retrieve PIN input from user, then validate format
+	pin := yk.CachedPIN(2)
+
+	if pin == nil {
+		pin, err = prompt()
+		if err != nil {
+			return
+		}
+	}
+
+	// verify the PIN (bank 2) with the OpenPGP smart card applet
+	retries, err = yk.VerifyPIN(2, pin)
 	if err != nil {
 		return
 	}
 
-	if buf[0]&0xc0 != 0xc0 {
-		err = errors.New("invalid PGP packet header, only new format supported")
+	// add verified PIN to the cache
+	yk.SetCachedPIN(2, pin)
+
+	return -1, nil
+}
+
+// decryptSessionKey deciphers the session key from an encrypted key packet
+// addressed to the encryption key of the YubiKey. The PIN must be verified.
+func decryptSessionKey(yk *yubikeyscard.YubiKey, ek encryptedKeyPacket) (sk sessionKey, err error) {
+	var b []byte
+	switch packet.PublicKeyAlgorithm(ek.keyAlgo) {
+	case packet.PubKeyAlgoRSA:
+		// restore leading zeros stripped from the MPI, the card expects the
+		// ciphertext to be as long as the modulus
+		modLen := int(binary.BigEndian.Uint16(yk.AppRelatedData.AlgoAttrEnc.RSAModLen[:])+7) / 8
+		b, err = yubikeyscard.Decipher(yk.Card, leftPad(ek.encryptedBytes, modLen))
+	case packet.PubKeyAlgoECDH:
+		b, err = decryptECDH(yk, ek)
+	}
+	if err != nil {
 		return
 	}
 
-	if buf[1] < 192 && buf[1] > 223 {
-		err = errors.New("invalid PGP packet length, expected two-octect length format")
-		return
+	// version 3 packets name the cipher in the first octet, which determines
+	// the key length
+	sk, err = decodeSessionKey(ek.version, b)
+	if err != nil {
+		err = &sessionKeyError{err}
 	}
 
-	tag = buf[0] & 0x1f
-	length = int(binary.BigEndian.Uint16([]byte{buf[1] - 192, buf[2]})+192) + 3
-	contents = r
-	return tag, length, contents, nil
+	return
 }
 
-func readEncKeyPacket(r io.Reader) (ek encryptedKeyPacket, err error) {
-	var buf [encryptedKeyPacketKeyInfoLength]byte
+// sessionKeyError is returned when the deciphered session key is invalid, as
+// when the encrypted key packet was addressed to another key.
+type sessionKeyError struct {
+	err error
+}
 
-	tag, length, contents, err := readHeader(r)
-	if err != nil {
-		return
+func (e *sessionKeyError) Error() string {
+	return e.err.Error()
+}
+
+func (e *sessionKeyError) Unwrap() error {
+	return e.err
+}
+
+// wrongKey reports whether the failure to decrypt a session key means that the
+// encrypted key packet was addressed to another key: the card rejected the
+// ciphertext as incorrect data, or the deciphered session key was invalid.
+func wrongKey(err error) bool {
+	var se *yubikeyscard.StatusError
+	if errors.As(err, &se) {
+		return se.SW == 0x6a80
 	}
 
-	if tag != 1 {
-		err = errors.New("invalid PGP packet type, only encrypted key and symmetrically encrypted packets supported")
-		return
+	var ske *sessionKeyError
+
+	return errors.As(err, &ske)
+}
+
+// decryptSessionKeyTouch decrypts the session key like decryptSessionKey, but
+// prompts for the YubiKey to be touched if its touch policy requires it. The
+// YubiKey fails the decipher operation if it is not touched in time.
+func decryptSessionKeyTouch(yk *yubikeyscard.YubiKey, ek encryptedKeyPacket, touch TouchPromptFunction) (sessionKey, error) {
+	if !yk.AppRelatedData.UIF.Enc.Policy.Required() {
+		return decryptSessionKey(yk, ek)
 	}
 
-	n, err := io.ReadFull(contents, buf[:])
-	if err != nil {
-		return
+	if touch != nil {
+		touch(yk, touchTimeout)
 	}
 
-	if n != encryptedKeyPacketKeyInfoLength {
-		err = errors.New("invalid PGP packet, body too short")
-		return
+	sk, err := decryptSessionKey(yk, ek)
+
+	// security status not satisfied or conditions of use not satisfied
+	var se *yubikeyscard.StatusError
+	if errors.As(err, &se) && (se.SW == 0x6982 || se.SW == 0x6985) {
+		return sk, fmt.Errorf("YubiKey was not touched within %s", touchTimeout)
 	}
 
-	if buf[0] != 3 {
-		err = errors.New("invalid PGP encrypted key packet, only version 3 supported")
-		return
+	return sk, err
+}
+
+// encryptionKeyMatches reports whether the algorithm of the encryption key on
+// the YubiKey can decrypt the encrypted key packet.
+func encryptionKeyMatches(yk *yubikeyscard.YubiKey, ek encryptedKeyPacket) bool {
+	id := yk.AppRelatedData.AlgoAttrEnc.ID
+
+	switch packet.PublicKeyAlgorithm(ek.keyAlgo) {
+	case packet.PubKeyAlgoRSA:
+		return id == yubikeyscard.AlgoIdRSA
+	case packet.PubKeyAlgoECDH:
+		return id == yubikeyscard.AlgoIdECDH
 	}
 
-	if buf[9] != uint8(packet.PubKeyAlgoRSA) {
-		err = errors.New("invalid PGP encrypted key packet, only RSA supported")
-		return
+	return false
+}
+
+// KeyNotFoundError is returned by ReadMessage when none of the connected
+// YubiKeys holds a decryption key of the message. A key ID of 0 is a wildcard
+// recipient.
+type KeyNotFoundError struct {
+	KeyIDs []uint64
+}
+
+func (e *KeyNotFoundError) Error() string {
+	if len(e.KeyIDs) == 1 && e.KeyIDs[0] != 0 {
+		return fmt.Sprintf("decryption key %X could not be found on any YubiKeys", e.KeyIDs[0])
 	}
 
-	ek.tag = tag
-	ek.length = length
-	ek.version = buf[0]
-	ek.keyID = binary.BigEndian.Uint64(buf[1:9])
-	ek.keyAlgo = buf[9]
-	ek.keySize = binary.BigEndian.Uint16(buf[10:12])
+	ids := make([]string, len(e.KeyIDs))
+	for i, id := range e.KeyIDs {
+		if id == 0 {
+			ids[i] = "wildcard"
+		} else {
+			ids[i] = fmt.Sprintf("%X", id)
+		}
+	}
 
-	ek.encryptedBytes = make([]byte, length-(encryptedKeyPacketHeaderLength+encryptedKeyPacketKeyInfoLength))
-	if _, err = io.ReadFull(contents, ek.encryptedBytes); err != nil {
-		return
+	return fmt.Sprintf("none of the decryption keys (%s) could be found on any YubiKeys", strings.Join(ids, ", "))
+}
+
+// keysNotFoundError describes the key IDs of the encrypted key packets, none of
+// which could be found on the connected YubiKeys.
+func keysNotFoundError(eks []encryptedKeyPacket) error {
+	e := &KeyNotFoundError{KeyIDs: make([]uint64, len(eks))}
+	for i, ek := range eks {
+		e.KeyIDs[i] = ek.keyID
 	}
 
-	return ek, nil
+	return e
 }
 
-// readSymEncPacket decrypts the symmetrically encypted portion of the message
-// with the provided session key and cipher function.
-func readSymEncPacket(r io.Reader, key []byte, cipherFunc packet.CipherFunction) ([]byte, error) {
-	packets := packet.NewReader(r)
+// readEncryptedMessage reads the encrypted key packets at the start of the
+// message, followed by the encrypted data packet. Encrypted key packets with
+// an unsupported version or algorithm are skipped, as they may be addressed to
+// other recipients.
+func readEncryptedMessage(r io.Reader) (eks []encryptedKeyPacket, data rawPacket, err error) {
+	var skipped error
 
 	for {
-		p, err := packets.Next()
-		if err != nil {
-			return nil, err
+		var p rawPacket
+
+		p, err = readPacket(r)
+		if err == io.EOF {
+			err = errors.New("invalid PGP message, no encrypted data packet found")
+			return
+		} else if err != nil {
+			return
 		}
 
-		switch p := p.(type) {
-		case *packet.SymmetricallyEncrypted:
-			decrypted, err := p.Decrypt(cipherFunc, key)
-			if err != nil {
-				return nil, err
+		switch p.tag {
+		case packetTagEncryptedKey:
+			ek, perr := parseEncKeyPacket(p.body)
+			if perr != nil {
+				skipped = perr
+				continue
 			}
 
-			if err := packets.Push(decrypted); err != nil {
-				return nil, err
-			}
-		case *packet.LiteralData:
-			body, err := io.ReadAll(p.Body)
-			if err != nil {
-				return nil, err
+			eks = append(eks, ek)
+		case packetTagSymKeyEnc, packetTagMarker:
+			// passphrase encrypted session keys can not be used with a YubiKey
+		case packetTagSymEnc, packetTagSymEncMDC:
+			data = p
+
+			switch {
+			case len(eks) > 0:
+			case skipped != nil:
+				err = skipped
+			default:
+				err = errors.New("invalid PGP message, no encrypted key packets found")
 			}
 
-			return body, nil
+			return
 		default:
-			return nil, errors.New("unexpected PGP packet type encountered")
+			err = errors.New("invalid PGP packet type, only encrypted key and symmetrically encrypted packets supported")
+			return
 		}
 	}
 }
+
+// parseEncKeyPacket parses the body of a public-key encrypted session key
+// packet, as described in RFC 4880 section 5.1 and RFC 9580 section 5.1.
+func parseEncKeyPacket(body []byte) (ek encryptedKeyPacket, err error) {
+	if len(body) == 0 {
+		err = errors.New("invalid PGP packet, body too short")
+		return
+	}
+
+	ek.version = body[0]
+
+	var fields []byte
+
+	switch ek.version {
+	case encryptedKeyPacketVersion3:
+		if len(body) < encryptedKeyPacketKeyInfoLength {
+			err = errors.New("invalid PGP packet, body too short")
+			return
+		}
+
+		ek.keyID = binary.BigEndian.Uint64(body[1:9])
+		ek.keyAlgo = body[9]
+		fields = body[encryptedKeyPacketKeyInfoLength:]
+	case encryptedKeyPacketVersion6:
+		// the recipient is identified by the key version and fingerprint,
+		// which are omitted for anonymous recipients
+		if len(body) < 3 || len(body) < 3+int(body[1]) {
+			err = errors.New("invalid PGP packet, body too short")
+			return
+		}
+
+		n := int(body[1])
+
+		switch n {
+		case 0:
+		case 1 + 20: // version 4 key, key ID is the low 64 bits of the fingerprint
+			ek.keyID = binary.BigEndian.Uint64(body[2+n-8 : 2+n])
+		case 1 + 32: // version 6 key, key ID is the high 64 bits of the fingerprint
+			ek.keyID = binary.BigEndian.Uint64(body[3:11])
+		default:
+			err = errors.New("invalid PGP encrypted key packet, unexpected fingerprint length")
+			return
+		}
+
+		ek.keyAlgo = body[2+n]
+		fields = body[3+n:]
+	default:
+		err = errors.New("invalid PGP encrypted key packet, only version 3 and 6 supported")
+		return
+	}
+
+	switch packet.PublicKeyAlgorithm(ek.keyAlgo) {
+	case packet.PubKeyAlgoRSA:
+		// RSA: MPI of m^e mod n
+		ek.encryptedBytes, ek.keySize, _, err = readMPI(fields)
+	case packet.PubKeyAlgoECDH:
+		// ECDH: MPI of the ephemeral public point, followed by the length
+		// prefixed wrapped session key
+		var rest []byte
+		ek.ephemeralPoint, ek.keySize, rest, err = readMPI(fields)
+		if err != nil {
+			return
+		}
+
+		if len(rest) == 0 || int(rest[0]) != len(rest)-1 {
+			err = errors.New("invalid PGP encrypted key packet, wrapped session key length mismatch")
+			return
+		}
+
+		ek.wrappedKey = rest[1:]
+	default:
+		err = errors.New("invalid PGP encrypted key packet, only RSA and ECDH supported")
+	}
+
+	return
+}
+
+// leftPad prepends zeros to b up to length n.
+func leftPad(b []byte, n int) []byte {
+	if len(b) >= n {
+		return b
+	}
+
+	return append(make([]byte, n-len(b)), b...)
+}
@@ -5,19 +5,27 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
-
-	"github.com/ebfe/scard"
 )
 
 var appID = []byte{0xd2, 0x76, 0x00, 0x01, 0x24, 0x01} // OpenPGP applet ID
 
+// maxShortLc is the longest command data that fits in a short APDU.
+const maxShortLc = 0xff
+
+// maxShortNe is the longest response data a short Le can request.
+const maxShortNe = 256
+
+// leMax is the Le of commands whose response may exceed 256 bytes. It is sent
+// as an extended Le requesting up to 65536 bytes if the card supports extended
+// length fields, and as a short Le requesting up to 256 bytes otherwise.
+const leMax uint16 = 0xffff
+
 // commandAPDU represents an application data unit sent to a smartcard.
 type commandAPDU struct {
 	cla, ins, p1, p2 uint8  // Class, Instruction, Parameter 1, Parameter 2
 	data             []byte // Command data
-	le               uint8  // Command data length
-	pib              bool   // Padding indicator byte present
-	elf              bool   // Use extended length fields
+	le               uint16 // Expected response length, 0 for the maximum of the Le field, leMax for the maximum of the card
+	noLe             bool   // Omit the Le field, as no response data is expected
 }
 
 // responseAPDU represents an application data unit received from a smart card.
@@ -26,8 +34,26 @@ type responseAPDU struct {
 	sw1, sw2 uint8  // status words 1 and 2
 }
 
-// serialize serializes a command APDU.
-func (ca commandAPDU) serialize() ([]byte, error) {
+// StatusError is returned when the card answers a command with a status other
+// than success.
+type StatusError struct {
+	Op string // what the command was meant to do
+	SW uint16 // status words 1 and 2
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("could not %s (status %04x)", e.Op, e.SW)
+}
+
+// statusError returns a StatusError for the response.
+func (ra *responseAPDU) statusError(op string) error {
+	return &StatusError{Op: op, SW: uint16(ra.sw1)<<8 | uint16(ra.sw2)}
+}
+
+// serialize serializes a command APDU as a short APDU, or with extended length
+// fields if extended is set. Extended length fields are 3 bytes for Lc and 2
+// bytes for Le, or 3 bytes for Le if there is no command data.
+func (ca commandAPDU) serialize(extended bool) ([]byte, error) {
 	buf := new(bytes.Buffer)
 
 	// write 4 header bytes to buffer
@@ -35,25 +61,25 @@ func (ca commandAPDU) serialize() ([]byte, error) {
 		return nil, err
 	}
 
-	// if a payload exists, calculate the length, prepend it to the payload, and write to buffer
-	if len(ca.data) > 0 {
-		lc := len(ca.data)
+	if !extended && len(ca.data) > maxShortLc {
+		return nil, fmt.Errorf("command data of %d bytes too long for a short APDU", len(ca.data))
+	}
 
-		// subtract one byte from length if padding indicator byte present
-		if ca.pib {
-			lc--
-		}
+	if extended && len(ca.data) > 0xffff {
+		return nil, fmt.Errorf("command data of %d bytes too long for an extended length APDU", len(ca.data))
+	}
 
-		// check if extended length fields (3 bytes) should be used
-		if ca.elf {
-			lcElf := make([]byte, 2)
-			binary.BigEndian.PutUint16(lcElf, uint16(lc))
+	// if a payload exists, prepend its length and write to buffer
+	if len(ca.data) > 0 {
+		if extended {
+			lc := make([]byte, 2)
+			binary.BigEndian.PutUint16(lc, uint16(len(ca.data)))
 
-			if _, err := buf.Write(append([]byte{0}, lcElf...)); err != nil {
+			if _, err := buf.Write(append([]byte{0}, lc...)); err != nil {
 				return nil, err
 			}
 		} else {
-			if _, err := buf.Write([]byte{uint8(lc)}); err != nil {
+			if _, err := buf.Write([]byte{uint8(len(ca.data))}); err != nil {
 				return nil, err
 			}
 		}
@@ -63,18 +89,135 @@ func (ca commandAPDU) serialize() ([]byte, error) {
 		}
 	}
 
-	if _, err := buf.Write([]byte{ca.le}); err != nil {
+	if ca.noLe {
+		return buf.Bytes(), nil
+	}
+
+	if !extended && ca.le > maxShortNe && ca.le != leMax {
+		return nil, fmt.Errorf("expected response of %d bytes too long for a short APDU", ca.le)
+	}
+
+	// a short Le of zero requests up to 256 bytes, an extended Le of zero up
+	// to 65536 bytes
+	var le []byte
+	switch {
+	case ca.le == leMax && extended:
+		le = []byte{0, 0}
+	case ca.le == leMax:
+		le = []byte{0}
+	case extended:
+		le = binary.BigEndian.AppendUint16(nil, ca.le)
+	default:
+		le = []byte{uint8(ca.le)}
+	}
+
+	if extended && len(ca.data) == 0 {
+		le = append([]byte{0}, le...)
+	}
+
+	if _, err := buf.Write(le); err != nil {
 		return nil, err
 	}
 
 	return buf.Bytes(), nil
 }
 
-// transmit will send the serialized APDU command to the applet.
-func (ca commandAPDU) transmit(card *scard.Card) (responseAPDU, error) {
+// transmit sends the command APDU to the applet and returns the complete
+// response. Command data too long for a short APDU is sent with extended
+// length fields if the card supports them, or with command chaining otherwise.
+// Response data that the card returns in several parts is collected with GET
+// RESPONSE, and a command with the wrong Le is sent again with the length
+// requested by the card.
+func (ca commandAPDU) transmit(card Transport) (responseAPDU, error) {
+	if err := beginTransaction(card); err != nil {
+		return responseAPDU{}, err
+	}
+
+	defer endTransaction(card)
+
+	ra, err := ca.send(card)
+	if err != nil {
+		return ra, err
+	}
+
+	// wrong Le, the exact length is in SW2
+	if ra.sw1 == 0x6c {
+		ca.le = uint16(ra.sw2)
+		if ra, err = ca.send(card); err != nil {
+			return ra, err
+		}
+	}
+
+	data := ra.data
+
+	// more response data available, the number of bytes is in SW2
+	for ra.sw1 == 0x61 {
+		getResponse := commandAPDU{
+			cla: 0,
+			ins: 0xc0,
+			p1:  0,
+			p2:  0,
+			le:  uint16(ra.sw2),
+		}
+
+		ra, err = getResponse.send(card)
+		if err != nil {
+			return ra, err
+		}
+
+		data = append(data, ra.data...)
+	}
+
+	ra.data = data
+
+	return ra, nil
+}
+
+// send sends the command APDU in a single exchange, or as a chain of short
+// APDUs if the command data requires extended length fields the card does not
+// support. Commands whose response may exceed 256 bytes are sent with an
+// extended Le if the card supports it, so the response is not split into
+// parts fetched with GET RESPONSE.
+func (ca commandAPDU) send(card Transport) (responseAPDU, error) {
+	caps := cardCaps(card)
+	longLe := ca.le > maxShortNe && caps.ExtendedLength
+
+	if len(ca.data) <= maxShortLc && !longLe {
+		return ca.exchange(card, false)
+	}
+
+	if caps.ExtendedLength && (caps.MaxCommandLength == 0 || len(ca.data) <= int(caps.MaxCommandLength)) {
+		return ca.exchange(card, true)
+	}
+
+	if !caps.CommandChaining {
+		return responseAPDU{}, fmt.Errorf("command data of %d bytes requires extended length APDUs or command chaining, neither of which the card supports", len(ca.data))
+	}
+
+	// all but the last part have the chaining bit set in the class byte and
+	// are answered with 9000 only
+	for len(ca.data) > maxShortLc {
+		part := ca
+		part.cla |= 0x10
+		part.data = ca.data[:maxShortLc]
+		part.noLe = true
+
+		ra, err := part.exchange(card, false)
+		if err != nil || !ra.success() {
+			return ra, err
+		}
+
+		ca.data = ca.data[maxShortLc:]
+	}
+
+	return ca.exchange(card, false)
+}
+
+// exchange serializes the command APDU and transmits it to the card.
+func (ca commandAPDU) exchange(card Transport, extended bool) (responseAPDU, error) {
 	ra := new(responseAPDU)
 
-	cmd, err := ca.serialize()
+	cmd, err := ca.serialize(extended)
 	if err != nil {
 		return *ra, err
 	}
@@ -0,0 +1,39 @@
+package yubikeyscard
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestSerializeLe(t *testing.T) {
+	tests := []struct {
+		name     string
+		ca       commandAPDU
+		extended bool
+		want     string
+	}{
+		{"short maximum", commandAPDU{ins: 0xca, p2: 0x6e}, false, "00ca006e00"},
+		{"short leMax", commandAPDU{ins: 0xca, p2: 0x6e, le: leMax}, false, "00ca006e00"},
+		{"short 256", commandAPDU{ins: 0xc0, le: 256}, false, "00c0000000"},
+		{"extended leMax", commandAPDU{ins: 0xca, p2: 0x6e, le: leMax}, true, "00ca006e000000"},
+		{"extended with data", commandAPDU{ins: 0x47, p1: 0x81, data: []byte{0xb8, 0}, le: leMax}, true, "00478100000002b8000000"},
+		{"extended 300", commandAPDU{ins: 0xca, p2: 0x6e, le: 300}, true, "00ca006e00012c"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := tt.ca.serialize(tt.extended)
+			if err != nil {
+				t.Fatalf("serialize() error = %v", err)
+			}
+
+			if got := hex.EncodeToString(b); got != tt.want {
+				t.Errorf("serialize() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := (commandAPDU{ins: 0xca, le: 300}).serialize(false); err == nil {
+		t.Error("serialize() of a short APDU with Le 300 succeeded")
+	}
+}
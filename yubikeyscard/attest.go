@@ -0,0 +1,269 @@
+package yubikeyscard
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+	"vervet/bertlv"
+)
+
+// OIDs of the extensions Yubico adds to OpenPGP attestation certificates.
+var (
+	oidYubicoCardholder  = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 41482, 5, 1}
+	oidYubicoKeySource   = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 41482, 5, 2}
+	oidYubicoVersion     = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 41482, 5, 3}
+	oidYubicoFingerprint = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 41482, 5, 4}
+	oidYubicoGenDate     = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 41482, 5, 5}
+	oidYubicoSerial      = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 41482, 5, 7}
+	oidYubicoUIF         = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 41482, 5, 8}
+)
+
+// Key sources reported in attestation certificates.
+const (
+	KeySourceImported  byte = 0x00
+	KeySourceGenerated byte = 0x01
+)
+
+// Attestation is a Yubico attestation statement for a key slot. The
+// certificate is issued by the attestation key of the YubiKey for the public
+// key in the slot, and carries the properties of the key in extensions.
+type Attestation struct {
+	Certificate  *x509.Certificate
+	Intermediate *x509.Certificate // attestation certificate of the YubiKey
+
+	Cardholder  string
+	KeySource   byte
+	Version     [3]byte
+	Fingerprint []byte
+	Created     time.Time
+	Serial      uint32
+	TouchPolicy TouchPolicy
+}
+
+// Generated reports whether the key was generated on the YubiKey, rather than
+// imported.
+func (a *Attestation) Generated() bool {
+	return a.KeySource == KeySourceGenerated
+}
+
+// Verify verifies the certificate chain of the attestation statement up to one
+// of the roots. Intermediates may be provided in addition to the attestation
+// certificate of the YubiKey.
+func (a *Attestation) Verify(roots *x509.CertPool, intermediates *x509.CertPool) error {
+	if intermediates == nil {
+		intermediates = x509.NewCertPool()
+	}
+
+	intermediates.AddCert(a.Intermediate)
+
+	// attestation certificates are not issued for a particular usage
+	_, err := a.Certificate.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+
+	return err
+}
+
+// Attest has the YubiKey issue an attestation certificate for the key in the
+// key slot with the Yubico ATTEST command. The YubiKey stores the certificate
+// as the cardholder certificate of the slot, replacing any certificate there.
+// It is read back along with the attestation certificate of the YubiKey, which
+// signs it.
+func (yk *YubiKey) Attest(slot KeySlot) (*Attestation, error) {
+	if err := yk.BeginTransaction(); err != nil {
+		return nil, err
+	}
+
+	defer yk.EndTransaction()
+
+	ref, ok := map[KeySlot]uint8{KeySlotSign: 1, KeySlotEnc: 2, KeySlotAuth: 3}[slot]
+	if !ok {
+		return nil, fmt.Errorf("unknown key slot %02x", uint8(slot))
+	}
+
+	ca := commandAPDU{
+		cla: 0x80,
+		ins: 0xfb,
+		p1:  ref,
+		p2:  0,
+		le:  0,
+	}
+
+	ra, err := ca.transmit(yk.Card)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ra.success() {
+		switch {
+		case ra.sw1 == 0x69 && ra.sw2 == 0x82:
+			return nil, errors.New("PIN must be verified to attest keys")
+		case ra.sw1 == 0x6a && ra.sw2 == 0x88:
+			return nil, fmt.Errorf("%s key slot is empty", slot)
+		case ra.sw1 == 0x6d && ra.sw2 == 0x00:
+			return nil, errors.New("card does not support Yubico attestation")
+		}
+
+		return nil, fmt.Errorf("could not attest %s key (status %02x%02x)", slot, ra.sw1, ra.sw2)
+	}
+
+	// the cardholder certificate has an instance per key slot, numbered from
+	// the authentication key
+	if err := yk.selectData(doCardholderCrt, 3-ref); err != nil {
+		return nil, err
+	}
+
+	der, err := GetData(yk.Card, doCardholderCrt)
+	if err != nil {
+		return nil, err
+	}
+
+	a := new(Attestation)
+	if a.Certificate, err = x509.ParseCertificate(der); err != nil {
+		return nil, fmt.Errorf("invalid attestation certificate: %s", err)
+	}
+
+	if der, err = GetData(yk.Card, doAttestationCrt); err != nil {
+		return nil, err
+	}
+
+	if a.Intermediate, err = x509.ParseCertificate(der); err != nil {
+		return nil, fmt.Errorf("invalid Yubico attestation certificate: %s", err)
+	}
+
+	if err := a.parseExtensions(); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// selectData selects an instance of a data object that occurs several times,
+// such as the cardholder certificate, for the next GET DATA.
+func (yk *YubiKey) selectData(do DataObject, occurrence uint8) error {
+	data := bertlv.Encode(0x60, bertlv.Encode(0x5c, do.tagBytes()))
+
+	// firmware up to 5.4.3 expects the length of the data in the first octet
+	version, err := yk.FirmwareVersion()
+	if err != nil {
+		return err
+	}
+
+	if version[0] < 5 || (version[0] == 5 && (version[1] < 4 || (version[1] == 4 && version[2] <= 3))) {
+		data = append([]byte{uint8(len(data))}, data...)
+	}
+
+	ca := commandAPDU{
+		cla:  0,
+		ins:  0xa5,
+		p1:   occurrence,
+		p2:   0x04,
+		data: data,
+		le:   0,
+	}
+
+	ra, err := ca.transmit(yk.Card)
+	if err != nil {
+		return err
+	}
+
+	if !ra.success() {
+		return fmt.Errorf("could not select data object %04x (status %02x%02x)", do.tag, ra.sw1, ra.sw2)
+	}
+
+	return nil
+}
+
+// FirmwareVersion returns the firmware version of the YubiKey as major, minor
+// and patch number, read with the Yubico GET VERSION command.
+func (yk *YubiKey) FirmwareVersion() ([3]byte, error) {
+	var version [3]byte
+
+	ca := commandAPDU{
+		cla: 0,
+		ins: 0xf1,
+		p1:  0,
+		p2:  0,
+		le:  0,
+	}
+
+	ra, err := ca.transmit(yk.Card)
+	if err != nil {
+		return version, err
+	}
+
+	if !ra.success() || len(ra.data) < 3 {
+		return version, errors.New("could not read YubiKey firmware version")
+	}
+
+	// each part of the version is BCD encoded
+	for i := range version {
+		version[i] = (ra.data[i]>>4)*10 + ra.data[i]&0x0f
+	}
+
+	return version, nil
+}
+
+// parseExtensions reads the properties of the attested key from the Yubico
+// extensions of the certificate.
+func (a *Attestation) parseExtensions() error {
+	a.KeySource = 0xff
+
+	for _, ext := range a.Certificate.Extensions {
+		v := ext.Value
+
+		switch {
+		case ext.Id.Equal(oidYubicoCardholder):
+			a.Cardholder = string(v)
+		case ext.Id.Equal(oidYubicoKeySource) && len(v) == 1:
+			a.KeySource = v[0]
+		case ext.Id.Equal(oidYubicoVersion) && len(v) == 3:
+			copy(a.Version[:], v)
+		case ext.Id.Equal(oidYubicoFingerprint):
+			a.Fingerprint = v
+		case ext.Id.Equal(oidYubicoGenDate) && len(v) == 4:
+			a.Created = time.Unix(int64(binary.BigEndian.Uint32(v)), 0)
+		case ext.Id.Equal(oidYubicoSerial) && len(v) == 4:
+			a.Serial = binary.BigEndian.Uint32(v)
+		case ext.Id.Equal(oidYubicoUIF) && len(v) >= 1:
+			a.TouchPolicy = TouchPolicy(v[0])
+		}
+	}
+
+	if a.KeySource == 0xff || a.Fingerprint == nil {
+		return errors.New("attestation certificate does not contain Yubico OpenPGP extensions")
+	}
+
+	return nil
+}
+
+// Matches reports whether the public key of the certificate is the public key
+// material read from the card.
+func (pk *PublicKey) Matches(pub crypto.PublicKey) bool {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		return pk.Modulus != nil && k.N.Cmp(new(big.Int).SetBytes(pk.Modulus)) == 0 &&
+			big.NewInt(int64(k.E)).Cmp(new(big.Int).SetBytes(pk.Exponent)) == 0
+	case *ecdsa.PublicKey:
+		point, err := k.ECDH()
+		return err == nil && bytes.Equal(point.Bytes(), pk.Point)
+	case *ecdh.PublicKey:
+		return bytes.Equal(k.Bytes(), pk.Point)
+	case ed25519.PublicKey:
+		return bytes.Equal(k, pk.Point)
+	}
+
+	return false
+}
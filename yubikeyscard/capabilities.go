@@ -0,0 +1,287 @@
+package yubikeyscard
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"vervet/bertlv"
+)
+
+// CardCaps holds the card capabilities announced in the historical bytes or
+// the card capabilities DO, and the extended length information, if the card
+// supports extended length fields. Cards differ in whether they accept
+// extended length APDUs, so it is not assumed.
+type CardCaps struct {
+	Announced         bool   // card capabilities are present
+	CommandChaining   bool   // command chaining is supported
+	ExtendedLength    bool   // extended Lc and Le fields are supported
+	MaxCommandLength  uint16 // maximum length of a command APDU, 0 if unknown
+	MaxResponseLength uint16 // maximum length of a response APDU, 0 if unknown
+}
+
+// deserialize reads the 3 card capability bytes, as found in the historical
+// bytes or the card capabilities DO.
+func (cc *CardCaps) deserialize(data []byte) {
+	if len(data) < 3 {
+		return
+	}
+
+	cc.Announced = true
+	cc.CommandChaining = data[2]&0x80 != 0
+	cc.ExtendedLength = data[2]&0x40 != 0
+}
+
+// deserializeHistBytes reads the card capabilities from the compact-TLV data
+// objects of the historical bytes. Only historical bytes starting with the
+// category indicator 00 are supported, which all OpenPGP cards use.
+func (cc *CardCaps) deserializeHistBytes(data []byte) {
+	// the category indicator is followed by compact-TLV data objects and 3
+	// status indicator bytes
+	if len(data) < 4 || data[0] != 0 {
+		return
+	}
+
+	data = data[1 : len(data)-3]
+	for len(data) > 0 {
+		tag, n := data[0]>>4, int(data[0]&0x0f)
+		if n >= len(data) {
+			return
+		}
+
+		// card capabilities
+		if tag == 7 {
+			cc.deserialize(data[1 : n+1])
+			return
+		}
+
+		data = data[n+1:]
+	}
+}
+
+// deserializeExtLenInfo reads the maximum command and response lengths of the
+// extended length information DO, which are encoded as two 2 byte integers.
+func (cc *CardCaps) deserializeExtLenInfo(data []byte) {
+	if len(data) != 8 || data[0] != 0x02 || data[1] != 2 || data[4] != 0x02 || data[5] != 2 {
+		return
+	}
+
+	cc.MaxCommandLength = binary.BigEndian.Uint16(data[2:4])
+	cc.MaxResponseLength = binary.BigEndian.Uint16(data[6:8])
+}
+
+// deserializeExtCapsV2 reads the maximum command and response lengths from the
+// extended capabilities of version 2 cards, which have no extended length
+// information DO.
+func (cc *CardCaps) deserializeExtCapsV2(data []byte) {
+	if len(data) < 10 {
+		return
+	}
+
+	cc.MaxCommandLength = binary.BigEndian.Uint16(data[6:8])
+	cc.MaxResponseLength = binary.BigEndian.Uint16(data[8:10])
+}
+
+// ExtCaps holds the extended capabilities of the card (C0). The lengths are
+// those of version 3 cards.
+type ExtCaps struct {
+	Announced          bool // extended capabilities are present
+	SecureMessaging    bool // secure messaging is supported
+	GetChallenge       bool // GET CHALLENGE is supported
+	KeyImport          bool // private keys can be imported
+	PWStatusChangeable bool // the PW1 validity of the password status can be changed
+	PrivateDOs         bool // private use DOs are supported
+	AlgoAttrChangeable bool // the algorithm attributes of key slots can be changed
+	AES                bool // PSO:DECIPHER and ENCIPHER with AES are supported
+	KDF                bool // the KDF data object is supported
+	SMAlgo             byte
+	MaxChallengeLength uint16
+	MaxCertLength      uint16 // maximum length of cardholder certificates
+	MaxSpecialDOLength uint16 // maximum length of special DOs, such as private DOs
+	PINBlock2          bool   // PIN block 2 format is supported
+	MSE                bool   // MANAGE SECURITY ENVIRONMENT is supported
+}
+
+// deserialize reads the extended capabilities DO of version 3 cards.
+func (ec *ExtCaps) deserialize(data []byte) {
+	if len(data) < 10 {
+		return
+	}
+
+	ec.Announced = true
+	ec.SecureMessaging = data[0]&0x80 != 0
+	ec.GetChallenge = data[0]&0x40 != 0
+	ec.KeyImport = data[0]&0x20 != 0
+	ec.PWStatusChangeable = data[0]&0x10 != 0
+	ec.PrivateDOs = data[0]&0x08 != 0
+	ec.AlgoAttrChangeable = data[0]&0x04 != 0
+	ec.AES = data[0]&0x02 != 0
+	ec.KDF = data[0]&0x01 != 0
+	ec.SMAlgo = data[1]
+	ec.MaxChallengeLength = binary.BigEndian.Uint16(data[2:4])
+	ec.MaxCertLength = binary.BigEndian.Uint16(data[4:6])
+	ec.MaxSpecialDOLength = binary.BigEndian.Uint16(data[6:8])
+	ec.PINBlock2 = data[8] == 1
+	ec.MSE = data[9] == 1
+}
+
+// Features holds the user interface of the card announced in the general
+// feature management DO (7F74).
+type Features struct {
+	Announced   bool // general feature management is present
+	Display     bool
+	Biometric   bool // biometric input sensor
+	Button      bool
+	Keypad      bool // PIN pad
+	LED         bool
+	Loudspeaker bool
+	Microphone  bool
+	Touchscreen bool
+}
+
+// deserialize reads the feature bitmap in the general feature management DO.
+func (f *Features) deserialize(data []byte) {
+	b := findTLV(data, 0x81)
+	if len(b) < 1 {
+		return
+	}
+
+	f.Announced = true
+	f.Display = b[0]&0x80 != 0
+	f.Biometric = b[0]&0x40 != 0
+	f.Button = b[0]&0x20 != 0
+	f.Keypad = b[0]&0x10 != 0
+	f.LED = b[0]&0x08 != 0
+	f.Loudspeaker = b[0]&0x04 != 0
+	f.Microphone = b[0]&0x02 != 0
+	f.Touchscreen = b[0]&0x01 != 0
+}
+
+// AlgoInfo lists the algorithms supported in each key slot, as announced in
+// the algorithm information DO (FA) of version 3.4 cards. The lists are empty
+// if the card does not announce its algorithms.
+type AlgoInfo struct {
+	Sign []AlgoAttr
+	Enc  []AlgoAttr
+	Auth []AlgoAttr
+	Att  []AlgoAttr // Yubico attestation key
+}
+
+// deserialize reads the algorithm attributes listed in the DO. Entries of
+// unknown algorithms are skipped.
+func (ai *AlgoInfo) deserialize(data []byte) error {
+	tlvs, err := bertlv.Parse(data)
+	if err != nil {
+		return fmt.Errorf("invalid algorithm information returned by card: %s", err)
+	}
+
+	if len(tlvs) == 1 && tlvs[0].Tag == uint32(doAlgoInfo.tag) {
+		tlvs = tlvs[0].Children
+	}
+
+	*ai = AlgoInfo{}
+
+	for _, t := range tlvs {
+		var attr AlgoAttr
+		if err := attr.deserialize(bytes.NewReader(t.Value)); err != nil {
+			continue
+		}
+
+		switch t.Tag {
+		case uint32(doAlgoAttrSign.tag):
+			ai.Sign = append(ai.Sign, attr)
+		case uint32(doAlgoAttrEnc.tag):
+			ai.Enc = append(ai.Enc, attr)
+		case uint32(doAlgoAttrAuth.tag):
+			ai.Auth = append(ai.Auth, attr)
+		case 0xda:
+			ai.Att = append(ai.Att, attr)
+		}
+	}
+
+	return nil
+}
+
+// Slot returns the algorithms supported in the key slot.
+func (ai *AlgoInfo) Slot(slot KeySlot) []AlgoAttr {
+	switch slot {
+	case KeySlotSign:
+		return ai.Sign
+	case KeySlotEnc:
+		return ai.Enc
+	case KeySlotAuth:
+		return ai.Auth
+	}
+
+	return nil
+}
+
+// AlgoNames returns the names of the algorithms.
+func AlgoNames(attrs []AlgoAttr) []string {
+	names := make([]string, len(attrs))
+	for i := range attrs {
+		names[i] = attrs[i].Name()
+	}
+
+	return names
+}
+
+// sameAlgo reports whether the algorithm attributes describe the same
+// algorithm and key size or curve, regardless of the import format.
+func sameAlgo(a, b AlgoAttr) bool {
+	if a.ID != b.ID {
+		return false
+	}
+
+	if a.ID == AlgoIdRSA {
+		return a.RSAModLen == b.RSAModLen
+	}
+
+	return bytes.Equal(a.ECurveOID, b.ECurveOID)
+}
+
+// CheckKeyGeneration returns an error if the card announces that it can not
+// generate a key with the algorithm attributes in the key slot.
+func (yk *YubiKey) CheckKeyGeneration(slot KeySlot, attr AlgoAttr) error {
+	return yk.AppRelatedData.checkAlgo(slot, attr)
+}
+
+// CheckKeyImport returns an error if the card announces that it can not import
+// a key with the algorithm attributes into the key slot.
+func (yk *YubiKey) CheckKeyImport(slot KeySlot, attr AlgoAttr) error {
+	ec := yk.AppRelatedData.ExtCaps
+	if ec.Announced && !ec.KeyImport {
+		return errors.New("card does not support importing keys")
+	}
+
+	return yk.AppRelatedData.checkAlgo(slot, attr)
+}
+
+// checkAlgo returns an error if the algorithm of the key slot can not be set
+// to the algorithm attributes, according to the extended capabilities and
+// algorithm information of the card.
+func (ard *AppRelatedData) checkAlgo(slot KeySlot, attr AlgoAttr) error {
+	current, _, _ := ard.Key(slot)
+	if sameAlgo(current, attr) {
+		return nil
+	}
+
+	if ard.ExtCaps.Announced && !ard.ExtCaps.AlgoAttrChangeable {
+		return fmt.Errorf("card does not support changing the %s key algorithm from %s", slot, current.Name())
+	}
+
+	supported := ard.AlgoInfo.Slot(slot)
+	if len(supported) == 0 {
+		return nil
+	}
+
+	for _, s := range supported {
+		if sameAlgo(s, attr) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("card does not support %s keys in the %s key slot, supported algorithms: %s",
+		attr.Name(), slot, strings.Join(AlgoNames(supported), ", "))
+}
@@ -0,0 +1,60 @@
+package yubikeyscard
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// Curve describes an elliptic curve supported by the OpenPGP application.
+type Curve struct {
+	Name string // GnuPG curve name
+	OID  []byte // DER-encoded object identifier, without tag and length
+	Bits int    // field size in bits
+}
+
+var (
+	CurveCv25519 = Curve{Name: "cv25519", OID: []byte{0x2b, 0x06, 0x01, 0x04, 0x01, 0x97, 0x55, 0x01, 0x05, 0x01}, Bits: 255}
+	CurveEd25519 = Curve{Name: "ed25519", OID: []byte{0x2b, 0x06, 0x01, 0x04, 0x01, 0xda, 0x47, 0x0f, 0x01}, Bits: 255}
+	CurveP256    = Curve{Name: "nistp256", OID: []byte{0x2a, 0x86, 0x48, 0xce, 0x3d, 0x03, 0x01, 0x07}, Bits: 256}
+	CurveP384    = Curve{Name: "nistp384", OID: []byte{0x2b, 0x81, 0x04, 0x00, 0x22}, Bits: 384}
+	CurveP521    = Curve{Name: "nistp521", OID: []byte{0x2b, 0x81, 0x04, 0x00, 0x23}, Bits: 521}
+	CurveBP256   = Curve{Name: "brainpoolP256r1", OID: []byte{0x2b, 0x24, 0x03, 0x03, 0x02, 0x08, 0x01, 0x01, 0x07}, Bits: 256}
+	CurveBP384   = Curve{Name: "brainpoolP384r1", OID: []byte{0x2b, 0x24, 0x03, 0x03, 0x02, 0x08, 0x01, 0x01, 0x0b}, Bits: 384}
+	CurveBP512   = Curve{Name: "brainpoolP512r1", OID: []byte{0x2b, 0x24, 0x03, 0x03, 0x02, 0x08, 0x01, 0x01, 0x0d}, Bits: 512}
+	CurveSecp256 = Curve{Name: "secp256k1", OID: []byte{0x2b, 0x81, 0x04, 0x00, 0x0a}, Bits: 256}
+)
+
+var Curves = []Curve{
+	CurveCv25519, CurveEd25519, CurveP256, CurveP384, CurveP521,
+	CurveBP256, CurveBP384, CurveBP512, CurveSecp256,
+}
+
+// CurveByOID returns the curve with the provided object identifier, or nil if
+// the curve is unknown.
+func CurveByOID(oid []byte) *Curve {
+	for i := range Curves {
+		if bytes.Equal(Curves[i].OID, oid) {
+			return &Curves[i]
+		}
+	}
+
+	return nil
+}
+
+// Name returns the GnuPG style name of the key algorithm, such as rsa4096 or
+// cv25519.
+func (aa *AlgoAttr) Name() string {
+	switch aa.ID {
+	case AlgoIdRSA:
+		return fmt.Sprintf("rsa%d", binary.BigEndian.Uint16(aa.RSAModLen[:]))
+	case AlgoIdECDH, AlgoIdECDSA, AlgoIdEdDSA:
+		if c := CurveByOID(aa.ECurveOID); c != nil {
+			return c.Name
+		}
+
+		return fmt.Sprintf("unknown curve %x", aa.ECurveOID)
+	}
+
+	return fmt.Sprintf("unknown algorithm %d", aa.ID)
+}
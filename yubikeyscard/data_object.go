@@ -3,6 +3,7 @@ package yubikeyscard
 import (
 	"bytes"
 	"encoding/binary"
+	"vervet/bertlv"
 )
 
 const (
@@ -37,6 +38,7 @@ var doPWStatus = DataObject{tag: 0x00C4, constructed: false, parent: 0x6E, binar
 var doFingerprints = DataObject{tag: 0x00C5, constructed: false, parent: 0x6E, binary: true, extLen: 0, desc: "Fingerprints"}
 var doCAFingerprints = DataObject{tag: 0x00C6, constructed: false, parent: 0x6E, binary: true, extLen: 0, desc: "CA Fingerprints"}
 var doKeyGenDate = DataObject{tag: 0x00CD, constructed: false, parent: 0x6E, binary: true, extLen: 0, desc: "Generation times of key pairs"}
+var doKeyInfo = DataObject{tag: 0x00DE, constructed: false, parent: 0x6E, binary: true, extLen: 0, desc: "Key Information"}
 var doSecSuppTmpl = DataObject{tag: 0x007A, constructed: true, parent: 0, binary: true, extLen: 0, desc: "Security Support Template"}
 var doDigSigCtr = DataObject{tag: 0x0093, constructed: false, parent: 0x7A, binary: true, extLen: 0, desc: "Digital Signature Counter"}
 var doPrivateDO1 = DataObject{tag: 0x0101, constructed: false, parent: 0, binary: false, extLen: 2, desc: "Private DO 1"}
@@ -51,17 +53,22 @@ var doAESKeyData = DataObject{tag: 0x00D5, constructed: false, parent: 0, binary
 var doUIFSig = DataObject{tag: 0x00D6, constructed: false, parent: 0x6E, binary: true, extLen: 0, desc: "UIF for Signature"}
 var doUIFDec = DataObject{tag: 0x00D7, constructed: false, parent: 0x6E, binary: true, extLen: 0, desc: "UIF for Decryption"}
 var doUIFAut = DataObject{tag: 0x00D8, constructed: false, parent: 0x6E, binary: true, extLen: 0, desc: "UIF for Authentication"}
-var doUIFAtt = DataObject{tag: 0x00D8, constructed: false, parent: 0x6E, binary: true, extLen: 0, desc: "UIF for Yubico Attestation key"}
+var doUIFAtt = DataObject{tag: 0x00D9, constructed: false, parent: 0x6E, binary: true, extLen: 0, desc: "UIF for Yubico Attestation key"}
 var doKDFDO = DataObject{tag: 0x00F9, constructed: false, parent: 0, binary: true, extLen: 0, desc: "KDF data object"}
 var doAlgoInfo = DataObject{tag: 0x00FA, constructed: false, parent: 0, binary: true, extLen: 2, desc: "Algorithm Information"}
+var doExtLenInfo = DataObject{tag: 0x7F66, constructed: true, parent: 0x6E, binary: true, extLen: 0, desc: "Extended length information"}
+
+// Yubico
+var doAttestationCrt = DataObject{tag: 0x00FC, constructed: false, parent: 0, binary: true, extLen: 2, desc: "Yubico attestation certificate"}
 
 var DataObjects = []DataObject{
 	doURL, doHistBytes, doCardRelData, doName, doLangPrefs, doSalutation,
 	doAppRelData, doLoginData, doAID, doDiscrDOs, doCardCaps, doExtLenCaps,
 	doAlgoAttrSign, doAlgoAttrEnc, doAlgoAttrAuth, doPWStatus, doFingerprints,
-	doCAFingerprints, doKeyGenDate, doSecSuppTmpl, doDigSigCtr, doPrivateDO1,
-	doPrivateDO2, doPrivateDO3, doPrivateDO4, doCardholderCrt, doGenFeatMgmt,
-	doAESKeyData, doUIFSig, doUIFDec, doUIFAut, doUIFAtt, doKDFDO, doAlgoInfo,
+	doCAFingerprints, doKeyGenDate, doKeyInfo, doSecSuppTmpl, doDigSigCtr,
+	doPrivateDO1, doPrivateDO2, doPrivateDO3, doPrivateDO4, doCardholderCrt,
+	doGenFeatMgmt, doAESKeyData, doUIFSig, doUIFDec, doUIFAut, doUIFAtt, doKDFDO,
+	doAlgoInfo, doExtLenInfo, doAttestationCrt,
 }
 
 func (do *DataObject) tagBytes() []byte {
@@ -78,6 +85,14 @@ func (do *DataObject) tagP2() byte {
 	return do.tagBytes()[1]
 }
 
+// longResponse reports whether the value of the data object may exceed 256
+// bytes: the objects marked with extended length in the OpenPGP card
+// specification, and the application related data, which exceeds 256 bytes on
+// cards with long algorithm attributes and key information.
+func (do *DataObject) longResponse() bool {
+	return do.extLen != 0 || do.tag == doAppRelData.tag
+}
+
 func (do *DataObject) parentBytes() []byte {
 	b := make([]byte, 2)
 	binary.BigEndian.PutUint16(b, uint16(do.parent))
@@ -96,85 +111,18 @@ func (do *DataObject) children() []DataObject {
 	return c
 }
 
-// doFindTLV function is based on GnuPG implementation of do_find_tlv in common/tlv.c
-func doFindTLV(data []byte, tag uint16, nestLevel int) []byte {
-	var o int = 0
-	var n int = len(data)
-	var tagLen uint16
-	var thisTag uint16
-	var tagFound bool
-	var composite bool
-
-	for !tagFound {
-		if n < 2 { // Buffer definitely too short for tag and length.
-			return nil
-		}
-
-		if data[o] == 0 || data[o] == 0xff { // Skip optional filler between TLV objects.
-			o++
-			n--
-		}
-
-		composite = (data[o] & 0x20) != 0
-
-		if (data[o] & 0x1f) == 0x1f { // more tag bytes to follow
-			o++
-			n--
-
-			if n < 2 { // Buffer definitely too short for tag and length.
-				return nil
-			}
-			if (data[o] & 0x1f) == 0x1f { // We support only up to 2 bytes.
-				return nil
-			}
-
-			thisTag = binary.BigEndian.Uint16([]byte{data[o-1], data[o] & 0x7f})
-		} else {
-			thisTag = binary.BigEndian.Uint16([]byte{0, data[o]})
-		}
-
-		tagLen = binary.BigEndian.Uint16([]byte{0, data[o+1]})
-		o += 2
-		n -= 2
-		if tagLen < 0x80 {
-			// do nothing
-		} else if tagLen == 0x81 { // One byte length follows.
-			if n != 0 { // we expected 1 more bytes with the length
-				return nil
-			}
-
-			tagLen = binary.BigEndian.Uint16([]byte{0, data[o]})
-			o++
-			n--
-		} else if tagLen == 0x82 { // Two byte length follows
-			if n < 2 { // We expected 2 more bytes with the length.
-				return nil
-			}
-
-			tagLen = binary.BigEndian.Uint16([]byte{data[o], data[o+1]})
-			o += 2
-			n -= 2
-		} else { // APDU limit is 65535, thus it does not make sense to assume longer length fields. */
-			return nil
-		}
-
-		if composite && nestLevel < 100 { // Dive into this composite DO after checking for a too deep nesting
-			tmpData := doFindTLV(data[o:], tag, nestLevel+1)
-
-			if len(tmpData) > 0 {
-				return tmpData
-			}
-		}
+// findTLV returns the value of the first data object with the tag in data,
+// searching nested data objects depth first. nil is returned if the tag is not
+// found or data is not valid BER-TLV.
+func findTLV(data []byte, tag uint16) []byte {
+	tlvs, err := bertlv.Parse(data)
+	if err != nil {
+		return nil
+	}
 
-		if thisTag == tag {
-			tagFound = true
-		} else if int(tagLen) > n { // Buffer too short to skip to the next tag.
-			return nil
-		} else {
-			o += int(tagLen)
-			n -= int(tagLen)
-		}
+	if t := bertlv.Find(tlvs, uint32(tag)); t != nil {
+		return t.Value
 	}
 
-	return data[o : o+int(tagLen)]
+	return nil
 }
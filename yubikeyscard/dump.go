@@ -0,0 +1,70 @@
+package yubikeyscard
+
+import "vervet/bertlv"
+
+// Tag returns the tag of the data object.
+func (do DataObject) Tag() uint16 {
+	return do.tag
+}
+
+// Parent returns the tag of the constructed data object that contains the data
+// object, or 0 if the data object is read directly with GET DATA.
+func (do DataObject) Parent() uint16 {
+	return do.parent
+}
+
+// Binary reports whether the value of the data object is binary rather than
+// text.
+func (do DataObject) Binary() bool {
+	return do.binary
+}
+
+// Description returns the name of the data object in the OpenPGP card
+// specification.
+func (do DataObject) Description() string {
+	return do.desc
+}
+
+// LookupDataObject returns the data object with the tag from DataObjects.
+func LookupDataObject(tag uint32) (DataObject, bool) {
+	for _, do := range DataObjects {
+		if uint32(do.tag) == tag {
+			return do, true
+		}
+	}
+
+	return DataObject{}, false
+}
+
+// ReadDataObject reads the data object with GET DATA and decodes it. Cards
+// return some constructed data objects with their tag and others as the
+// contained data objects only, both are returned as a tree rooted at the data
+// object. Certificates are not decoded, nor are values that are not valid
+// BER-TLV.
+func (yk *YubiKey) ReadDataObject(do DataObject) (bertlv.TLV, error) {
+	root := bertlv.TLV{Tag: uint32(do.tag)}
+
+	data, err := GetData(yk.Card, do)
+	if err != nil {
+		return root, err
+	}
+
+	root.Value = data
+
+	if !root.Constructed() || do.tag == doCardholderCrt.tag || do.tag == doAttestationCrt.tag {
+		return root, nil
+	}
+
+	tlvs, err := bertlv.Parse(data)
+	if err != nil {
+		return root, nil
+	}
+
+	if len(tlvs) == 1 && tlvs[0].Tag == root.Tag {
+		return tlvs[0], nil
+	}
+
+	root.Children = tlvs
+
+	return root, nil
+}
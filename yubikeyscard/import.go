@@ -0,0 +1,175 @@
+package yubikeyscard
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"vervet/bertlv"
+)
+
+// RSA private key import formats from the algorithm attributes.
+const (
+	rsaImportStandard        uint8 = 0x00
+	rsaImportStandardModulus uint8 = 0x01
+	rsaImportCRT             uint8 = 0x02
+	rsaImportCRTModulus      uint8 = 0x03
+
+	// ecImportPublicKey indicates that the public key is imported with the
+	// private key of elliptic curve keys
+	ecImportPublicKey uint8 = 0xff
+)
+
+// PrivateKey is private key material to import into a key slot. RSA keys
+// consist of the public exponent, primes and modulus. Elliptic curve keys
+// consist of the private key and public point in the native encoding of the
+// curve, which is little endian for Curve25519.
+type PrivateKey struct {
+	Exponent []byte
+	P, Q     []byte
+	Modulus  []byte
+	Scalar   []byte
+	Point    []byte
+}
+
+// ImportKey imports the private key into the key slot, replacing any key in
+// the slot. The algorithm of the slot is changed to the provided attributes
+// first, and the key is sent in the import format the card reports for them.
+// The admin PIN must be verified. The fingerprint and generation time must be
+// written with SetKeyInfo afterwards.
+func (yk *YubiKey) ImportKey(slot KeySlot, attr AlgoAttr, key *PrivateKey) error {
+	if err := yk.CheckKeyImport(slot, attr); err != nil {
+		return err
+	}
+
+	if err := yk.BeginTransaction(); err != nil {
+		return err
+	}
+
+	defer yk.EndTransaction()
+
+	attr, err := yk.setAlgoAttr(slot, attr)
+	if err != nil {
+		return err
+	}
+
+	tmpl, values, err := privateKeyTemplate(attr, key)
+	if err != nil {
+		return err
+	}
+
+	// extended header list with the control reference template of the slot,
+	// the cardholder private key template and the concatenated key data
+	data := []byte{uint8(slot), 0}
+	data = append(data, bertlv.Encode(0x7f48, tmpl)...)
+	data = append(data, bertlv.Encode(0x5f48, values)...)
+
+	ca := commandAPDU{
+		cla:  0,
+		ins:  0xdb,
+		p1:   0x3f,
+		p2:   0xff,
+		data: bertlv.Encode(0x4d, data),
+		le:   0,
+	}
+
+	ra, err := ca.transmit(yk.Card)
+	if err != nil {
+		return err
+	}
+
+	if !ra.success() {
+		if ra.sw1 == 0x69 && ra.sw2 == 0x82 {
+			return errors.New("security status not satisfied, admin PIN must be verified")
+		}
+
+		return fmt.Errorf("could not import %s key (status %02x%02x)", slot, ra.sw1, ra.sw2)
+	}
+
+	return yk.refreshAppRelatedData()
+}
+
+// privateKeyTemplate returns the cardholder private key template (7F48),
+// listing the tag and length of each key component, and the concatenated
+// components, as described in section 4.4.3.12 of the OpenPGP card
+// specification.
+func privateKeyTemplate(attr AlgoAttr, key *PrivateKey) (tmpl, values []byte, err error) {
+	add := func(tag uint16, v []byte) {
+		tmpl = append(tmpl, bertlv.EncodeTagLength(uint32(tag), len(v))...)
+		values = append(values, v...)
+	}
+
+	switch attr.ID {
+	case AlgoIdRSA:
+		bits := int(binary.BigEndian.Uint16(attr.RSAModLen[:]))
+		expBits := int(binary.BigEndian.Uint16(attr.RSAPubKeyExpLen[:]))
+		primeLen := bits / 16
+
+		if key.Exponent == nil || key.P == nil || key.Q == nil {
+			return nil, nil, errors.New("RSA private key is incomplete")
+		}
+
+		e := new(big.Int).SetBytes(key.Exponent)
+		p := new(big.Int).SetBytes(key.P)
+		q := new(big.Int).SetBytes(key.Q)
+
+		if new(big.Int).Mul(p, q).BitLen() != bits {
+			return nil, nil, fmt.Errorf("RSA key size does not match %d bit key slot", bits)
+		}
+
+		add(0x91, padLeft(e.Bytes(), (expBits+7)/8))
+		add(0x92, padLeft(p.Bytes(), primeLen))
+		add(0x93, padLeft(q.Bytes(), primeLen))
+
+		switch attr.PrivKeyImpFmt {
+		case rsaImportStandard, rsaImportStandardModulus:
+		case rsaImportCRT, rsaImportCRTModulus:
+			one := big.NewInt(1)
+			dp := new(big.Int).ModInverse(e, new(big.Int).Sub(p, one))
+			dq := new(big.Int).ModInverse(e, new(big.Int).Sub(q, one))
+			qinv := new(big.Int).ModInverse(q, p)
+
+			if dp == nil || dq == nil || qinv == nil {
+				return nil, nil, errors.New("invalid RSA private key")
+			}
+
+			add(0x94, padLeft(qinv.Bytes(), primeLen))
+			add(0x95, padLeft(dp.Bytes(), primeLen))
+			add(0x96, padLeft(dq.Bytes(), primeLen))
+		default:
+			return nil, nil, fmt.Errorf("unsupported RSA private key import format %02x", attr.PrivKeyImpFmt)
+		}
+
+		if attr.PrivKeyImpFmt == rsaImportStandardModulus || attr.PrivKeyImpFmt == rsaImportCRTModulus {
+			add(0x97, padLeft(new(big.Int).Mul(p, q).Bytes(), bits/8))
+		}
+	case AlgoIdECDH, AlgoIdECDSA, AlgoIdEdDSA:
+		curve := CurveByOID(attr.ECurveOID)
+		if curve == nil {
+			return nil, nil, fmt.Errorf("unsupported curve %x", attr.ECurveOID)
+		}
+
+		if key.Scalar == nil {
+			return nil, nil, errors.New("elliptic curve private key is incomplete")
+		}
+
+		add(0x92, padLeft(key.Scalar, (curve.Bits+7)/8))
+
+		if attr.PrivKeyImpFmt == ecImportPublicKey {
+			add(0x99, key.Point)
+		}
+	default:
+		return nil, nil, fmt.Errorf("unsupported algorithm %d", attr.ID)
+	}
+
+	return tmpl, values, nil
+}
+
+// padLeft prepends zeros to b up to length n.
+func padLeft(b []byte, n int) []byte {
+	if len(b) >= n {
+		return b
+	}
+
+	return append(make([]byte, n-len(b)), b...)
+}
@@ -3,21 +3,18 @@ package yubikeyscard
 import (
 	"errors"
 	"fmt"
-
-	"github.com/ebfe/scard"
+	"vervet/bertlv"
 )
 
 // Decipher data with private key on smart card
-func Decipher(card *scard.Card, data []byte) ([]byte, error) {
+func Decipher(card Transport, data []byte) ([]byte, error) {
 	ca := commandAPDU{
 		cla:  0,
 		ins:  0x2a,
 		p1:   0x80,
 		p2:   0x86,
-		data: append(append([]byte{0}, data...), 1), // prepend RSA padding indicator byte and append footer
+		data: append([]byte{0}, data...), // prepend RSA padding indicator byte
 		le:   0,
-		pib:  true,
-		elf:  true,
 	}
 
 	if len(data)%16 != 0 {
@@ -30,15 +27,64 @@ func Decipher(card *scard.Card, data []byte) ([]byte, error) {
 	}
 
 	if !ra.success() {
-		return nil, errors.New("decipher operation unsuccessful")
+		return nil, ra.statusError("decipher")
+	}
+
+	return ra.data, nil
+}
+
+// DecipherECDH computes the ECDH shared secret of the ephemeral public point
+// and the private key on the smart card. Depending on the card, the secret is
+// returned as the x-coordinate, optionally prefixed, or as the full point.
+func DecipherECDH(card Transport, point []byte) ([]byte, error) {
+	ca := commandAPDU{
+		cla:  0,
+		ins:  0x2a,
+		p1:   0x80,
+		p2:   0x86,
+		data: bertlv.Encode(0xa6, bertlv.Encode(0x7f49, bertlv.Encode(0x86, point))), // cipher DO, public key template, public key
+		le:   0,
+	}
+
+	ra, err := ca.transmit(card)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ra.success() {
+		return nil, ra.statusError("decipher")
 	}
 
 	return ra.data, nil
 }
 
-func GetData(card *scard.Card, do DataObject) ([]byte, error) {
-	data := []byte{}
+// ComputeDigitalSignature signs the data with the private key in the signature
+// key slot. RSA keys expect a DigestInfo, ECDSA and EdDSA keys the hash. The
+// PIN must be verified for signing (bank 1), cards may require this for every
+// signature.
+func ComputeDigitalSignature(card Transport, data []byte) ([]byte, error) {
+	ca := commandAPDU{
+		cla:  0,
+		ins:  0x2a,
+		p1:   0x9e,
+		p2:   0x9a,
+		data: data,
+		le:   0,
+	}
+
+	ra, err := ca.transmit(card)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ra.success() {
+		return nil, ra.statusError("compute digital signature")
+	}
+
+	return ra.data, nil
+}
 
+func GetData(card Transport, do DataObject) ([]byte, error) {
 	ca := commandAPDU{
 		cla: 0,
 		ins: 0xca,
@@ -47,38 +93,23 @@ func GetData(card *scard.Card, do DataObject) ([]byte, error) {
 		le:  0,
 	}
 
+	if do.longResponse() {
+		ca.le = leMax
+	}
+
 	ra, err := ca.transmit(card)
 	if err != nil {
 		return nil, err
 	}
 
-	data = append(data, ra.data...)
-
-	for !ra.success() {
-		if ra.sw1 == 0x61 {
-			ca = commandAPDU{
-				cla: 0,
-				ins: 0xc0,
-				p1:  0,
-				p2:  0,
-				le:  0,
-			}
-
-			ra, err = ca.transmit(card)
-			if err != nil {
-				return nil, err
-			}
-
-			data = append(data, ra.data...)
-		} else {
-			return nil, errors.New("error occurred, could not get data segment")
-		}
+	if !ra.success() {
+		return nil, ra.statusError("read " + do.desc)
 	}
 
-	return data, nil
+	return ra.data, nil
 }
 
-func SelectApp(card *scard.Card) error {
+func SelectApp(card Transport) error {
 	ca := commandAPDU{
 		cla:  0,
 		ins:  0xa4,
@@ -100,11 +131,40 @@ func SelectApp(card *scard.Card) error {
 	return nil
 }
 
+// PutData writes the value of the data object with the provided tag. Values
+// longer than a short APDU allows are sent with extended length fields or
+// command chaining, depending on the card.
+func PutData(card Transport, tag uint16, data []byte) error {
+	ca := commandAPDU{
+		cla:  0,
+		ins:  0xda,
+		p1:   uint8(tag >> 8),
+		p2:   uint8(tag),
+		data: data,
+		le:   0,
+	}
+
+	ra, err := ca.transmit(card)
+	if err != nil {
+		return err
+	}
+
+	if !ra.success() {
+		if ra.sw1 == 0x69 && ra.sw2 == 0x82 {
+			return errors.New("security status not satisfied, admin PIN must be verified")
+		}
+
+		return fmt.Errorf("could not write data object %04x (status %02x%02x)", tag, ra.sw1, ra.sw2)
+	}
+
+	return nil
+}
+
 // Verify is used to check the PIN for the provided bank and set appropriate
 // access. Verify will return the number of tries remaining. If an error other
 // than an invalid PIN occurs, -1 will be returned for the number of remaining
 // retries.
-func Verify(card *scard.Card, bank uint8, pin []byte) (int, error) {
+func Verify(card Transport, bank uint8, pin []byte) (int, error) {
 	ca := commandAPDU{
 		cla:  0,
 		ins:  0x20,
@@ -124,7 +184,7 @@ func Verify(card *scard.Card, bank uint8, pin []byte) (int, error) {
 	}
 
 	if !ra.success() {
-		retries, err := pw1PINRetries(card)
+		retries, err := pinRetries(card, bank)
 		if err != nil {
 			return -1, err
 		}
@@ -139,3 +199,99 @@ func Verify(card *scard.Card, bank uint8, pin []byte) (int, error) {
 
 	return 3, nil
 }
+
+// ChangeReferenceData replaces the PIN of the provided bank, 1 for the user PIN
+// (PW1) or 3 for the admin PIN (PW3), after checking the current PIN.
+// ChangeReferenceData will return the number of tries remaining if the current
+// PIN is incorrect, otherwise -1.
+func ChangeReferenceData(card Transport, bank uint8, pin []byte, newPIN []byte) (int, error) {
+	ca := commandAPDU{
+		cla:  0,
+		ins:  0x24,
+		p1:   0,
+		p2:   0x80 + bank,
+		data: append(append([]byte{}, pin...), newPIN...),
+		le:   0,
+	}
+
+	if bank != 1 && bank != 3 {
+		return -1, errors.New("invalid PIN bank, use bank 1 or 3")
+	}
+
+	ra, err := ca.transmit(card)
+	if err != nil {
+		return -1, err
+	}
+
+	if !ra.success() {
+		return pinError(card, bank, ra)
+	}
+
+	return -1, nil
+}
+
+// ResetRetryCounter sets a new user PIN (PW1) and resets its retry counter. The
+// reset code authenticates the command, or if rc is nil, the admin PIN must be
+// verified. ResetRetryCounter will return the number of tries remaining if the
+// reset code is incorrect, otherwise -1.
+func ResetRetryCounter(card Transport, rc []byte, newPIN []byte) (int, error) {
+	ca := commandAPDU{
+		cla:  0,
+		ins:  0x2c,
+		p1:   0,
+		p2:   0x81,
+		data: append(append([]byte{}, rc...), newPIN...),
+		le:   0,
+	}
+
+	if rc == nil {
+		ca.p1 = 0x02
+	}
+
+	ra, err := ca.transmit(card)
+	if err != nil {
+		return -1, err
+	}
+
+	if !ra.success() {
+		if rc == nil {
+			if ra.sw1 == 0x69 && ra.sw2 == 0x82 {
+				return -1, errors.New("security status not satisfied, admin PIN must be verified")
+			}
+
+			return -1, fmt.Errorf("could not unblock PIN (status %02x%02x)", ra.sw1, ra.sw2)
+		}
+
+		return pinError(card, resetCodeBank, ra)
+	}
+
+	return -1, nil
+}
+
+// pinError returns the error and remaining retries for an unsuccessful
+// command authenticated with the PIN of the provided bank.
+func pinError(card Transport, bank uint8, ra responseAPDU) (int, error) {
+	name := "PIN"
+	if bank == resetCodeBank {
+		name = "reset code"
+	}
+
+	switch {
+	case ra.sw1 == 0x69 && ra.sw2 == 0x83:
+		return 0, fmt.Errorf("%s blocked, no retries remaining", name)
+	case ra.sw1 == 0x63, ra.sw1 == 0x69 && ra.sw2 == 0x82:
+		retries, err := pinRetries(card, bank)
+		if err != nil {
+			return -1, err
+		}
+
+		verb := "retry"
+		if retries > 1 {
+			verb = "retries"
+		}
+
+		return retries, fmt.Errorf("invalid %s, %d %s remaining", name, retries, verb)
+	}
+
+	return -1, fmt.Errorf("%s operation unsuccessful (status %02x%02x)", name, ra.sw1, ra.sw2)
+}
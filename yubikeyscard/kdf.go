@@ -0,0 +1,240 @@
+package yubikeyscard
+
+import (
+	"crypto"
+	"crypto/rand"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"vervet/bertlv"
+)
+
+// KDF algorithms of the KDF data object.
+const (
+	KDFAlgoNone          byte = 0x00
+	KDFAlgoIterSaltedS2K byte = 0x03
+)
+
+// Hash algorithms of the KDF data object, using the OpenPGP algorithm IDs.
+const (
+	kdfHashSHA256 byte = 0x08
+	kdfHashSHA512 byte = 0x0a
+)
+
+const (
+	// kdfIterations is the number of octets hashed when deriving PINs for new
+	// KDF data objects, the OpenPGP string-to-key count 255
+	kdfIterations uint32 = 65011712
+	kdfSaltLength        = 8
+
+	defaultPIN      = "123456"
+	defaultAdminPIN = "12345678"
+)
+
+// KDF is the KDF data object (F9), which specifies how PINs are hashed by the
+// host before they are sent to the card, as described in section 4.3.2 of the
+// OpenPGP card specification.
+type KDF struct {
+	Algo       byte
+	HashAlgo   byte
+	Iterations uint32
+	SaltPW1    []byte
+	SaltRC     []byte
+	SaltPW3    []byte
+	InitialPW1 []byte
+	InitialPW3 []byte
+}
+
+// Enabled reports whether PINs must be hashed before they are sent to the card.
+func (kdf *KDF) Enabled() bool {
+	return kdf.Algo == KDFAlgoIterSaltedS2K
+}
+
+// refreshKDF reads the KDF data object. Cards without support for the data
+// object are treated as if KDF is disabled.
+func (yk *YubiKey) refreshKDF() error {
+	yk.KDF = KDF{}
+
+	data, err := GetData(yk.Card, doKDFDO)
+	if err != nil || len(data) == 0 {
+		return nil
+	}
+
+	return yk.KDF.deserialize(data)
+}
+
+func (kdf *KDF) deserialize(data []byte) error {
+	algo := findTLV(data, 0x81)
+	if len(algo) != 1 {
+		return errors.New("invalid KDF data object returned by card")
+	}
+
+	kdf.Algo = algo[0]
+	if kdf.Algo == KDFAlgoNone {
+		return nil
+	}
+
+	if kdf.Algo != KDFAlgoIterSaltedS2K {
+		return fmt.Errorf("unsupported KDF algorithm %02x", kdf.Algo)
+	}
+
+	hash := findTLV(data, 0x82)
+	count := findTLV(data, 0x83)
+	if len(hash) != 1 || len(count) != 4 {
+		return errors.New("invalid KDF data object returned by card")
+	}
+
+	kdf.HashAlgo = hash[0]
+	kdf.Iterations = binary.BigEndian.Uint32(count)
+	kdf.SaltPW1 = findTLV(data, 0x84)
+	kdf.SaltRC = findTLV(data, 0x85)
+	kdf.SaltPW3 = findTLV(data, 0x86)
+	kdf.InitialPW1 = findTLV(data, 0x87)
+	kdf.InitialPW3 = findTLV(data, 0x88)
+
+	return nil
+}
+
+func (kdf *KDF) serialize() []byte {
+	data := bertlv.Encode(0x81, []byte{kdf.Algo})
+	if kdf.Algo == KDFAlgoNone {
+		return data
+	}
+
+	data = append(data, bertlv.Encode(0x82, []byte{kdf.HashAlgo})...)
+	data = append(data, bertlv.Encode(0x83, binary.BigEndian.AppendUint32(nil, kdf.Iterations))...)
+
+	for _, f := range []struct {
+		tag   uint16
+		value []byte
+	}{
+		{0x84, kdf.SaltPW1}, {0x85, kdf.SaltRC}, {0x86, kdf.SaltPW3},
+		{0x87, kdf.InitialPW1}, {0x88, kdf.InitialPW3},
+	} {
+		if f.value != nil {
+			data = append(data, bertlv.Encode(uint32(f.tag), f.value)...)
+		}
+	}
+
+	return data
+}
+
+// derivePIN returns the PIN for the provided bank in the form sent to the
+// card. If KDF is enabled, the PIN is hashed with the iterated and salted S2K
+// function of RFC 4880 section 3.7.1.3, using the salt of the bank, or the PW1
+// salt if the bank has none. resetCodeBank selects the salt of the reset code.
+func (kdf *KDF) derivePIN(bank uint8, pin []byte) ([]byte, error) {
+	if !kdf.Enabled() {
+		return pin, nil
+	}
+
+	var salt []byte
+
+	switch bank {
+	case 1, 2:
+		salt = kdf.SaltPW1
+	case 3:
+		salt = kdf.SaltPW3
+	case resetCodeBank:
+		salt = kdf.SaltRC
+	}
+
+	// the reset code and admin PIN use the PW1 salt if they have none, as
+	// GnuPG sets up cards with a single salt
+	if len(salt) == 0 {
+		salt = kdf.SaltPW1
+	}
+
+	if len(salt) == 0 {
+		return nil, errors.New("KDF data object does not contain a salt for the PIN")
+	}
+
+	var h crypto.Hash
+
+	switch kdf.HashAlgo {
+	case kdfHashSHA256:
+		h = crypto.SHA256
+	case kdfHashSHA512:
+		h = crypto.SHA512
+	default:
+		return nil, fmt.Errorf("unsupported KDF hash algorithm %02x", kdf.HashAlgo)
+	}
+
+	input := append(append([]byte{}, salt...), pin...)
+
+	// the salted PIN is hashed repeatedly until the number of octets is
+	// reached, but at least once
+	count := max(int(kdf.Iterations), len(input))
+
+	d := h.New()
+	for n := count; n > 0; n -= len(input) {
+		d.Write(input[:min(n, len(input))])
+	}
+
+	return d.Sum(nil), nil
+}
+
+// newKDF returns a KDF data object using iterated and salted S2K with SHA-256
+// and random salts. The initial PIN hashes are those of the default PINs,
+// which the card sets the PINs to when the data object is written.
+func newKDF() (*KDF, error) {
+	kdf := &KDF{
+		Algo:       KDFAlgoIterSaltedS2K,
+		HashAlgo:   kdfHashSHA256,
+		Iterations: kdfIterations,
+	}
+
+	for _, salt := range []*[]byte{&kdf.SaltPW1, &kdf.SaltRC, &kdf.SaltPW3} {
+		*salt = make([]byte, kdfSaltLength)
+		if _, err := rand.Read(*salt); err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+
+	if kdf.InitialPW1, err = kdf.derivePIN(1, []byte(defaultPIN)); err != nil {
+		return nil, err
+	}
+
+	if kdf.InitialPW3, err = kdf.derivePIN(3, []byte(defaultAdminPIN)); err != nil {
+		return nil, err
+	}
+
+	return kdf, nil
+}
+
+// SetKDF enables or disables hashing of PINs with a KDF. Writing the KDF data
+// object resets the PIN and admin PIN to their defaults, which must be changed
+// afterwards. The admin PIN must be verified.
+func (yk *YubiKey) SetKDF(enable bool) error {
+	if err := yk.BeginTransaction(); err != nil {
+		return err
+	}
+
+	defer yk.EndTransaction()
+
+	kdf := &KDF{Algo: KDFAlgoNone}
+
+	if enable {
+		var err error
+
+		if kdf, err = newKDF(); err != nil {
+			return err
+		}
+	}
+
+	if err := PutData(yk.Card, doKDFDO.tag, kdf.serialize()); err != nil {
+		return err
+	}
+
+	yk.PINCache = [3][]byte{}
+
+	if err := yk.refreshKDF(); err != nil {
+		return err
+	}
+
+	return yk.refreshAppRelatedData()
+}
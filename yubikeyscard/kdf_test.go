@@ -0,0 +1,50 @@
+package yubikeyscard
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDerivePINSalts(t *testing.T) {
+	kdf := &KDF{
+		Algo:       KDFAlgoIterSaltedS2K,
+		HashAlgo:   kdfHashSHA256,
+		Iterations: 100000,
+		SaltPW1:    []byte("pw1_salt"),
+	}
+
+	pin := []byte("12345678")
+
+	pw1, err := kdf.derivePIN(1, pin)
+	if err != nil {
+		t.Fatalf("derivePIN() error = %v", err)
+	}
+
+	// without their own salts, the admin PIN and reset code use the PW1 salt
+	for _, bank := range []uint8{3, resetCodeBank} {
+		got, err := kdf.derivePIN(bank, pin)
+		if err != nil {
+			t.Fatalf("derivePIN(%d) error = %v", bank, err)
+		}
+
+		if !bytes.Equal(got, pw1) {
+			t.Errorf("derivePIN(%d) = %x, want %x", bank, got, pw1)
+		}
+	}
+
+	kdf.SaltPW3 = []byte("pw3_salt")
+
+	pw3, err := kdf.derivePIN(3, pin)
+	if err != nil {
+		t.Fatalf("derivePIN(3) error = %v", err)
+	}
+
+	if bytes.Equal(pw3, pw1) {
+		t.Error("derivePIN(3) did not use the PW3 salt")
+	}
+
+	kdf.SaltPW1 = nil
+	if _, err := kdf.derivePIN(1, pin); err == nil {
+		t.Error("derivePIN(1) without salt succeeded")
+	}
+}
@@ -0,0 +1,215 @@
+package yubikeyscard
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// keySlotDOs holds the tags of the data objects that describe a key slot.
+type keySlotDOs struct {
+	algoAttr    uint16
+	fingerprint uint16
+	genDate     uint16
+	uif         uint16
+}
+
+var keySlotTags = map[KeySlot]keySlotDOs{
+	KeySlotSign: {0xc1, 0xc7, 0xce, 0xd6},
+	KeySlotEnc:  {0xc2, 0xc8, 0xcf, 0xd7},
+	KeySlotAuth: {0xc3, 0xc9, 0xd0, 0xd8},
+}
+
+// KeySlotByName returns the key slot with the provided name, either the short
+// form sign, enc or auth, or the full name of the slot.
+func KeySlotByName(name string) (KeySlot, error) {
+	switch strings.ToLower(name) {
+	case "sign", "sig", "signature":
+		return KeySlotSign, nil
+	case "enc", "encryption", "decryption":
+		return KeySlotEnc, nil
+	case "auth", "aut", "authentication":
+		return KeySlotAuth, nil
+	}
+
+	return 0, fmt.Errorf("unknown key slot '%s', expected sign, enc or auth", name)
+}
+
+// AlgoAttrByName returns the algorithm attributes for the GnuPG style
+// algorithm name, such as rsa4096, cv25519 or nistp384, in the provided key
+// slot. Curve25519 keys are ECDH keys in the encryption slot and Ed25519 keys
+// in the other slots.
+func AlgoAttrByName(name string, slot KeySlot) (AlgoAttr, error) {
+	var aa AlgoAttr
+
+	name = strings.ToLower(name)
+
+	switch name {
+	case "rsa2048", "rsa3072", "rsa4096":
+		var bits uint16
+		fmt.Sscanf(name, "rsa%d", &bits)
+
+		aa.ID = AlgoIdRSA
+		binary.BigEndian.PutUint16(aa.RSAModLen[:], bits)
+		binary.BigEndian.PutUint16(aa.RSAPubKeyExpLen[:], 17)
+
+		return aa, nil
+	case "cv25519", "ed25519":
+		if slot == KeySlotEnc {
+			aa.ID = AlgoIdECDH
+			aa.ECurveOID = CurveCv25519.OID
+		} else {
+			aa.ID = AlgoIdEdDSA
+			aa.ECurveOID = CurveEd25519.OID
+		}
+
+		return aa, nil
+	}
+
+	for _, c := range Curves {
+		if c.Name != name || c.Bits == 255 {
+			continue
+		}
+
+		aa.ID = AlgoIdECDSA
+		if slot == KeySlotEnc {
+			aa.ID = AlgoIdECDH
+		}
+		aa.ECurveOID = c.OID
+
+		return aa, nil
+	}
+
+	return aa, fmt.Errorf("unsupported key algorithm '%s'", name)
+}
+
+// serialize serializes the algorithm attributes as written to the card.
+func (aa *AlgoAttr) serialize() []byte {
+	b := []byte{aa.ID}
+
+	if aa.ID == AlgoIdRSA {
+		b = append(b, aa.RSAModLen[:]...)
+		b = append(b, aa.RSAPubKeyExpLen[:]...)
+
+		return append(b, aa.PrivKeyImpFmt)
+	}
+
+	b = append(b, aa.ECurveOID...)
+	if aa.PrivKeyImpFmt == 0xff {
+		b = append(b, 0xff)
+	}
+
+	return b
+}
+
+// GenerateKeyPair generates a new key pair in the key slot with the provided
+// algorithm attributes and returns the public key. The admin PIN must be
+// verified. Any key in the slot is replaced, and the fingerprint and
+// generation time must be written with SetKeyInfo afterwards.
+func (yk *YubiKey) GenerateKeyPair(slot KeySlot, attr AlgoAttr) (*PublicKey, error) {
+	if err := yk.CheckKeyGeneration(slot, attr); err != nil {
+		return nil, err
+	}
+
+	if err := yk.BeginTransaction(); err != nil {
+		return nil, err
+	}
+
+	defer yk.EndTransaction()
+
+	if _, err := yk.setAlgoAttr(slot, attr); err != nil {
+		return nil, err
+	}
+
+	ca := commandAPDU{
+		cla:  0,
+		ins:  0x47,
+		p1:   0x80,
+		p2:   0,
+		data: []byte{uint8(slot), 0},
+		le:   leMax, // RSA 4096 public keys exceed 256 bytes
+	}
+
+	ra, err := ca.transmit(yk.Card)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ra.success() {
+		if ra.sw1 == 0x69 && ra.sw2 == 0x82 {
+			return nil, errors.New("security status not satisfied, admin PIN must be verified")
+		}
+
+		return nil, fmt.Errorf("could not generate %s key (status %02x%02x)", slot, ra.sw1, ra.sw2)
+	}
+
+	pk, err := parsePublicKeyTemplate(ra.data)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := yk.refreshAppRelatedData(); err != nil {
+		return nil, err
+	}
+
+	return pk, nil
+}
+
+// setAlgoAttr changes the algorithm of the key slot and returns the algorithm
+// attributes reported by the card afterwards. The private key import format of
+// the slot is kept if the algorithm family does not change.
+func (yk *YubiKey) setAlgoAttr(slot KeySlot, attr AlgoAttr) (AlgoAttr, error) {
+	tags, ok := keySlotTags[slot]
+	if !ok {
+		return attr, fmt.Errorf("unknown key slot %02x", uint8(slot))
+	}
+
+	current, _, _ := yk.AppRelatedData.Key(slot)
+	if (attr.ID == AlgoIdRSA) == (current.ID == AlgoIdRSA) {
+		attr.PrivKeyImpFmt = current.PrivKeyImpFmt
+		if attr.ID == AlgoIdRSA {
+			attr.RSAPubKeyExpLen = current.RSAPubKeyExpLen
+		}
+	}
+
+	if err := PutData(yk.Card, tags.algoAttr, attr.serialize()); err != nil {
+		return attr, fmt.Errorf("could not set %s key algorithm to %s: %s", slot, attr.Name(), err)
+	}
+
+	if err := yk.refreshAppRelatedData(); err != nil {
+		return attr, err
+	}
+
+	attr, _, _ = yk.AppRelatedData.Key(slot)
+
+	return attr, nil
+}
+
+// SetKeyInfo writes the OpenPGP fingerprint and generation time of the key in
+// the key slot, which cards do not compute themselves. The admin PIN must be
+// verified.
+func (yk *YubiKey) SetKeyInfo(slot KeySlot, fp [20]byte, created time.Time) error {
+	if err := yk.BeginTransaction(); err != nil {
+		return err
+	}
+
+	defer yk.EndTransaction()
+
+	tags, ok := keySlotTags[slot]
+	if !ok {
+		return fmt.Errorf("unknown key slot %02x", uint8(slot))
+	}
+
+	if err := PutData(yk.Card, tags.fingerprint, fp[:]); err != nil {
+		return err
+	}
+
+	date := binary.BigEndian.AppendUint32(nil, uint32(created.Unix()))
+	if err := PutData(yk.Card, tags.genDate, date); err != nil {
+		return err
+	}
+
+	return yk.refreshAppRelatedData()
+}
@@ -0,0 +1,92 @@
+package yubikeyscard
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// ManufacturerYubico is the manufacturer ID of Yubico in the AID. Only cards of
+// Yubico are connected unless other manufacturers are allowed.
+var ManufacturerYubico = [2]byte{0x00, 0x06}
+
+// manufacturers maps the manufacturer IDs registered for the OpenPGP card AID
+// to their names.
+var manufacturers = map[[2]byte]string{
+	{0x00, 0x00}: "test card",
+	{0x00, 0x01}: "PPC Card Systems",
+	{0x00, 0x02}: "Prism",
+	{0x00, 0x03}: "OpenFortress",
+	{0x00, 0x04}: "Wewid",
+	{0x00, 0x05}: "ZeitControl",
+	{0x00, 0x06}: "Yubico",
+	{0x00, 0x07}: "OpenKMS",
+	{0x00, 0x08}: "LogoEmail",
+	{0x00, 0x09}: "Fidesmo",
+	{0x00, 0x0a}: "VivoKey",
+	{0x00, 0x0b}: "Feitian Technologies",
+	{0x00, 0x0d}: "Dangerous Things",
+	{0x00, 0x0e}: "Excelsecu",
+	{0x00, 0x0f}: "Nitrokey",
+	{0x00, 0x10}: "NeoPGP",
+	{0x00, 0x11}: "Token2",
+	{0x00, 0x2a}: "Magrathea",
+	{0x00, 0x42}: "GnuPG e.V.",
+	{0x13, 0x37}: "Warsaw Hackerspace",
+	{0x23, 0x42}: "warpzone",
+	{0x43, 0x54}: "Confidential Technologies",
+	{0x54, 0x43}: "TIF-IT e.V.",
+	{0x63, 0xaf}: "Trustica",
+	{0xba, 0x53}: "c-base e.V.",
+	{0xbd, 0x0e}: "Paranoidlabs",
+	{0xf1, 0xd0}: "CanoKeys",
+	{0xf5, 0x17}: "FSIJ",
+	{0xf5, 0xec}: "F-Secure",
+	{0xff, 0xff}: "test card",
+}
+
+// ManufacturerName returns the name of the manufacturer of the card, or the
+// hex manufacturer ID if the manufacturer is not registered.
+func (aid *AID) ManufacturerName() string {
+	if name, ok := manufacturers[aid.Manufacturer]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("unknown (%x)", aid.Manufacturer)
+}
+
+// ParseManufacturer returns the manufacturer ID for a manufacturer name, such
+// as "Nitrokey", or a 4 digit hex manufacturer ID, such as "f517".
+func ParseManufacturer(s string) ([2]byte, error) {
+	var id [2]byte
+
+	for m, name := range manufacturers {
+		if name != "test card" && strings.EqualFold(s, name) {
+			return m, nil
+		}
+	}
+
+	b, err := hex.DecodeString(strings.TrimPrefix(strings.ToLower(s), "0x"))
+	if err != nil || len(b) != len(id) {
+		return id, fmt.Errorf("unknown card manufacturer '%s', use a name or a 4 digit hex ID", s)
+	}
+
+	copy(id[:], b)
+
+	return id, nil
+}
+
+// allowManufacturer reports whether cards of the manufacturer are connected.
+func (yks *YubiKeys) allowManufacturer(id [2]byte) bool {
+	if len(yks.Manufacturers) == 0 {
+		return id == ManufacturerYubico
+	}
+
+	for _, m := range yks.Manufacturers {
+		if m == id {
+			return true
+		}
+	}
+
+	return false
+}
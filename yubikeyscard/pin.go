@@ -0,0 +1,179 @@
+package yubikeyscard
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Minimum PIN lengths required by the OpenPGP card specification.
+const (
+	pw1MinLength       = 6
+	pw3MinLength       = 8
+	resetCodeMinLength = 8
+)
+
+// resetCodeBank identifies the reset code when looking up retry counters, the
+// reset code has no PIN bank of its own.
+const resetCodeBank = 0
+
+// pinFormatBlock2 is set in the max. length and format bytes of PW1 and PW3 if
+// the card expects PINs in the format 2 PIN block instead of UTF-8.
+const pinFormatBlock2 = 0x80
+
+// MaxPINLength returns the maximum length of the PIN of the provided bank, 1 or
+// 2 for the user PIN (PW1) and 3 for the admin PIN (PW3), as reported by the
+// card.
+func (pws *PWStatus) MaxPINLength(bank uint8) int {
+	if bank == 3 {
+		return int(pws.PW3MaxLenFmt &^ pinFormatBlock2)
+	}
+
+	return int(pws.PW1MaxLenFmt &^ pinFormatBlock2)
+}
+
+// checkPINLength checks that the new PIN for the provided bank is within the
+// minimum length of the specification and the maximum length of the card.
+func (pws *PWStatus) checkPINLength(bank uint8, pin []byte) error {
+	name, minLen, format := "PIN", pw1MinLength, pws.PW1MaxLenFmt
+	if bank == 3 {
+		name, minLen, format = "admin PIN", pw3MinLength, pws.PW3MaxLenFmt
+	}
+
+	if format&pinFormatBlock2 != 0 {
+		return errors.New("cards expecting PINs in PIN block format 2 are not supported")
+	}
+
+	return checkLength(name, pin, minLen, pws.MaxPINLength(bank))
+}
+
+// checkLength checks that the length of a PIN or reset code is within range.
+func checkLength(name string, pin []byte, minLen int, maxLen int) error {
+	if len(pin) < minLen || len(pin) > maxLen {
+		return fmt.Errorf("expected %s length of %d-%d characters", name, minLen, maxLen)
+	}
+
+	return nil
+}
+
+// VerifyPIN verifies the PIN for the provided bank, hashing it first if the
+// card has KDF enabled. VerifyPIN will return the number of tries remaining,
+// or -1 if an error other than an invalid PIN occurs.
+func (yk *YubiKey) VerifyPIN(bank uint8, pin []byte) (int, error) {
+	pin, err := yk.KDF.derivePIN(bank, pin)
+	if err != nil {
+		return -1, err
+	}
+
+	return Verify(yk.Card, bank, pin)
+}
+
+// ChangePIN replaces the PIN of the provided bank, 1 for the user PIN (PW1) or
+// 3 for the admin PIN (PW3). The length of the new PIN is checked against the
+// limits reported by the card before the current PIN is sent. ChangePIN will
+// return the number of tries remaining if the current PIN is incorrect,
+// otherwise -1.
+func (yk *YubiKey) ChangePIN(bank uint8, pin []byte, newPIN []byte) (int, error) {
+	if err := yk.BeginTransaction(); err != nil {
+		return -1, err
+	}
+
+	defer yk.EndTransaction()
+
+	if err := yk.AppRelatedData.PWStatus.checkPINLength(bank, newPIN); err != nil {
+		return -1, err
+	}
+
+	pin, err := yk.KDF.derivePIN(bank, pin)
+	if err != nil {
+		return -1, err
+	}
+
+	if newPIN, err = yk.KDF.derivePIN(bank, newPIN); err != nil {
+		return -1, err
+	}
+
+	retries, err := ChangeReferenceData(yk.Card, bank, pin, newPIN)
+	if err != nil {
+		yk.refreshAppRelatedData()
+		return retries, err
+	}
+
+	// PW1 is shared by banks 1 and 2, cached PINs are now stale
+	if bank == 3 {
+		yk.SetCachedPIN(3, nil)
+	} else {
+		yk.SetCachedPIN(1, nil)
+		yk.SetCachedPIN(2, nil)
+	}
+
+	return -1, yk.refreshAppRelatedData()
+}
+
+// SetResetCode sets the resetting code, which allows the user PIN to be
+// unblocked without the admin PIN. The length of the reset code is checked
+// against the limit reported by the card. The admin PIN must be verified.
+func (yk *YubiKey) SetResetCode(rc []byte) error {
+	if err := yk.BeginTransaction(); err != nil {
+		return err
+	}
+
+	defer yk.EndTransaction()
+
+	if yk.AppRelatedData.PWStatus.PW1MaxLenRC == 0 {
+		return errors.New("card does not support a reset code")
+	}
+
+	if err := checkLength("reset code", rc, resetCodeMinLength, int(yk.AppRelatedData.PWStatus.PW1MaxLenRC)); err != nil {
+		return err
+	}
+
+	rc, err := yk.KDF.derivePIN(resetCodeBank, rc)
+	if err != nil {
+		return err
+	}
+
+	if err := PutData(yk.Card, 0xd3, rc); err != nil {
+		return err
+	}
+
+	return yk.refreshAppRelatedData()
+}
+
+// UnblockPIN sets a new user PIN (PW1) and resets its retry counter, which
+// unblocks a PIN that ran out of retries. The reset code authenticates the
+// request, or if rc is nil, the admin PIN must be verified. UnblockPIN will
+// return the number of tries remaining if the reset code is incorrect,
+// otherwise -1.
+func (yk *YubiKey) UnblockPIN(rc []byte, newPIN []byte) (int, error) {
+	if err := yk.BeginTransaction(); err != nil {
+		return -1, err
+	}
+
+	defer yk.EndTransaction()
+
+	if err := yk.AppRelatedData.PWStatus.checkPINLength(1, newPIN); err != nil {
+		return -1, err
+	}
+
+	newPIN, err := yk.KDF.derivePIN(1, newPIN)
+	if err != nil {
+		return -1, err
+	}
+
+	if rc != nil {
+		if rc, err = yk.KDF.derivePIN(resetCodeBank, rc); err != nil {
+			return -1, err
+		}
+	}
+
+	retries, err := ResetRetryCounter(yk.Card, rc, newPIN)
+	if err != nil {
+		yk.refreshAppRelatedData()
+		return retries, err
+	}
+
+	yk.SetCachedPIN(1, nil)
+	yk.SetCachedPIN(2, nil)
+
+	return -1, yk.refreshAppRelatedData()
+}
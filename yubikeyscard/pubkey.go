@@ -0,0 +1,108 @@
+package yubikeyscard
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// KeySlot identifies a key slot of the OpenPGP application by the tag of its
+// control reference template.
+type KeySlot uint8
+
+const (
+	KeySlotSign KeySlot = 0xb6
+	KeySlotEnc  KeySlot = 0xb8
+	KeySlotAuth KeySlot = 0xa4
+)
+
+// KeySlots lists the key slots in the order of the fingerprint and generation
+// date data objects.
+var KeySlots = []KeySlot{KeySlotSign, KeySlotEnc, KeySlotAuth}
+
+// String returns the name of the key slot.
+func (s KeySlot) String() string {
+	switch s {
+	case KeySlotSign:
+		return "signature"
+	case KeySlotEnc:
+		return "encryption"
+	case KeySlotAuth:
+		return "authentication"
+	}
+
+	return fmt.Sprintf("unknown slot %02x", uint8(s))
+}
+
+// PublicKey is the public key material of a key slot. RSA keys consist of the
+// modulus and public exponent, elliptic curve keys of the public point.
+type PublicKey struct {
+	Modulus  []byte
+	Exponent []byte
+	Point    []byte
+}
+
+// ReadPublicKey reads the public key of the key slot using GENERATE ASYMMETRIC
+// KEY PAIR in read mode, which leaves the key on the card unchanged.
+func ReadPublicKey(card Transport, slot KeySlot) (*PublicKey, error) {
+	ca := commandAPDU{
+		cla:  0,
+		ins:  0x47,
+		p1:   0x81,
+		p2:   0,
+		data: []byte{uint8(slot), 0},
+		le:   leMax, // RSA 4096 public keys exceed 256 bytes
+	}
+
+	ra, err := ca.transmit(card)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ra.success() {
+		return nil, fmt.Errorf("could not read public key of %s slot", slot)
+	}
+
+	return parsePublicKeyTemplate(ra.data)
+}
+
+// parsePublicKeyTemplate parses the public key template (7F49) returned by key
+// generation.
+func parsePublicKeyTemplate(data []byte) (*PublicKey, error) {
+	tmpl := findTLV(data, 0x7f49)
+	if tmpl == nil {
+		return nil, errors.New("public key template not found in card response")
+	}
+
+	pk := &PublicKey{
+		Modulus:  findTLV(tmpl, 0x81),
+		Exponent: findTLV(tmpl, 0x82),
+		Point:    findTLV(tmpl, 0x86),
+	}
+
+	if pk.Point == nil && (pk.Modulus == nil || pk.Exponent == nil) {
+		return nil, errors.New("public key template does not contain a public key")
+	}
+
+	return pk, nil
+}
+
+// Key returns the algorithm attributes, fingerprint and generation time of the
+// key in the provided slot.
+func (ard *AppRelatedData) Key(slot KeySlot) (attr AlgoAttr, fp [20]byte, created time.Time) {
+	var date [4]byte
+
+	switch slot {
+	case KeySlotSign:
+		attr, fp, date = ard.AlgoAttrSign, ard.Fingerprints.Sign, ard.KeyGenDates.Sign
+	case KeySlotEnc:
+		attr, fp, date = ard.AlgoAttrEnc, ard.Fingerprints.Enc, ard.KeyGenDates.Enc
+	case KeySlotAuth:
+		attr, fp, date = ard.AlgoAttrAuth, ard.Fingerprints.Auth, ard.KeyGenDates.Auth
+	}
+
+	created = time.Unix(int64(binary.BigEndian.Uint32(date[:])), 0)
+
+	return
+}
@@ -0,0 +1,272 @@
+package yubikeyscard
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// traceEntry is a single command and response APDU exchange in a trace. Each
+// entry is written as one line of JSON. Exchanges that failed record the
+// transport error instead of a response.
+type traceEntry struct {
+	Reader   string `json:"reader"`
+	Command  string `json:"command"`
+	Response string `json:"response"`
+	Error    string `json:"error,omitempty"`
+	Redacted bool   `json:"redacted,omitempty"`
+}
+
+// Tracer records the APDUs exchanged with smart cards. A single tracer may be
+// shared by the transports of several cards.
+type Tracer struct {
+	mu       sync.Mutex
+	w        io.WriteCloser
+	enc      *json.Encoder
+	err      error           // first error writing the trace, reported on Close
+	decipher map[string]bool // readers whose PSO:DECIPHER response continues with GET RESPONSE
+}
+
+// CreateTrace creates or truncates the trace file at the provided path and
+// returns a tracer writing to it.
+func CreateTrace(path string) (*Tracer, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return newTracer(f), nil
+}
+
+func newTracer(w io.WriteCloser) *Tracer {
+	return &Tracer{w: w, enc: json.NewEncoder(w), decipher: make(map[string]bool)}
+}
+
+// Wrap returns a transport that records every exchange over t.
+func (tr *Tracer) Wrap(t Transport) Transport {
+	return &traceTransport{Transport: t, tracer: tr}
+}
+
+// Close closes the underlying trace file. Errors writing the trace, which do
+// not interrupt the exchanges with the cards, are reported here.
+func (tr *Tracer) Close() error {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	err := tr.w.Close()
+	if tr.err != nil {
+		return fmt.Errorf("could not write APDU trace: %s", tr.err)
+	}
+
+	return err
+}
+
+// record writes an exchange to the trace. The response data of PSO:DECIPHER
+// is redacted, including the parts the card returns with GET RESPONSE.
+func (tr *Tracer) record(reader string, cmd, rsp []byte, txErr error) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	secret := isDecipher(cmd) || (isGetResponse(cmd) && tr.decipher[reader])
+	tr.decipher[reader] = secret && len(rsp) >= 2 && rsp[len(rsp)-2] == 0x61
+
+	cmd, rsp, redacted := redact(cmd, rsp, secret)
+
+	e := traceEntry{
+		Reader:   reader,
+		Command:  hex.EncodeToString(cmd),
+		Response: hex.EncodeToString(rsp),
+		Redacted: redacted,
+	}
+
+	if txErr != nil {
+		e.Error = txErr.Error()
+	}
+
+	if err := tr.enc.Encode(e); err != nil && tr.err == nil {
+		tr.err = err
+	}
+}
+
+// traceTransport records the exchanges of the wrapped transport.
+type traceTransport struct {
+	Transport
+	tracer *Tracer
+}
+
+// Transmit sends the command APDU over the wrapped transport and records the
+// exchange, whether or not it succeeded.
+func (t *traceTransport) Transmit(cmd []byte) ([]byte, error) {
+	rsp, err := t.Transport.Transmit(cmd)
+	t.tracer.record(t.Reader(), cmd, rsp, err)
+
+	return rsp, err
+}
+
+// BeginTransaction starts a transaction on the wrapped transport.
+func (t *traceTransport) BeginTransaction() error {
+	return beginTransaction(t.Transport)
+}
+
+// EndTransaction ends a transaction on the wrapped transport.
+func (t *traceTransport) EndTransaction() error {
+	return endTransaction(t.Transport)
+}
+
+// redact replaces secrets in an exchange with zeros, keeping their length. The
+// command data of PIN operations, reset codes and key imports are redacted, and
+// the response data if secretResponse is set, as for PSO:DECIPHER, which
+// carries the session key.
+func redact(cmd, rsp []byte, secretResponse bool) ([]byte, []byte, bool) {
+	if secretResponse && len(rsp) > 2 {
+		zeroed := make([]byte, len(rsp))
+		copy(zeroed[len(rsp)-2:], rsp[len(rsp)-2:])
+
+		return cmd, zeroed, true
+	}
+
+	if len(cmd) < 4 {
+		return cmd, rsp, false
+	}
+
+	switch {
+	case cmd[1] == 0x20, cmd[1] == 0x24, cmd[1] == 0x2c, cmd[1] == 0xdb, // VERIFY, CHANGE REFERENCE DATA, RESET RETRY COUNTER, PUT DATA (key import)
+		cmd[1] == 0xda && cmd[2] == 0x00 && cmd[3] == 0xd3: // PUT DATA (reset code)
+		start, end := commandData(cmd)
+
+		zeroed := append([]byte{}, cmd...)
+		for i := start; i < end; i++ {
+			zeroed[i] = 0
+		}
+
+		return zeroed, rsp, true
+	}
+
+	return cmd, rsp, false
+}
+
+// isDecipher reports whether the command APDU is a PSO:DECIPHER.
+func isDecipher(cmd []byte) bool {
+	return len(cmd) >= 4 && cmd[1] == 0x2a && cmd[2] == 0x80 && cmd[3] == 0x86
+}
+
+// isGetResponse reports whether the command APDU is a GET RESPONSE.
+func isGetResponse(cmd []byte) bool {
+	return len(cmd) >= 2 && cmd[1] == 0xc0
+}
+
+// commandData returns the offsets of the data in a serialized command APDU,
+// which follows a 1 byte Lc field in short APDUs and a 3 byte Lc field in
+// extended length APDUs. Commands without data return an empty range.
+func commandData(cmd []byte) (int, int) {
+	switch {
+	case len(cmd) <= 5: // no data, short Le
+		return len(cmd), len(cmd)
+	case cmd[4] != 0: // short Lc
+		return 5, min(5+int(cmd[4]), len(cmd))
+	case len(cmd) <= 7: // no data, extended Le
+		return len(cmd), len(cmd)
+	}
+
+	n := int(cmd[5])<<8 | int(cmd[6])
+
+	return 7, min(7+n, len(cmd))
+}
+
+// Replay is a Transport that serves the responses of a recorded trace back in
+// order. Commands must match the recorded commands, apart from data that was
+// redacted when recording.
+type Replay struct {
+	reader  string
+	entries []traceEntry
+	pos     int
+}
+
+// ReadTrace reads an APDU trace and returns a replay transport for each reader
+// in the order the readers first appear in the trace.
+func ReadTrace(r io.Reader) ([]*Replay, error) {
+	var replays []*Replay
+	byReader := make(map[string]*Replay)
+
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 1<<20)
+
+	for line := 1; s.Scan(); line++ {
+		if len(bytes.TrimSpace(s.Bytes())) == 0 {
+			continue
+		}
+
+		var e traceEntry
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("invalid APDU trace entry on line %d: %s", line, err)
+		}
+
+		rp, ok := byReader[e.Reader]
+		if !ok {
+			rp = &Replay{reader: e.Reader}
+			byReader[e.Reader] = rp
+			replays = append(replays, rp)
+		}
+
+		rp.entries = append(rp.entries, e)
+	}
+
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(replays) == 0 {
+		return nil, errors.New("APDU trace contains no exchanges")
+	}
+
+	return replays, nil
+}
+
+// Transmit returns the recorded response for the next exchange in the trace.
+func (rp *Replay) Transmit(cmd []byte) ([]byte, error) {
+	if rp.pos >= len(rp.entries) {
+		return nil, fmt.Errorf("replay of reader '%s' exhausted after %d exchanges", rp.reader, rp.pos)
+	}
+
+	e := rp.entries[rp.pos]
+
+	recorded, err := hex.DecodeString(e.Command)
+	if err != nil {
+		return nil, err
+	}
+
+	// only the header of redacted commands can be compared
+	match := bytes.Equal(cmd, recorded)
+	if e.Redacted && len(cmd) >= 4 && len(recorded) >= 4 {
+		match = bytes.Equal(cmd[:4], recorded[:4])
+	}
+
+	if !match {
+		return nil, fmt.Errorf("replay of reader '%s' diverged at exchange %d: sent %x, recorded %s",
+			rp.reader, rp.pos+1, cmd, e.Command)
+	}
+
+	rp.pos++
+
+	if e.Error != "" {
+		return nil, errors.New(e.Error)
+	}
+
+	return hex.DecodeString(e.Response)
+}
+
+// Disconnect ends the replay. Remaining exchanges are left unserved.
+func (rp *Replay) Disconnect() error {
+	return nil
+}
+
+// Reader returns the name of the reader recorded in the trace.
+func (rp *Replay) Reader() string {
+	return rp.reader
+}
@@ -0,0 +1,314 @@
+package yubikeyscard
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		name     string
+		cmd      string
+		want     string
+		redacted bool
+	}{
+		{
+			name:     "verify",
+			cmd:      "0020008206313233343536",
+			want:     "0020008206000000000000",
+			redacted: true,
+		},
+		{
+			name:     "verify status",
+			cmd:      "00200082",
+			want:     "00200082",
+			redacted: true,
+		},
+		{
+			name:     "change reference data",
+			cmd:      "002400810e3132333435363132333435363738",
+			want:     "002400810e0000000000000000000000000000",
+			redacted: true,
+		},
+		{
+			name:     "extended length key import",
+			cmd:      "00db3fff000005" + "4d03b60000",
+			want:     "00db3fff000005" + "0000000000",
+			redacted: true,
+		},
+		{
+			name:     "extended length key import with Le",
+			cmd:      "00db3fff000003" + "4d0300" + "0000",
+			want:     "00db3fff000003" + "000000" + "0000",
+			redacted: true,
+		},
+		{
+			name:     "chained key import",
+			cmd:      "10db3fff03" + "4d8201",
+			want:     "10db3fff03" + "000000",
+			redacted: true,
+		},
+		{
+			name:     "reset code",
+			cmd:      "00da00d308" + "3132333435363738",
+			want:     "00da00d308" + "0000000000000000",
+			redacted: true,
+		},
+		{
+			name: "get data",
+			cmd:  "00ca006e00",
+			want: "00ca006e00",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd, _ := hex.DecodeString(tt.cmd)
+			want, _ := hex.DecodeString(tt.want)
+
+			got, _, redacted := redact(cmd, nil, false)
+			if !bytes.Equal(got, want) || redacted != tt.redacted {
+				t.Errorf("redact() = %x, %v, want %x, %v", got, redacted, want, tt.redacted)
+			}
+		})
+	}
+}
+
+// nopWriteCloser is a trace file backed by a buffer, or failing writes if err
+// is set.
+type nopWriteCloser struct {
+	bytes.Buffer
+	err error
+}
+
+func (w *nopWriteCloser) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	return w.Buffer.Write(p)
+}
+
+func (w *nopWriteCloser) Close() error {
+	return nil
+}
+
+// recordTrace records the exchanges with a tracer and returns the trace
+// entries.
+func recordTrace(t *testing.T, exchanges [][2]string) []traceEntry {
+	t.Helper()
+
+	w := new(nopWriteCloser)
+	tr := newTracer(w)
+
+	for _, x := range exchanges {
+		cmd, _ := hex.DecodeString(x[0])
+		rsp, _ := hex.DecodeString(x[1])
+		tr.record("reader", cmd, rsp, nil)
+	}
+
+	if err := tr.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	replays, err := ReadTrace(&w.Buffer)
+	if err != nil {
+		t.Fatalf("ReadTrace() error = %v", err)
+	}
+
+	return replays[0].entries
+}
+
+func TestRedactDecipher(t *testing.T) {
+	tests := []struct {
+		name      string
+		exchanges [][2]string
+		want      []string
+	}{
+		{
+			name:      "direct response",
+			exchanges: [][2]string{{"002a808601" + "00", "0102039000"}},
+			want:      []string{"0000009000"},
+		},
+		{
+			name: "get response",
+			exchanges: [][2]string{
+				{"002a808601" + "00", "0102036102"},
+				{"00c0000002", "04056101"},
+				{"00c0000001", "069000"},
+				{"00ca006e00", "0102039000"},
+			},
+			want: []string{"0000006102", "00006101", "009000", "0102039000"},
+		},
+		{
+			name: "get response after other command",
+			exchanges: [][2]string{
+				{"002a808601" + "00", "0102039000"},
+				{"00ca7f2100", "0102036102"},
+				{"00c0000002", "04059000"},
+			},
+			want: []string{"0000009000", "0102036102", "04059000"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries := recordTrace(t, tt.exchanges)
+
+			for i, e := range entries {
+				if e.Response != tt.want[i] {
+					t.Errorf("exchange %d response = %s, want %s", i+1, e.Response, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestTraceErrors(t *testing.T) {
+	w := new(nopWriteCloser)
+	tr := newTracer(w)
+
+	card := tr.Wrap(&Replay{reader: "reader", entries: []traceEntry{
+		{Reader: "reader", Command: "00ca006e00", Error: "card removed"},
+	}})
+
+	// failed exchanges are recorded with their error
+	if _, err := card.Transmit([]byte{0x00, 0xca, 0x00, 0x6e, 0x00}); err == nil {
+		t.Fatal("Transmit() of failed exchange succeeded")
+	}
+
+	if !strings.Contains(w.String(), `"error":"card removed"`) {
+		t.Errorf("trace = %s, want the transport error", w.String())
+	}
+
+	// errors writing the trace do not replace the response and are reported
+	// on Close
+	w.err = errors.New("disk full")
+	card = tr.Wrap(&Replay{reader: "reader", entries: []traceEntry{
+		{Reader: "reader", Command: "00ca006e00", Response: "9000"},
+	}})
+
+	if rsp, err := card.Transmit([]byte{0x00, 0xca, 0x00, 0x6e, 0x00}); err != nil || !bytes.Equal(rsp, []byte{0x90, 0x00}) {
+		t.Errorf("Transmit() = %x, %v, want 9000", rsp, err)
+	}
+
+	if err := tr.Close(); err == nil || !strings.Contains(err.Error(), "disk full") {
+		t.Errorf("Close() error = %v, want the write error", err)
+	}
+}
+
+// TestReplayTraces replays traces recorded from the simulated card, which
+// connect, read the encryption public key and verify a wrong and the correct
+// PIN, and checks the parsed application related data. The card capabilities
+// are unknown until the application related data has been read, so it is read
+// with a short Le and GET RESPONSE on both cards. Later long responses are
+// read with an extended Le if the card supports it.
+func TestReplayTraces(t *testing.T) {
+	tests := []struct {
+		file           string
+		extendedLength bool
+		maxCmdLength   uint16
+	}{
+		{"testdata/sim_extended.jsonl", true, 0x800},
+		{"testdata/sim_short.jsonl", false, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			rp := readTraceFile(t, tt.file)
+
+			yks := new(YubiKeys)
+			yk, err := yks.Attach(rp)
+			if err != nil {
+				t.Fatalf("Attach() error = %v", err)
+			}
+
+			ard := yk.AppRelatedData
+
+			if got := hex.EncodeToString(ard.AID.Serial[:]); got != "48c517ee" {
+				t.Errorf("serial = %s, want 48c517ee", got)
+			}
+
+			if ard.AID.Version != [2]byte{3, 4} || ard.AID.ManufacturerName() != "Yubico" {
+				t.Errorf("version %v, manufacturer %s, want [3 4], Yubico", ard.AID.Version, ard.AID.ManufacturerName())
+			}
+
+			if got := ard.AlgoAttrEnc.Name(); got != "rsa2048" {
+				t.Errorf("encryption key algorithm = %s, want rsa2048", got)
+			}
+
+			if got := hex.EncodeToString(ard.Fingerprints.Enc[:]); got != "9e02be646dc99841476063a5c277a37e48c517ee" {
+				t.Errorf("encryption key fingerprint = %s", got)
+			}
+
+			if ard.Fingerprints.Sign != [20]byte{} || ard.Fingerprints.Auth != [20]byte{} {
+				t.Error("signature and authentication key slots are not empty")
+			}
+
+			if ard.PWStatus.PW1RetryCtr != 3 || ard.PWStatus.PW3RetryCtr != 3 {
+				t.Errorf("PIN retries = %d, %d, want 3, 3", ard.PWStatus.PW1RetryCtr, ard.PWStatus.PW3RetryCtr)
+			}
+
+			caps := ard.CardCaps
+			if !caps.CommandChaining || caps.ExtendedLength != tt.extendedLength || caps.MaxCommandLength != tt.maxCmdLength {
+				t.Errorf("card capabilities = %+v", caps)
+			}
+
+			if !ard.ExtCaps.KeyImport || !ard.ExtCaps.KDF || !ard.Features.Button {
+				t.Errorf("extended capabilities = %+v, features = %+v", ard.ExtCaps, ard.Features)
+			}
+
+			if got := strings.Join(AlgoNames(ard.AlgoInfo.Enc), " "); got != "rsa2048 rsa3072 rsa4096" {
+				t.Errorf("encryption algorithms = %s", got)
+			}
+
+			pk, err := ReadPublicKey(yk.Card, KeySlotEnc)
+			if err != nil {
+				t.Fatalf("ReadPublicKey() error = %v", err)
+			}
+
+			if len(pk.Modulus) != 256 {
+				t.Errorf("modulus length = %d, want 256", len(pk.Modulus))
+			}
+
+			// the PINs are redacted, so any PIN of the same length replays
+			if retries, err := yk.VerifyPIN(2, []byte("000000")); err == nil || retries != 2 {
+				t.Errorf("VerifyPIN() = %d, %v, want 2 retries", retries, err)
+			}
+
+			if _, err := yk.VerifyPIN(2, []byte("000000")); err != nil {
+				t.Errorf("VerifyPIN() error = %v", err)
+			}
+
+			if rp.pos != len(rp.entries) {
+				t.Errorf("replayed %d of %d exchanges", rp.pos, len(rp.entries))
+			}
+		})
+	}
+}
+
+func readTraceFile(t *testing.T, path string) *Replay {
+	t.Helper()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+
+	replays, err := ReadTrace(f)
+	if err != nil {
+		t.Fatalf("ReadTrace() error = %v", err)
+	}
+
+	if len(replays) != 1 {
+		t.Fatalf("ReadTrace() returned %d readers, want 1", len(replays))
+	}
+
+	return replays[0]
+}
@@ -0,0 +1,136 @@
+package yubikeyscard
+
+import (
+	"github.com/ebfe/scard"
+)
+
+// Transport is the link over which command and response APDUs are exchanged
+// with an OpenPGP smart card. PC/SC readers are the default transport, but any
+// implementation (simulator, relay, recorder) may be used in their place.
+type Transport interface {
+	// Transmit sends a serialized command APDU and returns the raw response
+	// APDU, including the trailing status words.
+	Transmit(cmd []byte) ([]byte, error)
+
+	// Disconnect resets the card and closes the transport.
+	Disconnect() error
+
+	// Reader returns the name of the reader the card is inserted in.
+	Reader() string
+}
+
+// transactor is implemented by transports that can give a sequence of APDUs
+// exclusive access to a card that is shared with other applications.
+type transactor interface {
+	BeginTransaction() error
+	EndTransaction() error
+}
+
+// pcscTransport is a Transport backed by a PC/SC card session.
+type pcscTransport struct {
+	card         *scard.Card
+	reader       string
+	disposition  scard.Disposition // how the card is left on disconnect
+	transactions int               // depth of nested transactions
+}
+
+// Transmit sends the command APDU to the card through the PC/SC reader.
+func (t *pcscTransport) Transmit(cmd []byte) ([]byte, error) {
+	return t.card.Transmit(cmd)
+}
+
+// Disconnect will end the PC/SC session. Cards connected exclusively are reset,
+// so that verified PINs do not outlive the session, while shared cards are left
+// as they are for the other applications.
+func (t *pcscTransport) Disconnect() error {
+	return t.card.Disconnect(t.disposition)
+}
+
+// BeginTransaction starts a PC/SC transaction, or nests in the current one.
+func (t *pcscTransport) BeginTransaction() error {
+	if t.transactions == 0 {
+		if err := t.card.BeginTransaction(); err != nil {
+			return err
+		}
+	}
+
+	t.transactions++
+
+	return nil
+}
+
+// EndTransaction ends the PC/SC transaction once the outermost transaction
+// ends.
+func (t *pcscTransport) EndTransaction() error {
+	if t.transactions == 0 {
+		return nil
+	}
+
+	t.transactions--
+	if t.transactions > 0 {
+		return nil
+	}
+
+	return t.card.EndTransaction(scard.LeaveCard)
+}
+
+// Reader returns the PC/SC reader name.
+func (t *pcscTransport) Reader() string {
+	return t.reader
+}
+
+// capsTransport is a Transport to a card whose capabilities are known, which
+// decide how commands with long data are sent.
+type capsTransport struct {
+	Transport
+	caps CardCaps
+}
+
+// BeginTransaction starts a transaction on the underlying transport.
+func (t *capsTransport) BeginTransaction() error {
+	return beginTransaction(t.Transport)
+}
+
+// EndTransaction ends a transaction on the underlying transport.
+func (t *capsTransport) EndTransaction() error {
+	return endTransaction(t.Transport)
+}
+
+// cardCaps returns the capabilities of the card, which are unknown until the
+// application related data has been read.
+func cardCaps(t Transport) CardCaps {
+	if ct, ok := t.(*capsTransport); ok {
+		return ct.caps
+	}
+
+	return CardCaps{}
+}
+
+// BeginTransaction gives the following APDUs exclusive access to the card until
+// EndTransaction, so that other applications sharing the card can not
+// interleave their APDUs. Transactions may be nested. Transports without
+// transactions, such as simulated cards, ignore them.
+func (yk *YubiKey) BeginTransaction() error {
+	return beginTransaction(yk.Card)
+}
+
+// EndTransaction ends a transaction started with BeginTransaction.
+func (yk *YubiKey) EndTransaction() error {
+	return endTransaction(yk.Card)
+}
+
+func beginTransaction(t Transport) error {
+	if tr, ok := t.(transactor); ok {
+		return tr.BeginTransaction()
+	}
+
+	return nil
+}
+
+func endTransaction(t Transport) error {
+	if tr, ok := t.(transactor); ok {
+		return tr.EndTransaction()
+	}
+
+	return nil
+}
@@ -0,0 +1,127 @@
+package yubikeyscard
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// TouchPolicy is the user interaction flag of a key slot, which controls
+// whether the button of the card must be touched to use the key.
+type TouchPolicy byte
+
+const (
+	TouchPolicyOff         TouchPolicy = 0x00
+	TouchPolicyOn          TouchPolicy = 0x01
+	TouchPolicyFixed       TouchPolicy = 0x02 // on, can only be turned off by resetting the application
+	TouchPolicyCached      TouchPolicy = 0x03 // touch is cached for 15 seconds
+	TouchPolicyCachedFixed TouchPolicy = 0x04
+)
+
+// uifButton is the general feature byte of the user interaction flag for a
+// card with a button.
+const uifButton byte = 0x20
+
+var touchPolicyNames = map[TouchPolicy]string{
+	TouchPolicyOff:         "off",
+	TouchPolicyOn:          "on",
+	TouchPolicyFixed:       "fixed",
+	TouchPolicyCached:      "cached",
+	TouchPolicyCachedFixed: "cached-fixed",
+}
+
+func (tp TouchPolicy) String() string {
+	if name, ok := touchPolicyNames[tp]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("unknown (%02x)", byte(tp))
+}
+
+// Required reports whether the card must be touched to use the key.
+func (tp TouchPolicy) Required() bool {
+	return tp != TouchPolicyOff
+}
+
+// Fixed reports whether the touch policy can only be changed by resetting the
+// OpenPGP application.
+func (tp TouchPolicy) Fixed() bool {
+	return tp == TouchPolicyFixed || tp == TouchPolicyCachedFixed
+}
+
+// TouchPolicyByName returns the touch policy with the provided name: off, on,
+// fixed, cached or cached-fixed.
+func TouchPolicyByName(name string) (TouchPolicy, error) {
+	for tp, n := range touchPolicyNames {
+		if strings.EqualFold(n, name) {
+			return tp, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown touch policy '%s', expected off, on, fixed, cached or cached-fixed", name)
+}
+
+// UIF is the user interaction flag data object of a key slot. Cards without a
+// button do not have the data object.
+type UIF struct {
+	Supported bool
+	Policy    TouchPolicy
+}
+
+// UIFlags holds the user interaction flags of the key slots and the Yubico
+// attestation key.
+type UIFlags struct {
+	Sign UIF
+	Enc  UIF
+	Auth UIF
+	Att  UIF
+}
+
+// Slot returns the user interaction flag of the key slot.
+func (uifs *UIFlags) Slot(slot KeySlot) UIF {
+	switch slot {
+	case KeySlotSign:
+		return uifs.Sign
+	case KeySlotEnc:
+		return uifs.Enc
+	case KeySlotAuth:
+		return uifs.Auth
+	}
+
+	return UIF{}
+}
+
+func (uif *UIF) deserialize(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+
+	uif.Supported = true
+	uif.Policy = TouchPolicy(data[0])
+}
+
+// SetTouchPolicy changes the touch policy of the key slot. Fixed policies can
+// not be changed without resetting the OpenPGP application. The admin PIN must
+// be verified.
+func (yk *YubiKey) SetTouchPolicy(slot KeySlot, policy TouchPolicy) error {
+	if err := yk.BeginTransaction(); err != nil {
+		return err
+	}
+
+	defer yk.EndTransaction()
+
+	uif := yk.AppRelatedData.UIF.Slot(slot)
+	if !uif.Supported {
+		return errors.New("card does not support touch policies")
+	}
+
+	if uif.Policy.Fixed() {
+		return fmt.Errorf("touch policy of %s key slot is fixed, it can only be changed by resetting the OpenPGP application", slot)
+	}
+
+	if err := PutData(yk.Card, keySlotTags[slot].uif, []byte{byte(policy), uifButton}); err != nil {
+		return err
+	}
+
+	return yk.refreshAppRelatedData()
+}
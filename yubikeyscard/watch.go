@@ -0,0 +1,326 @@
+package yubikeyscard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ebfe/scard"
+)
+
+const (
+	// pnpNotification is the pseudo reader whose state changes when a reader
+	// is attached or detached.
+	pnpNotification = `\\?PnP?\Notification`
+
+	// maxUnknownReaderFailures is how many status changes in a row may fail
+	// with an unknown reader before the PnP pseudo reader is deemed
+	// unsupported and the readers are polled.
+	maxUnknownReaderFailures = 3
+
+	watchRetryDelay   = 50 * time.Millisecond
+	watchPollInterval = time.Second
+)
+
+// CardEventType is the kind of change reported by Watch.
+type CardEventType int
+
+const (
+	CardInserted CardEventType = iota
+	CardRemoved
+)
+
+func (t CardEventType) String() string {
+	if t == CardRemoved {
+		return "removed"
+	}
+
+	return "inserted"
+}
+
+// CardEvent is a smart card inserted into or removed from a reader. Detaching
+// a reader that holds a card is reported as a removal. If watching fails, the
+// last event before the channel is closed carries the error.
+type CardEvent struct {
+	Type   CardEventType
+	Reader string
+	Err    error
+}
+
+// Watch reports smart cards inserted into and removed from PC/SC readers,
+// including readers attached while watching, until ctx is done. Cards present
+// when Watch is called are reported as inserted. Events are applied to the
+// connected YubiKeys with Update.
+func (yks *YubiKeys) Watch(ctx context.Context) (<-chan CardEvent, error) {
+	// the status is watched with a separate context, as PC/SC contexts must
+	// not be shared between threads
+	sctx, err := scard.EstablishContext()
+	if err != nil {
+		return nil, err
+	}
+
+	events := make(chan CardEvent)
+	done := make(chan struct{})
+
+	// cancel the blocking status change call when ctx is done
+	go func() {
+		select {
+		case <-ctx.Done():
+			sctx.Cancel()
+		case <-done:
+		}
+	}()
+
+	go func() {
+		defer sctx.Release()
+		defer close(done)
+		defer close(events)
+
+		if err := watchReaders(ctx, sctx, events); err != nil && ctx.Err() == nil {
+			select {
+			case events <- CardEvent{Err: err}:
+			case <-ctx.Done():
+			}
+		}
+	}()
+
+	return events, nil
+}
+
+// watchReaders sends card events to the channel until the status change call
+// fails or is cancelled. Readers are attached and detached while waiting on
+// the PnP notification pseudo reader. Where it is not supported and status
+// changes keep failing with an unknown reader, the readers are polled instead.
+func watchReaders(ctx context.Context, sctx *scard.Context, events chan<- CardEvent) error {
+	var rs []scard.ReaderState
+
+	pnp := scard.ReaderState{Reader: pnpNotification, CurrentState: scard.StateUnaware}
+	usePnP := true
+	failures := 0
+
+	send := func(t CardEventType, reader string) bool {
+		select {
+		case events <- CardEvent{Type: t, Reader: reader}:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	for {
+		readers, err := listReaders(sctx)
+		if err != nil {
+			return err
+		}
+
+		// keep the state of known readers, and report cards in detached
+		// readers as removed
+		var next []scard.ReaderState
+		for _, r := range readers {
+			state := scard.ReaderState{Reader: r, CurrentState: scard.StateUnaware}
+
+			for _, s := range rs {
+				if s.Reader == r {
+					state = s
+				}
+			}
+
+			next = append(next, state)
+		}
+
+		for _, s := range rs {
+			if s.CurrentState&scard.StatePresent != 0 && !containsReader(next, s.Reader) {
+				if !send(CardRemoved, s.Reader) {
+					return nil
+				}
+			}
+		}
+
+		rs = next
+
+		states, timeout := rs, time.Duration(-1)
+		if usePnP {
+			states = append([]scard.ReaderState{pnp}, rs...)
+		} else {
+			timeout = watchPollInterval
+		}
+
+		// without the PnP pseudo reader there is nothing to wait on until a
+		// reader is attached
+		if len(states) == 0 {
+			if !sleepContext(ctx, watchPollInterval) {
+				return nil
+			}
+
+			continue
+		}
+
+		err = sctx.GetStatusChange(states, timeout)
+
+		// some platforms fail rather than report a detached reader as
+		// unknown, so the readers are listed again after a pause. Platforms
+		// without PnP notifications fail every time.
+		if errors.Is(err, scard.ErrUnknownReader) {
+			failures++
+			if usePnP && failures >= maxUnknownReaderFailures {
+				usePnP = false
+			}
+
+			if !sleepContext(ctx, min(watchRetryDelay<<min(failures, 5), watchPollInterval)) {
+				return nil
+			}
+
+			continue
+		}
+
+		// the readers are polled again when no card changed in time
+		if errors.Is(err, scard.ErrTimeout) {
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		failures = 0
+
+		if usePnP {
+			pnp = states[0]
+			pnp.CurrentState = pnp.EventState &^ scard.StateChanged
+			rs = states[1:]
+		}
+
+		for i := range rs {
+			s := &rs[i]
+			if s.EventState&scard.StateChanged == 0 {
+				continue
+			}
+
+			was := s.CurrentState&scard.StatePresent != 0
+			is := s.EventState&scard.StatePresent != 0
+
+			// the upper 16 bits count card events, so a card swapped between
+			// calls is reported as removed and inserted
+			swapped := was && is && s.CurrentState>>16 != s.EventState>>16
+
+			if was && (!is || swapped) && !send(CardRemoved, s.Reader) {
+				return nil
+			}
+
+			if is && (!was || swapped) && !send(CardInserted, s.Reader) {
+				return nil
+			}
+		}
+
+		for i := range rs {
+			rs[i].CurrentState = rs[i].EventState &^ scard.StateChanged
+		}
+	}
+}
+
+// sleepContext waits for the duration and reports whether it elapsed before
+// ctx was done.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Update applies a card event to the connected YubiKeys. An inserted card is
+// connected and returned if it is a YubiKey that supports OpenPGP and is
+// selected by the filter, otherwise ErrNotYubiKey is returned. Cards that are
+// already connected are ignored. The YubiKey in the reader of a removed card
+// is disconnected and returned. nil is returned if the event did not change
+// the connected YubiKeys.
+func (yks *YubiKeys) Update(ev CardEvent) (*YubiKey, error) {
+	switch ev.Type {
+	case CardInserted:
+		if yks.findByReader(ev.Reader) != nil {
+			return nil, nil
+		}
+
+		if !yks.Filter.matchReader(ev.Reader) {
+			return nil, fmt.Errorf("%w (reader '%s')", ErrNotYubiKey, ev.Reader)
+		}
+
+		if yks.Context == nil {
+			ctx, err := scard.EstablishContext()
+			if err != nil {
+				return nil, err
+			}
+
+			yks.Context = ctx
+		}
+
+		yk, err := yks.connectReader(ev.Reader)
+		if err != nil {
+			return nil, err
+		}
+
+		if yk == nil {
+			return nil, fmt.Errorf("%w (reader '%s')", ErrNotYubiKey, ev.Reader)
+		}
+
+		yks.YubiKeys = append(yks.YubiKeys, yk)
+
+		return yk, nil
+	case CardRemoved:
+		yk := yks.findByReader(ev.Reader)
+		if yk == nil {
+			return nil, nil
+		}
+
+		for i := range yks.YubiKeys {
+			if yks.YubiKeys[i] == yk {
+				yks.YubiKeys = append(yks.YubiKeys[:i], yks.YubiKeys[i+1:]...)
+				break
+			}
+		}
+
+		// the card is gone, so the session can not be reset
+		yk.Card.Disconnect()
+
+		return yk, nil
+	}
+
+	return nil, fmt.Errorf("unknown card event %d", ev.Type)
+}
+
+// findByReader returns the connected YubiKey in the reader, if any.
+func (yks *YubiKeys) findByReader(reader string) *YubiKey {
+	for _, yk := range yks.YubiKeys {
+		if yk.Card.Reader() == reader {
+			return yk
+		}
+	}
+
+	return nil
+}
+
+// listReaders lists the PC/SC readers, which is empty rather than an error if
+// no readers are attached.
+func listReaders(ctx *scard.Context) ([]string, error) {
+	readers, err := ctx.ListReaders()
+	if errors.Is(err, scard.ErrNoReadersAvailable) {
+		return nil, nil
+	}
+
+	return readers, err
+}
+
+func containsReader(rs []scard.ReaderState, reader string) bool {
+	for _, s := range rs {
+		if s.Reader == reader {
+			return true
+		}
+	}
+
+	return false
+}
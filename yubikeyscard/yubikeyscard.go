@@ -7,35 +7,69 @@ import (
 	"fmt"
 	"io"
 	"regexp"
-	"time"
+	"strings"
 
 	"github.com/ebfe/scard"
 )
 
 const (
 	AlgoIdRSA   uint8 = 1
-	AlgoIdECDH  uint8 = 12
-	AlgoIdECDSA uint8 = 13
+	AlgoIdECDH  uint8 = 18
+	AlgoIdECDSA uint8 = 19
+	AlgoIdEdDSA uint8 = 22
 )
 
-const (
-	scardPresentTimeout         int = 1
-	scardGetStatusChangeTimeout int = 5
-)
+// ErrNoYubiKeys is returned by Connect when no YubiKeys are inserted.
+var ErrNoYubiKeys = errors.New("no YubiKeys found")
 
-var yubikeyManufacturerID = [2]byte{0, 6}
+// ErrNotYubiKey is returned when a smart card does not support the OpenPGP
+// application or its manufacturer is not allowed.
+var ErrNotYubiKey = errors.New("smart card is not an OpenPGP card of an allowed manufacturer")
 
 type YubiKeys struct {
-	YubiKeys []*YubiKey
-	Context  *scard.Context
+	YubiKeys      []*YubiKey
+	Context       *scard.Context
+	Tracer        *Tracer   // records all APDUs exchanged if set, closed on disconnect
+	Filter        Filter    // selects the PC/SC readers and YubiKeys to connect to
+	Shared        bool      // share cards with other applications rather than lock them
+	Manufacturers [][2]byte // manufacturer IDs of the cards to connect to, Yubico if empty
+}
+
+// Filter selects PC/SC readers by name and YubiKeys by serial number. The zero
+// Filter selects all readers and YubiKeys.
+type Filter struct {
+	Reader  *regexp.Regexp // matched against the reader name
+	Serials []string       // hex serial numbers, as reported by FindBySN
+}
+
+// matchReader reports whether the reader is selected by the filter.
+func (f *Filter) matchReader(reader string) bool {
+	return f.Reader == nil || f.Reader.MatchString(reader)
+}
+
+// matchSerial reports whether the YubiKey is selected by the filter.
+func (f *Filter) matchSerial(yk *YubiKey) bool {
+	if len(f.Serials) == 0 {
+		return true
+	}
+
+	sn := fmt.Sprintf("%x", yk.AppRelatedData.AID.Serial)
+	for _, s := range f.Serials {
+		if strings.EqualFold(s, sn) {
+			return true
+		}
+	}
+
+	return false
 }
 
 type YubiKey struct {
-	Card            *scard.Card
+	Card            Transport
 	ReaderLabel     string
 	CardRelatedData CardRelatedData
 	AppRelatedData  AppRelatedData
 	PINCache        [3][]byte
+	KDF             KDF
 }
 
 type CardRelatedData struct {
@@ -52,6 +86,11 @@ type AppRelatedData struct {
 	PWStatus     PWStatus
 	Fingerprints Fingerprints
 	KeyGenDates  KeyGenDates
+	UIF          UIFlags
+	CardCaps     CardCaps
+	ExtCaps      ExtCaps
+	Features     Features
+	AlgoInfo     AlgoInfo
 }
 
 type AID struct {
@@ -93,8 +132,11 @@ type KeyGenDates struct {
 	Auth [4]byte
 }
 
-// Connect establishes the system context and opens sessions with all available
-// YubiKeys.
+// Connect establishes the system context and opens sessions with all YubiKeys
+// inserted at the time that are selected by the filter. Cards are connected
+// exclusively unless Shared is set. Readers whose card is in use by another
+// application are skipped. Cards inserted later can be connected by watching
+// for card events with Watch.
 func (yks *YubiKeys) Connect() error {
 	// establish system context
 	ctx, err := scard.EstablishContext()
@@ -105,47 +147,36 @@ func (yks *YubiKeys) Connect() error {
 	yks.Context = ctx
 
 	// list available smart card readers
-	readers, err := ctx.ListReaders()
+	readers, err := listReaders(ctx)
 	if err != nil {
 		return err
 	}
 
-	// wait for all smards card to reach present state
-	presentReaders, err := waitUntilCardsPresent(ctx, readers)
+	presentReaders, err := cardsPresent(ctx, readers)
 	if err != nil {
 		return err
 	}
 
+	var busy []string
+
 	// ignore other smart cards
 	for _, r := range presentReaders {
-		yk := new(YubiKey)
-
-		// connect to card
-		card, err := ctx.Connect(r, scard.ShareExclusive, scard.ProtocolAny)
-		if err != nil {
-			return err
-		}
-
-		// skip smart cards that do not support the OpenPGP applet
-		if err = SelectApp(card); err != nil {
+		if !yks.Filter.matchReader(r) {
 			continue
 		}
 
-		// build YubiKey struct
-		re := regexp.MustCompile("^(.*?) [0-9]{2}$")
-		yk.ReaderLabel = re.ReplaceAllString(r, "$1")
-		yk.Card = card
-
-		if err = yk.refreshCardRelatedData(); err != nil {
-			return err
+		yk, err := yks.connectReader(r)
+		if errors.Is(err, scard.ErrSharingViolation) {
+			busy = append(busy, r)
+			continue
 		}
 
-		if err = yk.refreshAppRelatedData(); err != nil {
+		if err != nil {
 			return err
 		}
 
-		// skip smart cards not manufactured by YubiCo
-		if yk.AppRelatedData.AID.Manufacturer != yubikeyManufacturerID {
+		// skip smart cards that are not OpenPGP-capable YubiKeys
+		if yk == nil {
 			continue
 		}
 
@@ -155,28 +186,97 @@ func (yks *YubiKeys) Connect() error {
 	// if no YubiKeys are found, release context, and throw error
 	if len(yks.YubiKeys) == 0 {
 		// Release reader context
-		err = ctx.Release()
-		if err != nil {
+		yks.Context = nil
+		if err := ctx.Release(); err != nil {
 			return err
 		}
 
-		return errors.New("no YubiKeys found")
+		if len(busy) > 0 {
+			return fmt.Errorf("%w, cards in use by another application: %s", ErrNoYubiKeys, strings.Join(busy, ", "))
+		}
+
+		return ErrNoYubiKeys
 	}
 
 	return nil
 }
 
+// connectReader opens a session with the card in the reader. A nil YubiKey is
+// returned if the card is not a YubiKey that supports OpenPGP or is not
+// selected by the filter.
+func (yks *YubiKeys) connectReader(reader string) (*YubiKey, error) {
+	mode, disposition := scard.ShareExclusive, scard.ResetCard
+	if yks.Shared {
+		mode, disposition = scard.ShareShared, scard.LeaveCard
+	}
+
+	card, err := yks.Context.Connect(reader, mode, scard.ProtocolAny)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &pcscTransport{card: card, reader: reader, disposition: disposition}
+
+	yk, err := yks.newYubiKey(yks.wrap(t))
+	if err != nil || yk == nil {
+		return nil, err
+	}
+
+	if !yks.Filter.matchSerial(yk) {
+		// leave YubiKeys that are not selected as they are
+		return nil, card.Disconnect(scard.LeaveCard)
+	}
+
+	return yk, nil
+}
+
+// Attach opens a session with a YubiKey over the provided transport and adds
+// it to the connected YubiKeys. Attach allows cards that are not reachable via
+// PC/SC, such as simulators or relays, to be used in place of hardware. If the
+// card is not a YubiKey that supports OpenPGP or its serial number is not
+// selected by the filter, ErrNotYubiKey is returned.
+func (yks *YubiKeys) Attach(t Transport) (*YubiKey, error) {
+	yk, err := yks.newYubiKey(yks.wrap(t))
+	if err != nil {
+		return nil, err
+	}
+
+	if yk == nil {
+		return nil, fmt.Errorf("%w (reader '%s')", ErrNotYubiKey, t.Reader())
+	}
+
+	if !yks.Filter.matchSerial(yk) {
+		yk.Card.Disconnect()
+		return nil, fmt.Errorf("%w (reader '%s')", ErrNotYubiKey, t.Reader())
+	}
+
+	yks.YubiKeys = append(yks.YubiKeys, yk)
+
+	return yk, nil
+}
+
 // Disconnect will reset all open sessions smart cards and release the system
 // context.
 func (yks *YubiKeys) Disconnect() error {
 	for _, yk := range yks.YubiKeys {
 		// Disconnect card by sending reset command
-		err := yk.Card.Disconnect(scard.ResetCard)
+		err := yk.Card.Disconnect()
 		if err != nil {
 			return err
 		}
 	}
 
+	if yks.Tracer != nil {
+		if err := yks.Tracer.Close(); err != nil {
+			return err
+		}
+	}
+
+	// YubiKeys attached without PC/SC have no system context
+	if yks.Context == nil {
+		return nil
+	}
+
 	// Release reader context
 	err := yks.Context.Release()
 	if err != nil {
@@ -235,55 +335,130 @@ func (yk *YubiKey) SetCachedPIN(bank uint8, pin []byte) error {
 	return nil
 }
 
-func waitUntilCardsPresent(ctx *scard.Context, readers []string) ([]string, error) {
-	start := time.Now()
-	var presentReaders []string
-	rs := make([]scard.ReaderState, len(readers))
+// cardsPresent returns the readers that hold a card.
+func cardsPresent(ctx *scard.Context, readers []string) ([]string, error) {
+	if len(readers) == 0 {
+		return nil, nil
+	}
 
+	rs := make([]scard.ReaderState, len(readers))
 	for i := range rs {
 		rs[i].Reader = readers[i]
 		rs[i].CurrentState = scard.StateUnaware
 	}
 
-	for {
-		ready := 0
-		for i := range rs {
-			rs[i].CurrentState = rs[i].EventState
-			if rs[i].EventState&scard.StatePresent != 0 {
-				ready++
+	// the current state is returned immediately for readers in unaware state
+	if err := ctx.GetStatusChange(rs, 0); err != nil {
+		return nil, err
+	}
+
+	var present []string
+	for _, s := range rs {
+		if s.EventState&scard.StatePresent != 0 {
+			present = append(present, s.Reader)
+		}
+	}
+
+	return present, nil
+}
 
-				for _, pr := range presentReaders {
-					if pr == readers[i] {
-						continue
-					}
-				}
+// wrap applies the APDU tracer, if any, to the transport.
+func (yks *YubiKeys) wrap(t Transport) Transport {
+	if yks.Tracer == nil {
+		return t
+	}
 
-				presentReaders = append(presentReaders, readers[i])
-			}
+	return yks.Tracer.Wrap(t)
+}
 
-		}
+// newYubiKey selects the OpenPGP application over the transport and reads the
+// card and application related data within a transaction. If the card does not
+// support OpenPGP or its manufacturer is not allowed, the transport is
+// disconnected and a nil YubiKey is returned. The transport is also
+// disconnected if reading the card fails, after the transaction has ended.
+func (yks *YubiKeys) newYubiKey(t Transport) (*YubiKey, error) {
+	if err := beginTransaction(t); err != nil {
+		t.Disconnect()
+		return nil, err
+	}
 
-		if ready == len(readers) {
-			return presentReaders, nil
-		}
+	yk, err := yks.readYubiKey(t)
 
-		err := ctx.GetStatusChange(rs, time.Duration(scardPresentTimeout)*time.Second)
-		if err != nil {
-			return nil, err
-		}
+	endTransaction(t)
 
-		if time.Since(start) > time.Duration(scardGetStatusChangeTimeout)*time.Second {
-			return presentReaders, nil
+	if err != nil || yk == nil {
+		if derr := t.Disconnect(); err == nil {
+			err = derr
 		}
+
+		return nil, err
 	}
+
+	return yk, nil
 }
 
-func pw1PINRetries(card *scard.Card) (int, error) {
+// readYubiKey selects the OpenPGP application and reads the YubiKey, or
+// returns nil if the card is not an OpenPGP card of an allowed manufacturer.
+func (yks *YubiKeys) readYubiKey(t Transport) (*YubiKey, error) {
+	yk := new(YubiKey)
+
+	// skip smart cards that do not support the OpenPGP applet
+	if err := SelectApp(t); err != nil {
+		return nil, nil
+	}
+
+	// build YubiKey struct
+	re := regexp.MustCompile("^(.*?) [0-9]{2}$")
+	yk.ReaderLabel = re.ReplaceAllString(t.Reader(), "$1")
+	yk.Card = t
+
+	if err := yk.refreshCardRelatedData(); err != nil {
+		return nil, err
+	}
+
+	if err := yk.refreshAppRelatedData(); err != nil {
+		return nil, err
+	}
+
+	// skip smart cards of other manufacturers
+	if !yks.allowManufacturer(yk.AppRelatedData.AID.Manufacturer) {
+		return nil, nil
+	}
+
+	// commands are sent as the card capabilities allow from here on
+	yk.Card = &capsTransport{Transport: t, caps: yk.AppRelatedData.CardCaps}
+
+	if err := yk.refreshKDF(); err != nil {
+		return nil, err
+	}
+
+	if err := yk.refreshAlgoInfo(); err != nil {
+		return nil, err
+	}
+
+	return yk, nil
+}
+
+// pinRetries returns the remaining retries of the PIN for the provided bank.
+// PW1 is shared by banks 1 and 2, bank 3 is the admin PIN (PW3) and
+// resetCodeBank the reset code.
+func pinRetries(card Transport, bank uint8) (int, error) {
 	data, err := GetData(card, doPWStatus)
 	if err != nil {
 		return 0, err
 	}
 
+	if len(data) < 7 {
+		return 0, errors.New("invalid password status bytes returned by card")
+	}
+
+	switch bank {
+	case 3:
+		return int(data[6]), nil
+	case resetCodeBank:
+		return int(data[5]), nil
+	}
+
 	return int(data[4]), nil
 }
 
@@ -296,7 +471,7 @@ func (yk *YubiKey) refreshCardRelatedData() error {
 	}
 
 	for _, c := range doCardRelData.children() {
-		d := doFindTLV(data, c.tag, 1)
+		d := findTLV(data, c.tag)
 		r := bytes.NewReader(d)
 
 		switch c.tag {
@@ -331,8 +506,13 @@ func (yk *YubiKey) refreshAppRelatedData() error {
 		return err
 	}
 
+	var caps CardCaps
+
+	ard.ExtCaps = ExtCaps{}
+	ard.Features = Features{}
+
 	for _, c := range doAppRelData.children() {
-		cData := doFindTLV(data, c.tag, 1)
+		cData := findTLV(data, c.tag)
 		buf := bytes.NewReader(cData)
 
 		switch c.tag {
@@ -350,6 +530,27 @@ func (yk *YubiKey) refreshAppRelatedData() error {
 			err = ard.Fingerprints.deserialize(buf)
 		case doKeyGenDate.tag:
 			err = ard.KeyGenDates.deserialize(buf)
+		case doUIFSig.tag:
+			ard.UIF.Sign.deserialize(cData)
+		case doUIFDec.tag:
+			ard.UIF.Enc.deserialize(cData)
+		case doUIFAut.tag:
+			ard.UIF.Auth.deserialize(cData)
+		case doUIFAtt.tag:
+			ard.UIF.Att.deserialize(cData)
+		case doCardCaps.tag:
+			caps.deserialize(cData)
+		case doExtLenCaps.tag:
+			// version 2 cards announce the maximum lengths here
+			if ard.AID.Version[0] < 3 {
+				caps.deserializeExtCapsV2(cData)
+			} else {
+				ard.ExtCaps.deserialize(cData)
+			}
+		case doGenFeatMgmt.tag:
+			ard.Features.deserialize(cData)
+		case doExtLenInfo.tag:
+			caps.deserializeExtLenInfo(cData)
 		}
 
 		if err != nil {
@@ -357,9 +558,43 @@ func (yk *YubiKey) refreshAppRelatedData() error {
 		}
 	}
 
+	// cards announce their capabilities in the historical bytes, unless they
+	// have a card capabilities DO
+	if !caps.Announced {
+		caps.deserializeHistBytes(findTLV(data, doHistBytes.tag))
+	}
+
+	ard.CardCaps = caps
+
 	return nil
 }
 
+// refreshAlgoInfo reads the algorithms supported by the card, which version
+// 3.4 cards list in the algorithm information DO. The list does not change, so
+// it is read once when connecting.
+func (yk *YubiKey) refreshAlgoInfo() error {
+	ard := &yk.AppRelatedData
+
+	if v := ard.AID.Version; v[0] < 3 || (v[0] == 3 && v[1] < 4) {
+		return nil
+	}
+
+	data, err := GetData(yk.Card, doAlgoInfo)
+
+	// the DO is optional
+	var se *StatusError
+	if errors.As(err, &se) {
+		ard.AlgoInfo = AlgoInfo{}
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return ard.AlgoInfo.deserialize(data)
+}
+
 func (aid *AID) deserialize(r *bytes.Reader) (err error) {
 	if _, err = io.ReadFull(r, aid.RID[:]); err != nil {
 		return
@@ -398,16 +633,24 @@ func (aa *AlgoAttr) deserialize(r *bytes.Reader) (err error) {
 				return err
 			}
 		}
-	case AlgoIdECDH, AlgoIdECDSA:
-		aa.ECurveOID = make([]byte, r.Len()-1)
-		if _, err := io.ReadFull(r, aa.ECurveOID); err != nil {
+
+		if aa.PrivKeyImpFmt, err = r.ReadByte(); err != nil {
+			return err
+		}
+	case AlgoIdECDH, AlgoIdECDSA, AlgoIdEdDSA:
+		// the curve OID is followed by an optional import format byte, which
+		// is 0xff if present
+		rest := make([]byte, r.Len())
+		if _, err := io.ReadFull(r, rest); err != nil {
 			return err
 		}
 
-	}
+		if len(rest) > 0 && rest[len(rest)-1] == 0xff {
+			aa.PrivKeyImpFmt = 0xff
+			rest = rest[:len(rest)-1]
+		}
 
-	if aa.PrivKeyImpFmt, err = r.ReadByte(); err != nil {
-		return err
+		aa.ECurveOID = rest
 	}
 
 	return nil
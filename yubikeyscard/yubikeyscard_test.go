@@ -0,0 +1,92 @@
+package yubikeyscard
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// recordingTransport replays a trace and records the transaction and
+// disconnect calls.
+type recordingTransport struct {
+	*Replay
+	calls []string
+}
+
+func (t *recordingTransport) BeginTransaction() error {
+	t.calls = append(t.calls, "begin")
+	return nil
+}
+
+func (t *recordingTransport) EndTransaction() error {
+	t.calls = append(t.calls, "end")
+	return nil
+}
+
+func (t *recordingTransport) Disconnect() error {
+	t.calls = append(t.calls, "disconnect")
+	return nil
+}
+
+func TestNewYubiKeyDisconnects(t *testing.T) {
+	tests := []struct {
+		name          string
+		exchanges     int
+		manufacturers [][2]byte
+		wantErr       bool
+	}{
+		// the replay is exhausted while reading the application related data
+		{"read error", 2, nil, true},
+		{"not OpenPGP", 0, nil, true},
+		{"manufacturer not allowed", 3, [][2]byte{{0x00, 0x0f}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rp := readTraceFile(t, "testdata/sim_extended.jsonl")
+			rp.entries = rp.entries[:tt.exchanges]
+
+			tr := &recordingTransport{Replay: rp}
+
+			yks := &YubiKeys{Manufacturers: tt.manufacturers}
+			if _, err := yks.Attach(tr); (err != nil) != tt.wantErr {
+				t.Fatalf("Attach() error = %v", err)
+			}
+
+			// commands open nested transactions, all of which must end
+			// before the card is disconnected
+			got := strings.Join(tr.calls, " ")
+			if !strings.HasSuffix(got, "end disconnect") || strings.Count(got, "disconnect") != 1 ||
+				strings.Count(got, "begin") != strings.Count(got, "end") {
+				t.Errorf("calls = %s, want balanced transactions followed by one disconnect", got)
+			}
+		})
+	}
+}
+
+func TestAttachFilterSerials(t *testing.T) {
+	tests := []struct {
+		serials []string
+		wantErr bool
+	}{
+		{nil, false},
+		{[]string{"48C517EE"}, false},
+		{[]string{"0a1b2c3d"}, true},
+	}
+
+	for _, tt := range tests {
+		tr := &recordingTransport{Replay: readTraceFile(t, "testdata/sim_extended.jsonl")}
+
+		yks := &YubiKeys{Filter: Filter{Serials: tt.serials}}
+		_, err := yks.Attach(tr)
+
+		if tt.wantErr != errors.Is(err, ErrNotYubiKey) || (!tt.wantErr && err != nil) {
+			t.Errorf("Attach() with serials %v error = %v", tt.serials, err)
+		}
+
+		// YubiKeys that are not selected are disconnected
+		if tt.wantErr && (len(yks.YubiKeys) != 0 || !strings.HasSuffix(strings.Join(tr.calls, " "), "disconnect")) {
+			t.Errorf("Attach() with serials %v kept the YubiKey, calls = %v", tt.serials, tr.calls)
+		}
+	}
+}
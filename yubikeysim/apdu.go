@@ -0,0 +1,180 @@
+package yubikeysim
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	insSelect            uint8 = 0xa4
+	insGetData           uint8 = 0xca
+	insGetResponse       uint8 = 0xc0
+	insVerify            uint8 = 0x20
+	insChangeRefData     uint8 = 0x24
+	insResetRetryCounter uint8 = 0x2c
+	insPSO               uint8 = 0x2a
+	insGenerateKey       uint8 = 0x47
+	insPutData           uint8 = 0xda
+	insPutDataOdd        uint8 = 0xdb
+	insSelectData        uint8 = 0xa5
+	insGetVersion        uint8 = 0xf1
+	insAttest            uint8 = 0xfb // Yubico proprietary, CLA 0x80
+
+	claChaining uint8 = 0x10 // command is not the last of a chain
+)
+
+// command is a parsed command APDU.
+type command struct {
+	cla, ins, p1, p2 uint8
+	data             []byte
+	ne               int  // expected response length, 0 if absent
+	extended         bool // extended length fields are used
+}
+
+// sameHeader reports whether the command continues a chain of commands.
+func (ca *command) sameHeader(next command) bool {
+	return ca.ins == next.ins && ca.p1 == next.p1 && ca.p2 == next.p2
+}
+
+// parseCommand parses a short or extended length command APDU.
+func parseCommand(b []byte) (ca command, err error) {
+	if len(b) < 4 {
+		return ca, errors.New("command APDU too short")
+	}
+
+	ca.cla, ca.ins, ca.p1, ca.p2 = b[0], b[1], b[2], b[3]
+	body := b[4:]
+
+	switch {
+	case len(body) == 0:
+		// case 1, no data and no Le
+	case len(body) == 1:
+		// case 2 short, Le only
+		ca.ne = decodeLe(body, maxShortResponse)
+	case body[0] == 0 && len(body) == 3:
+		// case 2 extended, Le only
+		ca.ne = decodeLe(body[1:], 65536)
+		ca.extended = true
+	case body[0] == 0 && len(body) > 3:
+		// case 3 or 4 extended
+		lc := int(binary.BigEndian.Uint16(body[1:3]))
+		if len(body) < 3+lc {
+			return ca, errors.New("command APDU data shorter than Lc")
+		}
+
+		ca.data = body[3 : 3+lc]
+		ca.ne = decodeLe(body[3+lc:], 65536)
+		ca.extended = true
+	default:
+		// case 3 or 4 short
+		lc := int(body[0])
+		if len(body) < 1+lc {
+			return ca, errors.New("command APDU data shorter than Lc")
+		}
+
+		ca.data = body[1 : 1+lc]
+		ca.ne = decodeLe(body[1+lc:], maxShortResponse)
+	}
+
+	return ca, nil
+}
+
+// decodeLe decodes a one or two byte Le field, where zero encodes the maximum.
+func decodeLe(le []byte, max int) int {
+	var n int
+
+	switch len(le) {
+	case 0:
+		return 0
+	case 1:
+		n = int(le[0])
+	default:
+		n = int(binary.BigEndian.Uint16(le[len(le)-2:]))
+	}
+
+	if n == 0 {
+		return max
+	}
+
+	return n
+}
+
+// tlv encodes a BER-TLV data object with the provided tag and value. Multiple
+// values are concatenated, allowing constructed data objects to be nested.
+func tlv(tag uint16, values ...[]byte) []byte {
+	var value []byte
+	for _, v := range values {
+		value = append(value, v...)
+	}
+
+	var b []byte
+	if tag > 0xff {
+		b = append(b, uint8(tag>>8))
+	}
+	b = append(b, uint8(tag))
+
+	// lengths above 127 bytes use the two byte form, as YubiKeys do
+	n := len(value)
+	if n < 0x80 {
+		b = append(b, uint8(n))
+	} else {
+		b = append(b, 0x82, uint8(n>>8), uint8(n))
+	}
+
+	return append(b, value...)
+}
+
+// parseTLV parses the first BER-TLV data object in b and returns its tag,
+// value and the data following it.
+func parseTLV(b []byte) (tag uint16, value, rest []byte, err error) {
+	tag, b, err = parseTLVTag(b)
+	if err != nil {
+		return
+	}
+
+	n, b, err := parseTLVLength(b)
+	if err != nil {
+		return
+	}
+
+	if len(b) < n {
+		return 0, nil, nil, errors.New("data object value shorter than length")
+	}
+
+	return tag, b[:n], b[n:], nil
+}
+
+// parseTLVTag parses a one or two byte tag.
+func parseTLVTag(b []byte) (uint16, []byte, error) {
+	if len(b) == 0 {
+		return 0, nil, errors.New("data object tag missing")
+	}
+
+	if b[0]&0x1f != 0x1f {
+		return uint16(b[0]), b[1:], nil
+	}
+
+	if len(b) < 2 {
+		return 0, nil, errors.New("data object tag too short")
+	}
+
+	return uint16(b[0])<<8 | uint16(b[1]), b[2:], nil
+}
+
+// parseTLVLength parses a short or long form length of up to two bytes.
+func parseTLVLength(b []byte) (int, []byte, error) {
+	if len(b) == 0 {
+		return 0, nil, errors.New("data object length missing")
+	}
+
+	switch {
+	case b[0] < 0x80:
+		return int(b[0]), b[1:], nil
+	case b[0] == 0x81 && len(b) >= 2:
+		return int(b[1]), b[2:], nil
+	case b[0] == 0x82 && len(b) >= 3:
+		return int(binary.BigEndian.Uint16(b[1:3])), b[3:], nil
+	}
+
+	return 0, nil, errors.New("invalid data object length")
+}
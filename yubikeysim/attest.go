@@ -0,0 +1,151 @@
+package yubikeysim
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"math/big"
+	"time"
+)
+
+// attestationValidity is the validity of the simulated attestation
+// certificates, which Yubico issues for the lifetime of the card.
+const attestationValidity = 50 * 365 * 24 * time.Hour
+
+// yubicoOIDArc is the arc of the extensions Yubico adds to OpenPGP
+// attestation certificates.
+var yubicoOIDArc = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 41482, 5}
+
+// selectedCrt is the SELECT DATA command data selecting the cardholder
+// certificate, as sent to firmware newer than 5.4.3.
+var selectedCrt = []byte{0x60, 0x04, 0x5c, 0x02, 0x7f, 0x21}
+
+// AttestationCertificate returns the self-signed attestation certificate of
+// the simulated card, the root of the certificates issued by ATTEST.
+func (c *Card) AttestationCertificate() (*x509.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.initAttestation(); err != nil {
+		return nil, err
+	}
+
+	return x509.ParseCertificate(c.attCert)
+}
+
+// initAttestation creates the attestation key and its self-signed certificate
+// on first use. A hardware YubiKey holds a key certified by Yubico instead.
+func (c *Card) initAttestation() error {
+	if c.attKey != nil {
+		return nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Vervet Simulated OpenPGP Attestation"},
+		NotBefore:             now,
+		NotAfter:              now.Add(attestationValidity),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+
+	c.attKey, c.attCert = key, der
+
+	return nil
+}
+
+// selectData selects an occurrence of the cardholder certificate for the next
+// GET DATA.
+func (c *Card) selectData(ca command) []byte {
+	if ca.p2 != 0x04 || int(ca.p1) >= len(c.crts) {
+		return swWrongParams
+	}
+
+	if !bytes.Equal(ca.data, selectedCrt) {
+		return swDataNotFound
+	}
+
+	c.occurrence = ca.p1
+
+	return swSuccess
+}
+
+// attest issues an attestation certificate for the encryption key and stores
+// it as the cardholder certificate of the key slot, like the Yubico ATTEST
+// command. Only the encryption key can be attested.
+func (c *Card) attest(ca command) []byte {
+	if ca.p2 != 0 || ca.p1 < 1 || ca.p1 > 3 {
+		return swWrongParams
+	}
+
+	if ca.p1 != 2 || c.fp == [20]byte{} {
+		return swDataNotFound
+	}
+
+	if !c.verified[pinBankUser] {
+		return swSecurityNotSatisfied
+	}
+
+	if err := c.initAttestation(); err != nil {
+		return swConditionsNotMet
+	}
+
+	issuer, err := x509.ParseCertificate(c.attCert)
+	if err != nil {
+		return swConditionsNotMet
+	}
+
+	source := []byte{0x00}
+	if c.generated {
+		source[0] = 0x01
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: new(big.Int).SetBytes(c.fp[:8]),
+		Subject:      pkix.Name{CommonName: "YubiKey OPGP Attestation Decipher"},
+		NotBefore:    issuer.NotBefore,
+		NotAfter:     issuer.NotAfter,
+		ExtraExtensions: []pkix.Extension{
+			yubicoExtension(1, []byte(c.Name)),
+			yubicoExtension(2, source),
+			yubicoExtension(3, firmwareVersion),
+			yubicoExtension(4, c.fp[:]),
+			yubicoExtension(5, binary.BigEndian.AppendUint32(nil, uint32(c.created.Unix()))),
+			yubicoExtension(7, c.Serial[:]),
+			yubicoExtension(8, c.uif[1]),
+		},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, issuer, &c.key.PublicKey, c.attKey)
+	if err != nil {
+		return swConditionsNotMet
+	}
+
+	// occurrences of the cardholder certificate are numbered from the
+	// authentication key slot
+	c.crts[3-ca.p1] = der
+
+	return swSuccess
+}
+
+func yubicoExtension(id int, value []byte) pkix.Extension {
+	oid := append(append(asn1.ObjectIdentifier{}, yubicoOIDArc...), id)
+	return pkix.Extension{Id: oid, Value: value}
+}
@@ -0,0 +1,98 @@
+package yubikeysim
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+// Load creates a simulated card backed by the RSA private key in the file at
+// the provided path. The file may contain a PEM-encoded PKCS #1 or PKCS #8
+// private key, or an unprotected OpenPGP secret key, either binary or ASCII
+// armored. For OpenPGP keys the encryption subkey and its creation time are
+// used, so the card reports the same fingerprint as the key, and an RSA
+// primary key is used as the signature key. PEM keys are reported with a
+// creation time of the Unix epoch.
+func Load(path string) (*Card, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if block, _ := pem.Decode(buf); block != nil {
+		key, err := parsePEMKey(block)
+		if err != nil {
+			return nil, err
+		}
+
+		return New(key, time.Unix(0, 0)), nil
+	}
+
+	return loadOpenPGPKey(buf)
+}
+
+func parsePEMKey(block *pem.Block) (*rsa.PrivateKey, error) {
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		rsaKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("only RSA private keys are supported by the simulated card")
+		}
+
+		return rsaKey, nil
+	}
+
+	return nil, fmt.Errorf("unsupported PEM block type '%s'", block.Type)
+}
+
+func loadOpenPGPKey(buf []byte) (*Card, error) {
+	el, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(buf))
+	if err != nil {
+		el, err = openpgp.ReadKeyRing(bytes.NewReader(buf))
+		if err != nil {
+			return nil, fmt.Errorf("could not parse OpenPGP secret key: %s", err)
+		}
+	}
+
+	for _, k := range el.DecryptionKeys() {
+		if k.PrivateKey == nil {
+			continue
+		}
+
+		if k.PrivateKey.Encrypted {
+			return nil, errors.New("passphrase protected OpenPGP keys are not supported by the simulated card")
+		}
+
+		key, ok := k.PrivateKey.PrivateKey.(*rsa.PrivateKey)
+		if !ok {
+			continue
+		}
+
+		c := New(key, k.PublicKey.CreationTime)
+
+		// an RSA primary key that is not the encryption key is the signature key
+		if pk := k.Entity.PrivateKey; pk != nil && pk != k.PrivateKey && !pk.Encrypted {
+			if signKey, ok := pk.PrivateKey.(*rsa.PrivateKey); ok {
+				c.SetSignatureKey(signKey, pk.CreationTime)
+			}
+		}
+
+		return c, nil
+	}
+
+	return nil, errors.New("no RSA encryption key found in OpenPGP secret key")
+}
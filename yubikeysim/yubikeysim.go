@@ -0,0 +1,838 @@
+// Package yubikeysim emulates the OpenPGP application of a Yubico YubiKey at
+// the APDU level. A simulated card implements yubikeyscard.Transport, so it
+// can be attached in place of a hardware token for tests and unseal drills.
+package yubikeysim
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/binary"
+	"math/big"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+const (
+	DefaultPIN      = "123456"
+	DefaultAdminPIN = "12345678"
+
+	defaultReaderName  = "Vervet Simulated OpenPGP Card 00"
+	defaultPINRetries  = 3
+	minPINLength       = 6
+	minAdminPINLength  = 8
+	minResetCodeLength = 8
+	maxPINLength       = 127
+	maxShortResponse   = 256
+	maxLength          = 0x800 // maximum command and response length announced for extended length APDUs
+	pinBankUser        = 0
+	pinBankResetCode   = 1
+	pinBankAdmin       = 2
+	rsaPubKeyExpLength = 17
+	keyStatus          = 0x02 // key imported into card
+	uifFixed           = 0x02
+	uifCachedFixed     = 0x04
+)
+
+var (
+	appID           = []byte{0xd2, 0x76, 0x00, 0x01, 0x24, 0x01} // OpenPGP applet ID
+	appVersion      = []byte{0x03, 0x04}
+	manufacturerID  = []byte{0x00, 0x06} // Yubico
+	histBytes       = []byte{0x00, 0x73, 0x00, 0x00, 0xe0, 0x05, 0x90, 0x00}
+	extCaps         = []byte{0x7d, 0x00, 0x0b, 0xfe, 0x08, 0x00, 0x00, 0xff, 0x00, 0x00}
+	uifDisabled     = []byte{0x00, 0x20}
+	kdfNone         = []byte{0x81, 0x01, 0x00}
+	firmwareVersion = []byte{0x05, 0x07, 0x01} // BCD
+)
+
+// status words returned by the simulated card
+var (
+	swSuccess              = []byte{0x90, 0x00}
+	swWrongLength          = []byte{0x67, 0x00}
+	swSecurityNotSatisfied = []byte{0x69, 0x82}
+	swAuthBlocked          = []byte{0x69, 0x83}
+	swConditionsNotMet     = []byte{0x69, 0x85}
+	swWrongData            = []byte{0x6a, 0x80}
+	swDataNotFound         = []byte{0x6a, 0x88}
+	swWrongParams          = []byte{0x6b, 0x00}
+	swInsNotSupported      = []byte{0x6d, 0x00}
+	swClaNotSupported      = []byte{0x6e, 0x00}
+)
+
+// Card is a software OpenPGP card. The encryption key slot is backed by an RSA
+// private key, the signature key slot holds an RSA key set with
+// SetSignatureKey, if any, and the authentication slot is empty. New RSA keys
+// can be generated in the encryption key slot.
+type Card struct {
+	ReaderName  string
+	Serial      [4]byte
+	Name        string
+	ShortAPDUs  bool  // reject extended length APDUs, so long commands must be chained
+	RSAKeySizes []int // supported RSA key sizes, 2048, 3072 and 4096 if empty
+	Untouched   bool  // fail decryption as if not touched in time when the touch policy requires it
+
+	mu       sync.Mutex
+	key      *rsa.PrivateKey
+	keyBits  int
+	created  time.Time
+	fp       [20]byte
+	selected bool
+	pins     [3][]byte
+	retries  [3]int
+	verified [3]bool
+	pw1Bank  uint8
+	kdf      []byte
+	uif      [4][]byte // user interaction flags of the key slots and attestation key
+	pending  []byte
+	chain    *command // data of chained commands received so far
+
+	signKey     *rsa.PrivateKey // key in the signature key slot, nil if empty
+	signFP      [20]byte
+	signCreated time.Time
+
+	generated  bool              // key in the encryption key slot was generated on the card
+	attKey     *ecdsa.PrivateKey // Yubico attestation key, created on first use
+	attCert    []byte
+	crts       [3][]byte // cardholder certificates, by occurrence
+	occurrence uint8     // cardholder certificate selected with SELECT DATA
+}
+
+// New creates a simulated card whose encryption key slot holds the provided
+// RSA private key. The creation time is used to compute the OpenPGP key
+// fingerprint reported by the card, and must match the time in the public key
+// messages were encrypted to.
+func New(key *rsa.PrivateKey, created time.Time) *Card {
+	c := &Card{
+		ReaderName: defaultReaderName,
+		key:        key,
+		keyBits:    key.N.BitLen(),
+		created:    created,
+		pins:       [3][]byte{[]byte(DefaultPIN), nil, []byte(DefaultAdminPIN)},
+		retries:    [3]int{defaultPINRetries, 0, defaultPINRetries},
+		kdf:        kdfNone,
+		uif:        [4][]byte{uifDisabled, uifDisabled, uifDisabled, uifDisabled},
+	}
+
+	// derive the serial number from the key fingerprint so that different
+	// keys are presented as different cards
+	c.fp = packet.NewRSAPublicKey(created, &key.PublicKey).Fingerprint
+	copy(c.Serial[:], c.fp[16:20])
+
+	return c
+}
+
+// SetSignatureKey stores the RSA private key in the signature key slot. The
+// creation time is used to compute the OpenPGP key fingerprint reported by the
+// card.
+func (c *Card) SetSignatureKey(key *rsa.PrivateKey, created time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.signKey = key
+	c.signCreated = created
+	c.signFP = packet.NewRSAPublicKey(created, &key.PublicKey).Fingerprint
+}
+
+// Transmit processes a serialized command APDU and returns the response APDU.
+func (c *Card) Transmit(cmd []byte) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ca, err := parseCommand(cmd)
+	if err != nil || (ca.extended && c.ShortAPDUs) {
+		return swWrongLength, nil
+	}
+
+	// collect the data of chained commands until the last command of the
+	// chain, which is processed with the data of the whole chain. A command
+	// with another header aborts the chain.
+	if c.chain != nil && c.chain.sameHeader(ca) {
+		ca.data = append(append([]byte{}, c.chain.data...), ca.data...)
+	}
+
+	c.chain = nil
+
+	if ca.cla&claChaining != 0 {
+		ca.cla &^= claChaining
+		c.chain = &ca
+
+		return swSuccess, nil
+	}
+
+	if ca.cla != 0 && (ca.cla != 0x80 || ca.ins != insAttest) {
+		return swClaNotSupported, nil
+	}
+
+	if ca.ins != insGetResponse {
+		c.pending = nil
+	}
+
+	switch ca.ins {
+	case insSelect:
+		return c.selectApp(ca), nil
+	case insGetResponse:
+		return c.getResponse(ca), nil
+	}
+
+	if !c.selected {
+		return swInsNotSupported, nil
+	}
+
+	switch ca.ins {
+	case insGetData:
+		return c.getData(ca), nil
+	case insVerify:
+		return c.verify(ca), nil
+	case insPSO:
+		return c.pso(ca), nil
+	case insGenerateKey:
+		return c.generateKey(ca), nil
+	case insPutData:
+		return c.putData(ca), nil
+	case insPutDataOdd:
+		return c.importKey(ca), nil
+	case insChangeRefData:
+		return c.changeReferenceData(ca), nil
+	case insResetRetryCounter:
+		return c.resetRetryCounter(ca), nil
+	case insSelectData:
+		return c.selectData(ca), nil
+	case insGetVersion:
+		return c.respond(firmwareVersion, ca.ne), nil
+	case insAttest:
+		return c.attest(ca), nil
+	}
+
+	return swInsNotSupported, nil
+}
+
+// Disconnect resets the card, clearing the application selection and the
+// verified state of all PINs.
+func (c *Card) Disconnect() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.selected = false
+	c.verified = [3]bool{}
+	c.pending = nil
+	c.chain = nil
+	c.occurrence = 0
+
+	return nil
+}
+
+// Reader returns the name of the simulated reader.
+func (c *Card) Reader() string {
+	return c.ReaderName
+}
+
+// PINRetries returns the remaining retries of the user PIN, reset code and
+// admin PIN.
+func (c *Card) PINRetries() (pw1, rc, pw3 int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.retries[pinBankUser], c.retries[pinBankResetCode], c.retries[pinBankAdmin]
+}
+
+func (c *Card) selectApp(ca command) []byte {
+	if ca.p1 != 0x04 || !bytes.HasPrefix(ca.data, appID) {
+		return []byte{0x6a, 0x82}
+	}
+
+	c.selected = true
+	c.verified = [3]bool{}
+	c.occurrence = 0
+
+	return swSuccess
+}
+
+func (c *Card) getResponse(ca command) []byte {
+	if c.pending == nil {
+		return swConditionsNotMet
+	}
+
+	data := c.pending
+	c.pending = nil
+
+	return c.respond(data, ca.ne)
+}
+
+// respond returns the response data with a success status, or the first
+// chunk of the data followed by a 61xx status when it exceeds the expected
+// length. Commands with an extended Le receive up to the maximum response
+// length at once. The remainder is served with GET RESPONSE.
+func (c *Card) respond(data []byte, ne int) []byte {
+	if ne == 0 {
+		ne = maxShortResponse
+	}
+
+	ne = min(ne, maxLength)
+
+	if len(data) <= ne {
+		return append(append([]byte{}, data...), swSuccess...)
+	}
+
+	c.pending = data[ne:]
+
+	remaining := len(c.pending)
+	if remaining > 0xff {
+		remaining = 0
+	}
+
+	return append(append([]byte{}, data[:ne]...), 0x61, uint8(remaining))
+}
+
+func (c *Card) getData(ca command) []byte {
+	var data []byte
+
+	switch uint16(ca.p1)<<8 | uint16(ca.p2) {
+	case 0x0065:
+		data = c.cardRelatedData()
+	case 0x006e:
+		data = c.appRelatedData()
+	case 0x00c4:
+		data = c.pwStatus()
+	case 0x004f:
+		data = c.aid()
+	case 0x5f52:
+		data = c.histBytes()
+	case 0x00f9:
+		data = c.kdf
+	case 0x00fa:
+		data = c.algoInfo()
+	case 0x7f21:
+		data = c.crts[c.occurrence]
+	case 0x00fc:
+		if err := c.initAttestation(); err != nil {
+			return swConditionsNotMet
+		}
+
+		data = c.attCert
+	default:
+		return swDataNotFound
+	}
+
+	return c.respond(data, ca.ne)
+}
+
+func (c *Card) verify(ca command) []byte {
+	if ca.p1 != 0 || ca.p2 < 0x81 || ca.p2 > 0x83 {
+		return swWrongParams
+	}
+
+	bank := pinBankUser
+	if ca.p2 == 0x83 {
+		bank = pinBankAdmin
+	}
+
+	// an empty VERIFY returns the verification state
+	if len(ca.data) == 0 {
+		if c.verified[bank] && (bank == pinBankAdmin || c.pw1Bank == ca.p2) {
+			return swSuccess
+		}
+
+		return []byte{0x63, 0xc0 | uint8(c.retries[bank])}
+	}
+
+	if c.retries[bank] == 0 {
+		return swAuthBlocked
+	}
+
+	if !bytes.Equal(ca.data, c.pins[bank]) {
+		return c.wrongPIN(bank)
+	}
+
+	c.retries[bank] = defaultPINRetries
+	c.verified[bank] = true
+
+	if bank == pinBankUser {
+		c.pw1Bank = ca.p2
+	}
+
+	return swSuccess
+}
+
+// wrongPIN counts a failed attempt against the PIN bank and returns the status
+// reporting the remaining retries.
+func (c *Card) wrongPIN(bank int) []byte {
+	c.retries[bank]--
+	c.verified[bank] = false
+
+	if c.retries[bank] == 0 {
+		return swAuthBlocked
+	}
+
+	return []byte{0x63, 0xc0 | uint8(c.retries[bank])}
+}
+
+// changeReferenceData replaces the user or admin PIN. The command data is the
+// current PIN followed by the new PIN.
+func (c *Card) changeReferenceData(ca command) []byte {
+	if ca.p1 != 0 || (ca.p2 != 0x81 && ca.p2 != 0x83) {
+		return swWrongParams
+	}
+
+	bank, minLength := pinBankUser, minPINLength
+	if ca.p2 == 0x83 {
+		bank, minLength = pinBankAdmin, minAdminPINLength
+	}
+
+	if c.retries[bank] == 0 {
+		return swAuthBlocked
+	}
+
+	pin := c.pins[bank]
+	if len(ca.data) < len(pin) || !bytes.Equal(ca.data[:len(pin)], pin) {
+		return c.wrongPIN(bank)
+	}
+
+	newPIN := ca.data[len(pin):]
+	if len(newPIN) < minLength || len(newPIN) > maxPINLength {
+		return swWrongLength
+	}
+
+	c.pins[bank] = append([]byte{}, newPIN...)
+	c.retries[bank] = defaultPINRetries
+	c.verified[bank] = false
+
+	return swSuccess
+}
+
+// resetRetryCounter sets a new user PIN and resets its retry counter. The
+// command data is the reset code followed by the new PIN, or only the new PIN
+// if the admin PIN is verified.
+func (c *Card) resetRetryCounter(ca command) []byte {
+	if ca.p2 != 0x81 {
+		return swWrongParams
+	}
+
+	newPIN := ca.data
+
+	switch ca.p1 {
+	case 0x00:
+		rc := c.pins[pinBankResetCode]
+		if c.retries[pinBankResetCode] == 0 {
+			return swAuthBlocked
+		}
+
+		if len(ca.data) < len(rc) || !bytes.Equal(ca.data[:len(rc)], rc) {
+			return c.wrongPIN(pinBankResetCode)
+		}
+
+		c.retries[pinBankResetCode] = defaultPINRetries
+		newPIN = ca.data[len(rc):]
+	case 0x02:
+		if !c.verified[pinBankAdmin] {
+			return swSecurityNotSatisfied
+		}
+	default:
+		return swWrongParams
+	}
+
+	if len(newPIN) < minPINLength || len(newPIN) > maxPINLength {
+		return swWrongLength
+	}
+
+	c.pins[pinBankUser] = append([]byte{}, newPIN...)
+	c.retries[pinBankUser] = defaultPINRetries
+	c.verified[pinBankUser] = false
+
+	return swSuccess
+}
+
+func (c *Card) pso(ca command) []byte {
+	// PSO:COMPUTE DIGITAL SIGNATURE and PSO:DECIPHER are supported
+	if ca.p1 == 0x9e && ca.p2 == 0x9a {
+		return c.sign(ca)
+	}
+
+	if ca.p1 != 0x80 || ca.p2 != 0x86 {
+		return swWrongParams
+	}
+
+	if !c.verified[pinBankUser] || c.pw1Bank != 0x82 {
+		return swSecurityNotSatisfied
+	}
+
+	if c.Untouched && c.uif[1][0] != 0 {
+		return swSecurityNotSatisfied
+	}
+
+	// first byte is the padding indicator, 0x00 for RSA
+	if len(ca.data) < 2 || ca.data[0] != 0 {
+		return swWrongData
+	}
+
+	pt, err := rsa.DecryptPKCS1v15(rand.Reader, c.key, ca.data[1:])
+	if err != nil {
+		return swWrongData
+	}
+
+	return c.respond(pt, ca.ne)
+}
+
+// sign signs the DigestInfo in the command data with the signature key. The
+// PIN is valid for a single signature, as the PW status bytes announce.
+func (c *Card) sign(ca command) []byte {
+	if c.signKey == nil {
+		return swConditionsNotMet
+	}
+
+	if !c.verified[pinBankUser] || c.pw1Bank != 0x81 {
+		return swSecurityNotSatisfied
+	}
+
+	c.verified[pinBankUser] = false
+
+	sig, err := rsa.SignPKCS1v15(nil, c.signKey, 0, ca.data)
+	if err != nil {
+		return swWrongData
+	}
+
+	return c.respond(sig, ca.ne)
+}
+
+// generateKey generates a new RSA key in the encryption key slot, or reads
+// the public key of the encryption or signature key slot. The authentication
+// key slot is empty.
+func (c *Card) generateKey(ca command) []byte {
+	if ca.p1 != 0x80 && ca.p1 != 0x81 {
+		return swWrongParams
+	}
+
+	if len(ca.data) != 2 || ca.data[1] != 0 {
+		return swWrongData
+	}
+
+	// control reference template of the signature key slot
+	if ca.data[0] == 0xb6 && ca.p1 == 0x81 && c.signKey != nil {
+		return c.respond(tlv(0x7f49,
+			tlv(0x81, c.signKey.N.Bytes()),
+			tlv(0x82, big.NewInt(int64(c.signKey.E)).Bytes())), ca.ne)
+	}
+
+	// control reference template of the encryption key slot
+	if ca.data[0] != 0xb8 {
+		return swDataNotFound
+	}
+
+	if ca.p1 == 0x80 {
+		if !c.verified[pinBankAdmin] {
+			return swSecurityNotSatisfied
+		}
+
+		key, err := rsa.GenerateKey(rand.Reader, c.keyBits)
+		if err != nil {
+			return swConditionsNotMet
+		}
+
+		// the fingerprint and generation time are written by the host
+		c.key = key
+		c.fp = [20]byte{}
+		c.created = time.Unix(0, 0)
+		c.generated = true
+	}
+
+	return c.respond(tlv(0x7f49,
+		tlv(0x81, c.key.N.Bytes()),
+		tlv(0x82, big.NewInt(int64(c.key.E)).Bytes())), ca.ne)
+}
+
+// putData writes the algorithm attributes, fingerprint and generation time of
+// the encryption key slot, the reset code, the KDF data object and the touch
+// policies. Only RSA keys are supported.
+func (c *Card) putData(ca command) []byte {
+	if !c.verified[pinBankAdmin] {
+		return swSecurityNotSatisfied
+	}
+
+	switch uint16(ca.p1)<<8 | uint16(ca.p2) {
+	case 0x00c2:
+		if len(ca.data) < 5 || ca.data[0] != 0x01 {
+			return swWrongData
+		}
+
+		bits := int(binary.BigEndian.Uint16(ca.data[1:3]))
+		if !slices.Contains(c.rsaKeySizes(), bits) {
+			return swWrongData
+		}
+
+		c.keyBits = bits
+	case 0x00c8:
+		if len(ca.data) != len(c.fp) {
+			return swWrongLength
+		}
+
+		copy(c.fp[:], ca.data)
+	case 0x00d3:
+		// an empty reset code disables unblocking with the reset code
+		if len(ca.data) > 0 && (len(ca.data) < minResetCodeLength || len(ca.data) > maxPINLength) {
+			return swWrongLength
+		}
+
+		c.pins[pinBankResetCode] = nil
+		c.retries[pinBankResetCode] = 0
+
+		if len(ca.data) > 0 {
+			c.pins[pinBankResetCode] = append([]byte{}, ca.data...)
+			c.retries[pinBankResetCode] = defaultPINRetries
+		}
+	case 0x00f9:
+		return c.setKDF(ca.data)
+	case 0x00d6, 0x00d7, 0x00d8, 0x00d9:
+		i := ca.p2 - 0xd6
+
+		// fixed policies can only be changed by a reset
+		if c.uif[i][0] == uifFixed || c.uif[i][0] == uifCachedFixed {
+			return swConditionsNotMet
+		}
+
+		if len(ca.data) != 2 || ca.data[0] > uifCachedFixed {
+			return swWrongData
+		}
+
+		c.uif[i] = append([]byte{}, ca.data...)
+	case 0x00cf:
+		if len(ca.data) != 4 {
+			return swWrongLength
+		}
+
+		c.created = time.Unix(int64(binary.BigEndian.Uint32(ca.data)), 0)
+	default:
+		return swDataNotFound
+	}
+
+	return swSuccess
+}
+
+// setKDF writes the KDF data object. The PINs are reset to the initial PIN
+// hashes of the data object, or to the default PINs if KDF is disabled, and
+// the reset code is removed.
+func (c *Card) setKDF(data []byte) []byte {
+	pins := [3][]byte{[]byte(DefaultPIN), nil, []byte(DefaultAdminPIN)}
+
+	for b := data; len(b) > 0; {
+		tag, value, rest, err := parseTLV(b)
+		if err != nil {
+			return swWrongData
+		}
+
+		switch tag {
+		case 0x87:
+			pins[pinBankUser] = append([]byte{}, value...)
+		case 0x88:
+			pins[pinBankAdmin] = append([]byte{}, value...)
+		}
+
+		b = rest
+	}
+
+	c.kdf = append([]byte{}, data...)
+	c.pins = pins
+	c.retries = [3]int{defaultPINRetries, 0, defaultPINRetries}
+	c.verified = [3]bool{}
+
+	return swSuccess
+}
+
+// importKey imports an RSA private key into the encryption key slot from an
+// extended header list in the standard import format (e, p, q).
+func (c *Card) importKey(ca command) []byte {
+	if ca.p1 != 0x3f || ca.p2 != 0xff {
+		return swWrongParams
+	}
+
+	if !c.verified[pinBankAdmin] {
+		return swSecurityNotSatisfied
+	}
+
+	tag, ehl, _, err := parseTLV(ca.data)
+	if err != nil || tag != 0x4d {
+		return swWrongData
+	}
+
+	crt, rest, err := parseTLVTag(ehl)
+	if err != nil || crt != 0xb8 || len(rest) < 1 || rest[0] != 0 {
+		return swDataNotFound
+	}
+
+	tag, tmpl, rest, err := parseTLV(rest[1:])
+	if err != nil || tag != 0x7f48 {
+		return swWrongData
+	}
+
+	tag, values, _, err := parseTLV(rest)
+	if err != nil || tag != 0x5f48 {
+		return swWrongData
+	}
+
+	// the template lists the tag and length of each component in values
+	components := map[uint16][]byte{}
+	for len(tmpl) > 0 {
+		var n int
+
+		tag, tmpl, err = parseTLVTag(tmpl)
+		if err == nil {
+			n, tmpl, err = parseTLVLength(tmpl)
+		}
+		if err != nil || n > len(values) {
+			return swWrongData
+		}
+
+		components[tag], values = values[:n], values[n:]
+	}
+
+	e, p, q := components[0x91], components[0x92], components[0x93]
+	if e == nil || p == nil || q == nil {
+		return swWrongData
+	}
+
+	key := &rsa.PrivateKey{
+		PublicKey: rsa.PublicKey{E: int(new(big.Int).SetBytes(e).Int64())},
+		Primes:    []*big.Int{new(big.Int).SetBytes(p), new(big.Int).SetBytes(q)},
+	}
+	key.N = new(big.Int).Mul(key.Primes[0], key.Primes[1])
+
+	one := big.NewInt(1)
+	phi := new(big.Int).Mul(new(big.Int).Sub(key.Primes[0], one), new(big.Int).Sub(key.Primes[1], one))
+	key.D = new(big.Int).ModInverse(big.NewInt(int64(key.E)), phi)
+
+	if key.D == nil || key.N.BitLen() != c.keyBits || key.Validate() != nil {
+		return swWrongData
+	}
+
+	key.Precompute()
+
+	// the fingerprint and generation time are written by the host
+	c.key = key
+	c.fp = [20]byte{}
+	c.created = time.Unix(0, 0)
+	c.generated = false
+
+	return swSuccess
+}
+
+func (c *Card) aid() []byte {
+	aid := append([]byte{}, appID...)
+	aid = append(aid, appVersion...)
+	aid = append(aid, manufacturerID...)
+	aid = append(aid, c.Serial[:]...)
+	return append(aid, 0x00, 0x00)
+}
+
+func (c *Card) pwStatus() []byte {
+	return []byte{0x00, maxPINLength, maxPINLength, maxPINLength,
+		uint8(c.retries[pinBankUser]),
+		uint8(c.retries[pinBankResetCode]),
+		uint8(c.retries[pinBankAdmin])}
+}
+
+func (c *Card) cardRelatedData() []byte {
+	return tlv(0x65,
+		tlv(0x5b, []byte(c.Name)),
+		tlv(0x5f2d, []byte("en")),
+		tlv(0x5f35, []byte{0x39}))
+}
+
+func (c *Card) appRelatedData() []byte {
+	var algoAttr, fingerprints, genDates [3][]byte
+
+	// empty key slots
+	for i := range algoAttr {
+		algoAttr[i] = rsaAlgoAttr(2048)
+		fingerprints[i] = make([]byte, 20)
+		genDates[i] = make([]byte, 4)
+	}
+
+	algoAttr[1] = rsaAlgoAttr(c.keyBits)
+	fingerprints[1] = c.fp[:]
+	binary.BigEndian.PutUint32(genDates[1], uint32(c.created.Unix()))
+
+	keyInfo := []byte{0x01, 0x00, 0x02, keyStatus, 0x03, 0x00}
+
+	if c.signKey != nil {
+		keyInfo[1] = keyStatus
+		algoAttr[0] = rsaAlgoAttr(c.signKey.N.BitLen())
+		fingerprints[0] = c.signFP[:]
+		binary.BigEndian.PutUint32(genDates[0], uint32(c.signCreated.Unix()))
+	}
+
+	return tlv(0x6e,
+		tlv(0x4f, c.aid()),
+		tlv(0x5f52, c.histBytes()),
+		tlv(0x7f74, tlv(0x81, []byte{0x20})),
+		tlv(0x73,
+			tlv(0xc0, extCaps),
+			tlv(0xc1, algoAttr[0]),
+			tlv(0xc2, algoAttr[1]),
+			tlv(0xc3, algoAttr[2]),
+			tlv(0xc4, c.pwStatus()),
+			tlv(0xc5, bytes.Join(fingerprints[:], nil)),
+			tlv(0xc6, make([]byte, 60)),
+			tlv(0xcd, bytes.Join(genDates[:], nil)),
+			tlv(0xde, keyInfo),
+			c.extLenInfo(),
+			tlv(0xd6, c.uif[0]),
+			tlv(0xd7, c.uif[1]),
+			tlv(0xd8, c.uif[2]),
+			tlv(0xd9, c.uif[3])))
+}
+
+// histBytes returns the historical bytes, which announce command chaining and,
+// unless the card accepts short APDUs only, extended length fields.
+func (c *Card) histBytes() []byte {
+	if !c.ShortAPDUs {
+		return histBytes
+	}
+
+	b := append([]byte{}, histBytes...)
+	b[4] = 0x80
+
+	return b
+}
+
+// extLenInfo returns the extended length information DO, which is absent if
+// the card accepts short APDUs only.
+func (c *Card) extLenInfo() []byte {
+	if c.ShortAPDUs {
+		return nil
+	}
+
+	n := binary.BigEndian.AppendUint16(nil, maxLength)
+
+	return tlv(0x7f66, tlv(0x02, n), tlv(0x02, n))
+}
+
+// algoInfo returns the algorithm information DO, which lists the RSA key sizes
+// the card announces for each key slot.
+func (c *Card) algoInfo() []byte {
+	var info []byte
+	for _, tag := range []uint16{0xc1, 0xc2, 0xc3} {
+		for _, bits := range c.rsaKeySizes() {
+			info = append(info, tlv(tag, rsaAlgoAttr(bits))...)
+		}
+	}
+
+	return tlv(0xfa, info)
+}
+
+// rsaKeySizes returns the RSA key sizes the card supports.
+func (c *Card) rsaKeySizes() []int {
+	if len(c.RSAKeySizes) == 0 {
+		return []int{2048, 3072, 4096}
+	}
+
+	return c.RSAKeySizes
+}
+
+func rsaAlgoAttr(bits int) []byte {
+	attr := []byte{0x01, 0, 0, 0, 0, 0x00}
+	binary.BigEndian.PutUint16(attr[1:3], uint16(bits))
+	binary.BigEndian.PutUint16(attr[3:5], rsaPubKeyExpLength)
+	return attr
+}
@@ -0,0 +1,463 @@
+package yubikeysim_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"vervet/yubikeypgp"
+	"vervet/yubikeyscard"
+	"vervet/yubikeysim"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// attachCard returns a simulated card backed by a new RSA key, attached to a
+// set of YubiKeys.
+func attachCard(t *testing.T) (*yubikeysim.Card, *yubikeyscard.YubiKeys, *yubikeyscard.YubiKey) {
+	t.Helper()
+
+	card := newCard(t)
+	yks, yk := attach(t, card)
+
+	return card, yks, yk
+}
+
+func newCard(t *testing.T) *yubikeysim.Card {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return yubikeysim.New(key, time.Unix(time.Now().Unix(), 0))
+}
+
+func attach(t *testing.T, card *yubikeysim.Card) (*yubikeyscard.YubiKeys, *yubikeyscard.YubiKey) {
+	t.Helper()
+
+	yks := new(yubikeyscard.YubiKeys)
+	yk, err := yks.Attach(card)
+	if err != nil {
+		t.Fatalf("Attach() error = %v", err)
+	}
+
+	t.Cleanup(func() { yks.Disconnect() })
+
+	return yks, yk
+}
+
+// encryptToCard encrypts the message to the public key in the encryption key
+// slot of the card.
+func encryptToCard(t *testing.T, yk *yubikeyscard.YubiKey, msg []byte) []byte {
+	t.Helper()
+
+	pk, err := yubikeypgp.CardPublicKey(yk, yubikeyscard.KeySlotEnc)
+	if err != nil {
+		t.Fatalf("CardPublicKey() error = %v", err)
+	}
+
+	ct, err := yubikeypgp.Encrypt(msg, []*yubikeypgp.PublicKey{pk})
+	if err != nil {
+		t.Fatalf("Encrypt() error = %v", err)
+	}
+
+	return ct
+}
+
+func pinPrompt(pin string) yubikeypgp.PinPromptFunction {
+	return func() ([]byte, error) {
+		return []byte(pin), nil
+	}
+}
+
+func TestReadMessage(t *testing.T) {
+	card, yks, yk := attachCard(t)
+
+	msg := []byte("unseal key share")
+	ct := encryptToCard(t, yk, msg)
+
+	md, retries, err := yubikeypgp.ReadMessage(yks, ct, pinPrompt(yubikeysim.DefaultPIN), nil)
+	if err != nil {
+		t.Fatalf("ReadMessage() error = %v", err)
+	}
+
+	if retries != -1 {
+		t.Errorf("ReadMessage() retries = %d, want -1", retries)
+	}
+
+	if !bytes.Equal(md.Body, msg) {
+		t.Errorf("ReadMessage() body = %q, want %q", md.Body, msg)
+	}
+
+	if md.YubiKey != yk {
+		t.Error("ReadMessage() did not report the simulated card")
+	}
+
+	if pw1, _, _ := card.PINRetries(); pw1 != 3 {
+		t.Errorf("PIN retries = %d, want 3", pw1)
+	}
+}
+
+func TestReadMessageWrongPIN(t *testing.T) {
+	card, yks, yk := attachCard(t)
+
+	msg := []byte("unseal key share")
+	ct := encryptToCard(t, yk, msg)
+
+	for want := 2; want >= 0; want-- {
+		md, retries, err := yubikeypgp.ReadMessage(yks, ct, pinPrompt("654321"), nil)
+		if err == nil {
+			t.Fatal("ReadMessage() with wrong PIN succeeded")
+		}
+
+		if retries != want {
+			t.Errorf("ReadMessage() retries = %d, want %d", retries, want)
+		}
+
+		if pw1, _, _ := card.PINRetries(); pw1 != want {
+			t.Errorf("PIN retries = %d, want %d", pw1, want)
+		}
+
+		if md.YubiKey != yk {
+			t.Error("ReadMessage() did not report the card that rejected the PIN")
+		}
+	}
+
+	// the PIN is blocked once the retries are used up
+	if _, _, err := yubikeypgp.ReadMessage(yks, ct, pinPrompt(yubikeysim.DefaultPIN), nil); err == nil {
+		t.Fatal("ReadMessage() with blocked PIN succeeded")
+	}
+}
+
+func TestReadMessageRetriesReset(t *testing.T) {
+	card, yks, yk := attachCard(t)
+
+	msg := []byte("unseal key share")
+	ct := encryptToCard(t, yk, msg)
+
+	if _, _, err := yubikeypgp.ReadMessage(yks, ct, pinPrompt("654321"), nil); err == nil {
+		t.Fatal("ReadMessage() with wrong PIN succeeded")
+	}
+
+	md, _, err := yubikeypgp.ReadMessage(yks, ct, pinPrompt(yubikeysim.DefaultPIN), nil)
+	if err != nil {
+		t.Fatalf("ReadMessage() error = %v", err)
+	}
+
+	if !bytes.Equal(md.Body, msg) {
+		t.Errorf("ReadMessage() body = %q, want %q", md.Body, msg)
+	}
+
+	// a correct PIN resets the retry counter
+	if pw1, _, _ := card.PINRetries(); pw1 != 3 {
+		t.Errorf("PIN retries = %d, want 3", pw1)
+	}
+}
+
+func TestReadMessageOtherKey(t *testing.T) {
+	_, yks, _ := attachCard(t)
+	_, _, other := attachCard(t)
+
+	ct := encryptToCard(t, other, []byte("unseal key share"))
+
+	_, _, err := yubikeypgp.ReadMessage(yks, ct, pinPrompt(yubikeysim.DefaultPIN), nil)
+
+	var knf *yubikeypgp.KeyNotFoundError
+	if !errors.As(err, &knf) {
+		t.Errorf("ReadMessage() error = %v, want KeyNotFoundError", err)
+	}
+}
+
+// wildcardRecipient replaces the key ID of the encrypted key packets with the
+// wildcard key ID.
+func wildcardRecipient(t *testing.T, yk *yubikeyscard.YubiKey, ct []byte) []byte {
+	t.Helper()
+
+	fp := yk.AppRelatedData.Fingerprints.Enc
+
+	i := bytes.Index(ct, fp[12:20])
+	if i < 0 {
+		t.Fatal("key ID not found in message")
+	}
+
+	ct = append([]byte{}, ct...)
+	copy(ct[i:i+8], make([]byte, 8))
+
+	return ct
+}
+
+func TestReadMessageWildcard(t *testing.T) {
+	yks := new(yubikeyscard.YubiKeys)
+	t.Cleanup(func() { yks.Disconnect() })
+
+	var cards []*yubikeysim.Card
+	var yk *yubikeyscard.YubiKey
+
+	for i := 0; i < 2; i++ {
+		card := newCard(t)
+		card.ReaderName = fmt.Sprintf("Simulated Reader %d", i)
+
+		var err error
+		if yk, err = yks.Attach(card); err != nil {
+			t.Fatalf("Attach() error = %v", err)
+		}
+
+		cards = append(cards, card)
+	}
+
+	// the message is addressed to the second card, the first card rejects
+	// the session key
+	msg := []byte("unseal key share")
+	ct := wildcardRecipient(t, yk, encryptToCard(t, yk, msg))
+
+	md, _, err := yubikeypgp.ReadMessage(yks, ct, pinPrompt(yubikeysim.DefaultPIN), nil)
+	if err != nil {
+		t.Fatalf("ReadMessage() error = %v", err)
+	}
+
+	if !bytes.Equal(md.Body, msg) || md.YubiKey != yk {
+		t.Errorf("ReadMessage() body = %q from %v, want %q from the second card", md.Body, md.YubiKey, msg)
+	}
+
+	// a card that is not touched fails instead of being skipped
+	first := yks.YubiKeys[0]
+	if _, err := first.VerifyPIN(3, []byte(yubikeysim.DefaultAdminPIN)); err != nil {
+		t.Fatalf("VerifyPIN() error = %v", err)
+	}
+
+	if err := first.SetTouchPolicy(yubikeyscard.KeySlotEnc, yubikeyscard.TouchPolicyOn); err != nil {
+		t.Fatalf("SetTouchPolicy() error = %v", err)
+	}
+
+	cards[0].Untouched = true
+
+	_, _, err = yubikeypgp.ReadMessage(yks, ct, pinPrompt(yubikeysim.DefaultPIN), nil)
+	if err == nil || !strings.Contains(err.Error(), "not touched") {
+		t.Errorf("ReadMessage() error = %v, want touch timeout", err)
+	}
+}
+
+// TestRejectedAlgorithm checks that keys the card does not announce in its
+// algorithm information are rejected before the key slot is changed.
+func TestRejectedAlgorithm(t *testing.T) {
+	card := newCard(t)
+	card.RSAKeySizes = []int{2048}
+
+	yks, yk := attach(t, card)
+	ct := encryptToCard(t, yk, []byte("unseal key share"))
+
+	if _, err := yk.VerifyPIN(3, []byte(yubikeysim.DefaultAdminPIN)); err != nil {
+		t.Fatalf("VerifyPIN() error = %v", err)
+	}
+
+	attr, err := yubikeyscard.AlgoAttrByName("rsa4096", yubikeyscard.KeySlotEnc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "card does not support rsa4096 keys"
+
+	if _, err := yubikeypgp.GenerateKey(yk, yubikeyscard.KeySlotEnc, attr); err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("GenerateKey() error = %v, want %q", err, want)
+	}
+
+	key := &yubikeyscard.PrivateKey{Exponent: []byte{0x01, 0x00, 0x01}, P: make([]byte, 256), Q: make([]byte, 256)}
+	if err := yk.ImportKey(yubikeyscard.KeySlotEnc, attr, key); err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("ImportKey() error = %v, want %q", err, want)
+	}
+
+	// the key in the slot is unchanged
+	if _, _, err := yubikeypgp.ReadMessage(yks, ct, pinPrompt(yubikeysim.DefaultPIN), nil); err != nil {
+		t.Errorf("ReadMessage() error = %v", err)
+	}
+}
+
+// TestCardCertificate checks that the certificate of the card keys is accepted
+// by the OpenPGP implementation Vault uses and decrypts with the card.
+func TestCardCertificate(t *testing.T) {
+	card := newCard(t)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	card.SetSignatureKey(key, time.Unix(time.Now().Unix(), 0))
+
+	yks, yk := attach(t, card)
+
+	cert, err := yubikeypgp.CardCertificate(yk, "Jane Officer <jane@example.com>", []byte(yubikeysim.DefaultPIN))
+	if err != nil {
+		t.Fatalf("CardCertificate() error = %v", err)
+	}
+
+	e, err := openpgp.ReadEntity(packet.NewReader(bytes.NewReader(cert.Serialize())))
+	if err != nil {
+		t.Fatalf("ReadEntity() error = %v", err)
+	}
+
+	if _, ok := e.Identities["Jane Officer <jane@example.com>"]; !ok {
+		t.Error("ReadEntity() did not find the user ID")
+	}
+
+	pks, err := yubikeypgp.ParsePublicKeys(cert.Serialize())
+	if err != nil {
+		t.Fatalf("ParsePublicKeys() error = %v", err)
+	}
+
+	if pks[0].Fingerprint != yk.AppRelatedData.Fingerprints.Enc {
+		t.Errorf("ParsePublicKeys() chose key %X, want the encryption key", pks[0].KeyID)
+	}
+
+	msg := []byte("unseal key share")
+
+	var ct bytes.Buffer
+	w, err := openpgp.Encrypt(&ct, []*openpgp.Entity{e}, nil, nil, nil)
+	if err != nil {
+		t.Fatalf("Encrypt() error = %v", err)
+	}
+
+	w.Write(msg)
+	w.Close()
+
+	md, _, err := yubikeypgp.ReadMessage(yks, ct.Bytes(), pinPrompt(yubikeysim.DefaultPIN), nil)
+	if err != nil {
+		t.Fatalf("ReadMessage() error = %v", err)
+	}
+
+	if !bytes.Equal(md.Body, msg) {
+		t.Errorf("ReadMessage() body = %q, want %q", md.Body, msg)
+	}
+}
+
+func TestCardCertificateNoSignatureKey(t *testing.T) {
+	_, _, yk := attachCard(t)
+
+	if _, err := yubikeypgp.CardCertificate(yk, "Jane Officer <jane@example.com>", []byte(yubikeysim.DefaultPIN)); err == nil {
+		t.Error("CardCertificate() without signature key succeeded")
+	}
+}
+
+// TestAttest checks the attestation statement of an imported key and of a key
+// generated on the card against the attestation certificate of the card.
+func TestAttest(t *testing.T) {
+	card, _, yk := attachCard(t)
+
+	root, err := card.AttestationCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+
+	if _, err := yk.VerifyPIN(1, []byte(yubikeysim.DefaultPIN)); err != nil {
+		t.Fatalf("VerifyPIN() error = %v", err)
+	}
+
+	att, err := yk.Attest(yubikeyscard.KeySlotEnc)
+	if err != nil {
+		t.Fatalf("Attest() error = %v", err)
+	}
+
+	fp := yk.AppRelatedData.Fingerprints.Enc
+	if !bytes.Equal(att.Fingerprint, fp[:]) || att.Generated() || att.TouchPolicy != yubikeyscard.TouchPolicyOff {
+		t.Errorf("Attest() fingerprint %x, generated %v, touch policy %s", att.Fingerprint, att.Generated(), att.TouchPolicy)
+	}
+
+	if err := att.Verify(roots, nil); err != nil {
+		t.Errorf("Verify() error = %v", err)
+	}
+
+	// a chain to another root is rejected
+	other := newCard(t)
+	otherRoot, err := other.AttestationCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	otherRoots := x509.NewCertPool()
+	otherRoots.AddCert(otherRoot)
+
+	if err := att.Verify(otherRoots, nil); err == nil {
+		t.Error("Verify() with another root succeeded")
+	}
+
+	if _, err := yk.VerifyPIN(3, []byte(yubikeysim.DefaultAdminPIN)); err != nil {
+		t.Fatalf("VerifyPIN() error = %v", err)
+	}
+
+	attr, err := yubikeyscard.AlgoAttrByName("rsa2048", yubikeyscard.KeySlotEnc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := yubikeypgp.GenerateKey(yk, yubikeyscard.KeySlotEnc, attr); err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+
+	if _, err := yk.VerifyPIN(1, []byte(yubikeysim.DefaultPIN)); err != nil {
+		t.Fatalf("VerifyPIN() error = %v", err)
+	}
+
+	if att, err = yk.Attest(yubikeyscard.KeySlotEnc); err != nil {
+		t.Fatalf("Attest() error = %v", err)
+	}
+
+	fp = yk.AppRelatedData.Fingerprints.Enc
+	if !bytes.Equal(att.Fingerprint, fp[:]) || !att.Generated() {
+		t.Errorf("Attest() of generated key fingerprint %x, generated %v", att.Fingerprint, att.Generated())
+	}
+}
+
+// TestExtendedLe checks that long responses are read with an extended Le from
+// cards that support it, and with GET RESPONSE from cards that do not.
+func TestExtendedLe(t *testing.T) {
+	for _, short := range []bool{false, true} {
+		card := newCard(t)
+		card.ShortAPDUs = short
+
+		path := filepath.Join(t.TempDir(), "trace.jsonl")
+
+		tr, err := yubikeyscard.CreateTrace(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		yks := new(yubikeyscard.YubiKeys)
+		yk, err := yks.Attach(tr.Wrap(card))
+		if err != nil {
+			t.Fatalf("Attach() error = %v", err)
+		}
+
+		if _, err := yubikeyscard.ReadPublicKey(yk.Card, yubikeyscard.KeySlotEnc); err != nil {
+			t.Fatalf("ReadPublicKey() error = %v", err)
+		}
+
+		yks.Disconnect()
+		tr.Close()
+
+		trace, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the response to the public key read exceeds 256 bytes
+		_, rest, _ := bytes.Cut(trace, []byte(`"command":"004781`))
+		got := bytes.Count(rest, []byte(`"command":"00c0`))
+
+		if want := map[bool]int{false: 0, true: 1}[short]; got != want {
+			t.Errorf("short APDUs %v: public key read with %d GET RESPONSE, want %d", short, got, want)
+		}
+	}
+}